@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type Cache struct {
@@ -24,3 +29,140 @@ func (cache Cache) Has(module PuppetModule) bool {
 	}
 	return false
 }
+
+// fetchGroup makes sure modules sharing their cache, like a module
+// declared with several install paths, are only fetched once per run.
+// Their archive is then extracted once too, see lockArchive.
+type fetchGroup struct {
+	mu      sync.Mutex
+	fetches map[string]*fetchCall
+}
+
+type fetchCall struct {
+	done chan struct{}
+	derr DownloadError
+}
+
+var fetches = fetchGroup{fetches: make(map[string]*fetchCall)}
+
+// do runs fetch, unless it was already run successfully for the same
+// cache folder and version. Concurrent fetches wait for the first one.
+func (g *fetchGroup) do(m PuppetModule, fetch func() DownloadError) DownloadError {
+	key := m.CacheFolder()
+	if _, ok := m.(*GitModule); !ok {
+		// The version of unpinned modules is only known once fetched
+		if m.Version() == "" {
+			return fetch()
+		}
+		key += "@" + m.Version()
+	}
+
+	g.mu.Lock()
+	if c, ok := g.fetches[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		if c.derr.error == nil {
+			return c.derr
+		}
+		// Failed fetches are tried again, when retried
+		return g.do(m, fetch)
+	}
+	c := &fetchCall{done: make(chan struct{})}
+	g.fetches[key] = c
+	g.mu.Unlock()
+
+	c.derr = fetch()
+	if c.derr.error != nil {
+		g.mu.Lock()
+		delete(g.fetches, key)
+		g.mu.Unlock()
+	}
+	close(c.done)
+
+	return c.derr
+}
+
+type byModTime []os.FileInfo
+
+func (f byModTime) Len() int           { return len(f) }
+func (f byModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byModTime) Less(i, j int) bool { return f[i].ModTime().After(f[j].ModTime()) }
+
+// cacheUsage records the archives of the cache used by the modules of a
+// run, by cache folder
+type cacheUsage struct {
+	sync.Mutex
+	archives map[string]map[string]bool
+}
+
+// Archives used by the modules installed by the run, kept when pruning
+// the cache with --keep-cache-versions
+var usedArchives = cacheUsage{archives: make(map[string]map[string]bool)}
+
+// record records the archive the module was installed from. Unpinned
+// modules found up to date use the archive of their installed version.
+func (u *cacheUsage) record(m PuppetModule) {
+	a, ok := m.(archived)
+	if !ok {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	used, ok := u.archives[m.CacheFolder()]
+	if !ok {
+		used = make(map[string]bool)
+		u.archives[m.CacheFolder()] = used
+	}
+	used[path.Base(a.archive())] = true
+	if m.Version() == "" {
+		if version := installedVersion(m); version != "" {
+			used[version+".tar.gz"] = true
+		}
+	}
+}
+
+// prune prunes the cache folders of the modules of the run, see
+// pruneCache. It is run once the run succeeded, so that archives used
+// by any of its environments are kept.
+func (u *cacheUsage) prune(keep int) {
+	u.Lock()
+	defer u.Unlock()
+
+	for folder, used := range u.archives {
+		if err := pruneCache(folder, used, keep); err != nil {
+			warnf("failed pruning the cache folder %s: %v\n", folder, err)
+		}
+	}
+}
+
+// pruneCache removes the archives in the cache folder of a module, but
+// the keep most recent ones and those in used. Modules without a cache
+// folder, local modules for example, have nothing to prune.
+func pruneCache(folder string, used map[string]bool, keep int) error {
+	files, err := ioutil.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	archives := make([]os.FileInfo, 0, len(files))
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".tar.gz") {
+			archives = append(archives, f)
+		}
+	}
+	sort.Sort(byModTime(archives))
+
+	for i, f := range archives {
+		if i < keep || used[f.Name()] {
+			continue
+		}
+		// Locked, as it may be installed from concurrently
+		removeArchive(path.Join(folder, f.Name()))
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPruneCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 1.0.0 is the oldest version, 1.3.0 the most recent
+	now := time.Now()
+	for i, v := range []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0"} {
+		f := path.Join(dir, v+".tar.gz")
+		if err := ioutil.WriteFile(f, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-4) * time.Hour)
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1.0.0 and 1.1.0 are used by two environments of the run
+	usage := cacheUsage{archives: make(map[string]map[string]bool)}
+	for _, v := range []string{"1.0.0", "1.1.0"} {
+		usage.record(&ForgeModule{baseModule: baseModule{name: "acme/foo", cacheFolder: dir}, version: v})
+	}
+	usage.prune(1)
+
+	expected := map[string]bool{"1.0.0": true, "1.1.0": true, "1.2.0": false, "1.3.0": true}
+	for v, kept := range expected {
+		if _, err := os.Stat(path.Join(dir, v+".tar.gz")); (err == nil) != kept {
+			t.Errorf("version %s: expected kept to be %t", v, kept)
+		}
+	}
+
+	if err := pruneCache(path.Join(dir, "missing"), nil, 2); err != nil {
+		t.Errorf("expected missing cache folders to be ignored, got %v", err)
+	}
+}
+
+func TestFetchGroup(t *testing.T) {
+	g := fetchGroup{fetches: make(map[string]*fetchCall)}
+
+	var calls int32
+	fetch := func() DownloadError {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return DownloadError{nil, false}
+	}
+
+	// The same module, installed to two folders, and another version
+	modules := []PuppetModule{
+		&ForgeModule{baseModule: baseModule{name: "puppetlabs/ntp", cacheFolder: "cache/ntp", installPath: "site"}, version: "6.0.0"},
+		&ForgeModule{baseModule: baseModule{name: "puppetlabs/ntp", cacheFolder: "cache/ntp", installPath: "vendor"}, version: "6.0.0"},
+		&ForgeModule{baseModule: baseModule{name: "puppetlabs/ntp", cacheFolder: "cache/ntp"}, version: "5.0.0"},
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range modules {
+		wg.Add(1)
+		go func(m PuppetModule) {
+			defer wg.Done()
+			if derr := g.do(m, fetch); derr.error != nil {
+				t.Error(derr)
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	if calls != 2 {
+		t.Errorf("expected 2 fetches, got %d", calls)
+	}
+}
+
+func TestFetchGroupInstallPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{"metadata.json", "manifests/"}
+	for i := 0; i < 200; i++ {
+		files = append(files, fmt.Sprintf("manifests/class%d.pp", i))
+	}
+	archive := tarball(t, files).Bytes()
+
+	var downloads int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Write(archive)
+	}))
+	defer ts.Close()
+
+	// The same module, installed to several folders at once
+	var wg sync.WaitGroup
+	installPaths := []string{"site", "vendor", "dist", "legacy"}
+	for _, p := range installPaths {
+		m := &TarballModule{baseModule: baseModule{name: "acme/foo", cacheFolder: path.Join(dir, "cache"), envRoot: dir, installPath: p}, url: ts.URL + "/foo.tar.gz", version: "1.0.0"}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if derr := m.Download(); derr.error != nil {
+				t.Errorf("failed installing %s to %s: %v", m.Name(), m.TargetFolder(), derr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if downloads != 1 {
+		t.Errorf("expected 1 download, got %d", downloads)
+	}
+	for _, p := range installPaths {
+		if _, err := os.Stat(path.Join(dir, p, "foo", "manifests", "class199.pp")); err != nil {
+			t.Errorf("module was not installed to %s: %v", p, err)
+		}
+	}
+}
+
+// TestTarballCacheFolder installs a Forge module and a tarball module of
+// the same name and version, they must not share their cache folder
+func TestTarballCacheFolder(t *testing.T) {
+	forge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/files/acme-foo-1.0.0.tar.gz" {
+			w.Write(forgeArchive(t, "acme/foo", nil))
+			return
+		}
+		fmt.Fprintf(w, `{"results": [{"version": "1.0.0", "file_uri": "/v3/files/acme-foo-1.0.0.tar.gz"}]}`)
+	}))
+	defer forge.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball(t, []string{"metadata.json", "manifests/", "manifests/tarball.pp"}).Bytes())
+	}))
+	defer ts.Close()
+
+	defer func(urls []string) { forgeURLs = urls }(forgeURLs)
+	forgeURLs = []string{forge.URL + "/"}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modules := []PuppetModule{
+		&ForgeModule{baseModule: baseModule{name: "acme/foo", envRoot: dir, installPath: "forge"}, version: "1.0.0"},
+		&TarballModule{baseModule: baseModule{name: "acme/foo", envRoot: dir, installPath: "tarball"}, url: ts.URL + "/foo.tar.gz", version: "1.0.0"},
+	}
+	for _, m := range modules {
+		m.SetCacheFolder(path.Join(dir, "cache", m.Hash()))
+		if derr := m.Download(); derr.error != nil {
+			t.Fatalf("failed installing %s to %s: %v", m.Name(), m.TargetFolder(), derr)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "forge", "foo", "manifests", "init.pp")); err != nil {
+		t.Errorf("expected the Forge module to be installed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "tarball", "foo", "manifests", "tarball.pp")); err != nil {
+		t.Errorf("expected the tarball module to be installed: %v", err)
+	}
+}
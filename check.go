@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// prober is implemented by modules whose source can be checked to be
+// reachable without downloading them
+type prober interface {
+	probe() error
+}
+
+// checkResult is the result of the probe of a module
+type checkResult struct {
+	m   PuppetModule
+	err error
+}
+
+// checkModules verifies that the sources of the modules of the
+// Puppetfiles are reachable, with up to workers probes at once, and
+// prints the result of each module to out. Dependencies are not
+// checked. Returns the number of modules that could not be reached.
+func checkModules(out io.Writer, puppetfiles []string, workers int) int {
+	var modules []PuppetModule
+	nErr := 0
+
+	for _, puppetfile := range puppetfiles {
+		pf := NewPuppetFile(puppetfile, "")
+		m, err := pf.load()
+		pf.Close()
+		if err != nil {
+			log.Printf("failed parsing %s: %v\n", puppetfile, err)
+			nErr++
+			continue
+		}
+		modules = append(modules, m...)
+	}
+
+	results := make([]checkResult, len(modules))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 1; w <= workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = checkResult{m: modules[i]}
+				if p, ok := modules[i].(prober); ok {
+					results[i].err = p.probe()
+				}
+			}
+		}()
+	}
+
+	for i := range modules {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	// Results are printed in the order modules are declared
+	for _, r := range results {
+		d := dumpModule(r.m)
+		source := strings.TrimSpace(d.Type + " " + d.Source)
+		if r.err != nil {
+			fmt.Fprintf(out, "FAIL %s (%s): %v\n", r.m.Name(), source, r.err)
+			nErr++
+			continue
+		}
+		fmt.Fprintf(out, "ok   %s (%s)\n", r.m.Name(), source)
+	}
+
+	return nErr
+}
+
+// probeURL sends a HEAD request to url, falling back to a GET request
+// if the server does not support them. The body is never read.
+func probeURL(url string) error {
+	resp, err := httpHead(url)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		resp, err = httpGet(url)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound{fmt.Sprintf("%s not found", url)}
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("failed retrieving %s - %s", url, resp.Status)
+	}
+
+	return nil
+}
+
+// probe lists the references of the repository, without prompting for
+// credentials
+func (m *GitModule) probe() error {
+	cmd := gitCmd("ls-remote", convertGitProtocol(rewriteURL(m.repoURL)), "HEAD")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		// The first line is enough to tell what failed
+		if output := strings.TrimSpace(string(output)); output != "" {
+			return fmt.Errorf("%v: %s", err, strings.SplitN(output, "\n", 2)[0])
+		}
+		return err
+	}
+
+	return nil
+}
+
+// probe resolves the release of the module on the Forge, and checks
+// its archive can be downloaded
+func (m *ForgeModule) probe() error {
+	url, err := m.downloadURL()
+	if err != nil {
+		return err
+	}
+
+	return probeURL(rewriteURL(strings.TrimSuffix(m.mirror, "/") + url))
+}
+
+// probe resolves the version of the module, and checks its archive
+// can be downloaded
+func (m *GithubTarballModule) probe() error {
+	url, err := m.downloadURL()
+	if err != nil {
+		return err
+	}
+
+	return probeURL(rewriteURL(url))
+}
+
+func (m *TarballModule) probe() error {
+	return probeURL(rewriteURL(m.url))
+}
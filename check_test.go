@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCheckModules(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("expected a HEAD request, got %s", r.Method)
+		}
+		if r.URL.Path != "/foo-1.0.0.tar.gz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	puppetfile := path.Join(dir, "Puppetfile")
+	content := "mod 'acme/foo', :tarball => '" + ts.URL + "/foo-1.0.0.tar.gz'\n" +
+		"mod 'acme/bar', :tarball => '" + ts.URL + "/bar-1.0.0.tar.gz'\n"
+	if err := ioutil.WriteFile(puppetfile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if nErr := checkModules(&out, []string{puppetfile}, 2); nErr != 1 {
+		t.Errorf("expected 1 unreachable module, got %d", nErr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ok   acme/foo") || !strings.HasPrefix(lines[1], "FAIL acme/bar") {
+		t.Errorf("unexpected output: %q", lines)
+	}
+}
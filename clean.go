@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// Files and folders of which a module has at least one, modules may
+// only provide functions, types, facts, tasks or Hiera data for example
+var moduleContent = []string{
+	"metadata.json", "manifests", "lib", "templates", "files",
+	"functions", "types", "data", "tasks", "plans", "facts.d", "hiera.yaml",
+}
+
+// isOrphan returns true if folder is empty, or has no module content,
+// like the leftover of a failed installation
+func isOrphan(folder string) (bool, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return false, err
+	}
+
+	for _, f := range files {
+		for _, c := range moduleContent {
+			if f.Name() == c {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// cleanOrphans removes the folders in modulePath that are not modules.
+// Returns the number of errors.
+func cleanOrphans(modulePath string) int {
+	folders, err := ioutil.ReadDir(modulePath)
+	if err != nil {
+		log.Printf("failed listing modules in %s: %v\n", modulePath, err)
+		return 1
+	}
+
+	nErr := 0
+	for _, f := range folders {
+		if !f.IsDir() {
+			continue
+		}
+
+		folder := path.Join(modulePath, f.Name())
+		orphan, err := isOrphan(folder)
+		if err != nil {
+			log.Printf("failed reading %s: %v\n", folder, err)
+			nErr++
+			continue
+		}
+		if !orphan {
+			continue
+		}
+
+		if err := os.RemoveAll(folder); err != nil {
+			log.Printf("failed removing %s: %v\n", folder, err)
+			nErr++
+			continue
+		}
+		log.Printf("Removed %s\n", folder)
+	}
+
+	return nErr
+}
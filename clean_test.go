@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCleanOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]bool{ // File to create, and whether its module should be kept
+		"apache/metadata.json":     true,
+		"ntp/manifests/init.pp":    true,
+		"types/lib/puppet/type.rb": true,
+		"data/hiera.yaml":          true,
+		"tasks/tasks/run.sh":       true,
+		"funcs/functions/f.pp":     true,
+		"broken/.version":          false,
+		"empty/":                   false,
+	}
+	for f := range files {
+		if err := os.MkdirAll(path.Join(dir, path.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if f[len(f)-1] != '/' {
+			if err := ioutil.WriteFile(path.Join(dir, f), []byte{}, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if nErr := cleanOrphans(dir); nErr != 0 {
+		t.Errorf("expected no error cleaning %s, got %d", dir, nErr)
+	}
+
+	for f, kept := range files {
+		if _, err := os.Stat(path.Join(dir, path.Dir(f))); (err == nil) != kept {
+			t.Errorf("expected %s to be kept: %t", path.Dir(f), kept)
+		}
+	}
+}
@@ -9,18 +9,79 @@ func cli() map[string]interface{} {
 	usage := `r10k-go
 
 Usage:
-  r10k-go install [--modulePath=<PATH>] [--no-deps] [--puppetfile=<PUPPETFILE>] [--workers=<n>]
-  r10k-go deploy environment <env> [--workers=<n>]
+  r10k-go install [--pin=<module=version>]... [options]
+  r10k-go deploy environment <env> [--pin=<module=version>]... [options]
+  r10k-go validate [options]
+  r10k-go check [options]
+  r10k-go dump [--pin=<module=version>]... [options]
+  r10k-go diff <old> <new> [options]
+  r10k-go prefetch [--pin=<module=version>]... [options]
+  r10k-go clean --orphans [options]
   r10k-go -h | --help
   r10k-go --version
 
 Options:
   -h --help                   Show this screen.
-  --modulesPath=<PATH>        Path to the modules folder
+  --allow-prerelease          Allow prereleases as latest version of GitHub tarball modules
+  --cache-only                Only download modules to the cache with install, without extracting them
+  --cachedir=<dir>            Folder of the cache of modules, .cache by default
+  --check-inodes              Abort before installing modules whose files would exhaust the inodes of the filesystem
+  --chown=<user:group>        Change the owner of the files of installed modules, requires root
+  --compare-content           Do not extract modules again if their files match the cached archive
+  --connect-timeout=<s>       Seconds to wait for connections to Forge and GitHub servers [default: 30]
+  --dependency-workers=<n>    Number of metadata.json files to resolve dependencies from in parallel [default: 4]
+  --deploy-timeout=<s>        Abort the run if it lasts more than this number of seconds
+  --dir-mode=<mode>           Octal permissions of the folders of modules installed from archives, 0750 for example
+  --env-depth=<n>             Number of commits of the history of the environment to fetch
+  --file-mode=<mode>          Octal permissions of the files of modules installed from archives, overriding those of the archive
+  --fsync                     Flush modules installed from archives to disk before marking them as installed
+  --git-binary=<path>         Path of the git command to run, git from the PATH by default
+  --git-protocol=<protocol>   Convert git remotes to https or ssh before cloning
+  --keep-cache-versions=<n>   Number of versions of each module to keep in the cache
+  --keep-going                Continue deploying other sources when one can not be cloned or its Puppetfile is malformed
+  --keyring=<GNUPGHOME>       GnuPG home directory holding the keys of allowed signers
+  --log-dir=<dir>             Also write the log of each module to <dir>/<module>.log
+  --manifest=<file>           Write the exact sources of the modules deployed to this JSON file
+  --max-archive-size=<size>   Refuse to download archives larger than this, in bytes or with a K, M or G suffix
+  --max-extract-size=<size>   Refuse to extract archives whose content is larger than this
+  --max-load=<load>           Wait for the load average to drop below this value to install more modules
+  --max-workers=<n>           Maximum number of workers with --workers auto [default: 32]
+  --metrics-file=<file>       Write metrics of the run to this file, for the textfile collector of node_exporter
+  --modulePath=<PATH>         Path to the modules folder, relative to the environment unless absolute
+  --modules-from=<file>       Only install the modules listed in this file, one per line
   --no-deps                   Skip downloading modules dependencies
-  --puppetFile=<PUPPETFILE>   Path to the modules folder
+  --not-found-ttl=<s>         Seconds missing GitHub repositories and versions are cached for, 0 to disable [default: 300]
+  --only                      Only deploy environments that changed since their last deployment
+  --only-changed              Only log changed modules, and the number of unchanged ones
+  --only-deps                 Only install the dependencies of the modules of the Puppetfile, not the modules themselves
+  --output=<format>           Format of the output of diff, text or json [default: text]
+  --orphans                   Remove the folders of the module path that are not modules
+  --parallel-extract          Write the files of archives larger than 16MB concurrently
+  --pin=<module=version>      Force the version of a module, or the ref of a git module, in all Puppetfiles
+  --purge                     Remove folders of module paths that are not modules of the Puppetfile
+  --puppet-version=<version>  Warn about modules not supporting this version of Puppet
+  --puppetfile=<PUPPETFILE>   Path to the Puppetfile
+  --puppetfile-dir=<dir>      Install the modules of all *.Puppetfile and Puppetfile.* files of this folder
+  --read-timeout=<s>          Seconds without receiving data before a download is aborted [default: 60]
+  --ref-type=<type>           Whether <env> is a branch, tag or commit of the control repo, or auto [default: auto]
+  --refresh=<modules>         Download these modules again even if they are in the cache, comma separated
+  --require-pinned            Refuse Puppetfiles with modules not pinned to a version, ref or tag
+  --result-buffer=<n>         Number of download results to queue, defaults to the number of workers
+  --retry-budget=<n>          Maximum number of retries of failed downloads, across all modules
+  --schedule-by-size          Install the largest modules first, by their size in the cache
+  --source=<name>             Only deploy the environment from this source of r10k.yml
+  --status-addr=<addr>        Serve the progress of the run as JSON on this address, :8080 for example
+  --ssh-host-keys=<policy>    Verification of the keys of git SSH servers: accept-new, yes or no [default: accept-new]
+  --ssh-known-hosts=<file>    known_hosts file the keys of git SSH servers are verified against
+  --stats                     Display statistics of the run
+  --strict-warnings           Fail if any warning was logged
+  --target-os=<os>            Skip modules not supporting this OS, RedHat or RedHat-8 for example
+  --tmpdir=<dir>              Folder of temporary files, TMPDIR by default
+  --trace                     Log details of HTTP downloads, like redirects
+  --update-in-place           Update checkouts of git modules instead of removing and checking them out again
+  --verify-signature          Refuse to deploy environments without a valid GPG signature
   --version                   Displays the version.
-  --workers=<n>               Number of modules to download in parallel
+  --workers=<n>               Number of modules to download in parallel, or auto to scale with the number of CPUs
 `
 
 	opts, _ := docopt.Parse(usage, nil, true, "0.1", false)
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With --compare-content, modules whose files match the content of the
+// archive in the cache are not extracted again
+var compareContent bool
+
+// contentReuser is implemented by modules installed from archives
+type contentReuser interface {
+	// reuseContent returns true if the module is installed with the
+	// content of its archive, and marks it up to date
+	reuseContent() bool
+}
+
+// contentHash hashes files, a map of file names to the hash of their content
+func contentHash(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hasher := sha1.New()
+	for _, name := range names {
+		io.WriteString(hasher, name+"\x00"+files[name]+"\x00")
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func hashReader(r io.Reader) (string, error) {
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// archiveHash returns the hash of the files the archive extracts to,
+// with the strip leading components of their paths removed
+func archiveHash(archive string, strip int) (string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gzf, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+
+	files := make(map[string]string)
+	tarReader := tar.NewReader(gzf)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		namePath := strings.Split(strings.Trim(header.Name, "/"), "/")
+		if len(namePath) <= strip {
+			continue
+		}
+		name := strings.Join(namePath[strip:], "/")
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if files[name], err = hashReader(tarReader); err != nil {
+				return "", err
+			}
+		case tar.TypeSymlink:
+			files[name] = "-> " + header.Linkname
+		}
+	}
+
+	return contentHash(files), nil
+}
+
+// folderHash returns the hash of the files in folder, but .version
+func folderHash(folder string) (string, error) {
+	files := make(map[string]string)
+
+	err := filepath.Walk(folder, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(folder, p)
+		if err != nil || name == ".version" {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			files[name] = "-> " + link
+
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			files[name], err = hashReader(f)
+			f.Close()
+			return err
+		}
+
+		return nil
+	})
+
+	return contentHash(files), err
+}
+
+// reuseExtracted returns true if targetFolder has the content of the
+// archive, after writing version to its .version file
+func reuseExtracted(archive string, strip int, targetFolder string, version string) bool {
+	expected, err := archiveHash(archive, strip)
+	if err != nil {
+		return false
+	}
+
+	if actual, err := folderHash(targetFolder); err != nil || actual != expected {
+		return false
+	}
+
+	return writeVersion(targetFolder, version) == nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReuseExtracted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "1.0.0.tar.gz")
+	files := []string{"apache-1.0.0/", "apache-1.0.0/metadata.json", "apache-1.0.0/manifests/", "apache-1.0.0/manifests/init.pp"}
+	if err := ioutil.WriteFile(archive, tarball(t, files).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := path.Join(dir, "apache")
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := extract(f, target, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reuseExtracted(archive, 1, target, "1.0.0") {
+		t.Error("expected the extracted module to be reused")
+	}
+	if version, _ := ioutil.ReadFile(path.Join(target, ".version")); string(version) != "1.0.0" {
+		t.Errorf("expected version file to contain 1.0.0, got %s", version)
+	}
+
+	if err := ioutil.WriteFile(path.Join(target, "manifests", "init.pp"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if reuseExtracted(archive, 1, target, "1.0.0") {
+		t.Error("expected a modified module not to be reused")
+	}
+}
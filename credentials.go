@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+)
+
+// credential is the HTTP basic auth login for a host. The password
+// can be read from the environment variable PasswordEnv, to keep it
+// out of r10k.yml
+type credential struct {
+	Username    string
+	Password    string
+	PasswordEnv string `yaml:"password_env"`
+}
+
+// Credentials used to download modules, by host
+var httpCredentials map[string]credential
+
+func (c credential) password() string {
+	if c.PasswordEnv != "" {
+		return os.Getenv(c.PasswordEnv)
+	}
+
+	return c.Password
+}
+
+// String masks the password, so credentials can be logged safely
+func (c credential) String() string {
+	return c.Username + ":********"
+}
+
+// setCredentials adds the basic auth header to requests to hosts we
+// have credentials for. Hosts can be given with or without port.
+func setCredentials(req *http.Request) {
+	c, ok := httpCredentials[req.URL.Host]
+	if !ok {
+		host, _, err := net.SplitHostPort(req.URL.Host)
+		if err != nil {
+			return
+		}
+		if c, ok = httpCredentials[host]; !ok {
+			return
+		}
+	}
+
+	req.SetBasicAuth(c.Username, c.password())
+}
+
+// httpGet is http.Get, with credentials for the host if there are any
+func httpGet(url string) (*http.Response, error) {
+	return httpRequest("GET", url)
+}
+
+// httpHead is http.Head, with credentials for the host if there are any
+func httpHead(url string) (*http.Response, error) {
+	return httpRequest("HEAD", url)
+}
+
+func httpRequest(method string, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(runContext)
+	setCredentials(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, redirectError(url, err)
+	}
+	if final := resp.Request.URL.String(); final != url {
+		tracef("%s resolved to %s\n", url, final)
+	}
+
+	return resp, nil
+}
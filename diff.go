@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// moduleChange is a difference between the modules of two Puppetfiles
+type moduleChange struct {
+	Name   string        `json:"name"`
+	Change string        `json:"change"` // added, removed or changed
+	Old    *dumpedModule `json:"old,omitempty"`
+	New    *dumpedModule `json:"new,omitempty"`
+}
+
+// diffModules returns the modules added, removed or changed between the
+// modules of two Puppetfiles, old and updated, sorted by name
+func diffModules(old, updated []PuppetModule) []moduleChange {
+	dumped := func(modules []PuppetModule) map[string]dumpedModule {
+		d := make(map[string]dumpedModule)
+		for _, m := range modules {
+			d[normalizeModuleName(m.Name())] = dumpModule(m)
+		}
+		return d
+	}
+	before, after := dumped(old), dumped(updated)
+
+	changes := []moduleChange{}
+	for name, o := range before {
+		o := o
+		n, ok := after[name]
+		if !ok {
+			changes = append(changes, moduleChange{Name: o.Name, Change: "removed", Old: &o})
+			continue
+		}
+
+		// puppetlabs/apache and puppetlabs-apache are the same module
+		renamed := n
+		renamed.Name = o.Name
+		if !reflect.DeepEqual(o, renamed) {
+			changes = append(changes, moduleChange{Name: n.Name, Change: "changed", Old: &o, New: &n})
+		}
+	}
+	for name, n := range after {
+		n := n
+		if _, ok := before[name]; !ok {
+			changes = append(changes, moduleChange{Name: n.Name, Change: "added", New: &n})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return normalizeModuleName(changes[i].Name) < normalizeModuleName(changes[j].Name)
+	})
+
+	return changes
+}
+
+// changedParameters returns the parameters of a module that differ
+// between from and to, by their name in the JSON dump
+func changedParameters(from, to dumpedModule) []string {
+	var changed []string
+
+	o, n := reflect.ValueOf(from), reflect.ValueOf(to)
+	for i := 0; i < o.NumField(); i++ {
+		field := o.Type().Field(i)
+		if field.Name == "Name" || reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+		changed = append(changed, strings.Split(field.Tag.Get("json"), ",")[0])
+	}
+
+	return changed
+}
+
+// describeVersion returns what version of a module is installed
+func describeVersion(d dumpedModule) string {
+	switch {
+	case d.Version != "":
+		return d.Version
+	case d.Ref != "":
+		return "ref " + d.Ref
+	case d.Tag != "":
+		return "tag " + d.Tag
+	case d.Branch != "":
+		return "branch " + d.Branch
+	case d.TagPattern != "":
+		return "latest tag matching " + d.TagPattern
+	default:
+		return "latest"
+	}
+}
+
+// describeSource returns where a module is downloaded from
+func describeSource(d dumpedModule) string {
+	source := strings.TrimSpace(d.Type + " " + d.Source)
+	if d.Subdir != "" {
+		source += " " + d.Subdir
+	}
+
+	return source
+}
+
+// printDiff writes the changes between two Puppetfiles to w, one per
+// line, or as a JSON array if format is json
+func printDiff(w io.Writer, changes []moduleChange, format string) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+
+	case "text":
+		for _, c := range changes {
+			switch c.Change {
+			case "added":
+				fmt.Fprintf(w, "+ %s %s (%s)\n", c.Name, describeVersion(*c.New), describeSource(*c.New))
+			case "removed":
+				fmt.Fprintf(w, "- %s %s (%s)\n", c.Name, describeVersion(*c.Old), describeSource(*c.Old))
+			default:
+				from, to := describeVersion(*c.Old), describeVersion(*c.New)
+				if fromSource, toSource := describeSource(*c.Old), describeSource(*c.New); fromSource != toSource {
+					from, to = from+" ("+fromSource+")", to+" ("+toSource+")"
+				}
+				if from == to {
+					// Another parameter changed, install_path for example
+					fmt.Fprintf(w, "~ %s %s (%s changed)\n", c.Name, from, strings.Join(changedParameters(*c.Old, *c.New), ", "))
+					continue
+				}
+				fmt.Fprintf(w, "~ %s %s -> %s\n", c.Name, from, to)
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown output format %s, should be text or json", format)
+	}
+}
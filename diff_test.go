@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffModules(t *testing.T) {
+	parse := func(lines ...string) []PuppetModule {
+		pf := PuppetFile{}
+		var modules []PuppetModule
+		for _, line := range lines {
+			m, err := pf.parseModule(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modules = append(modules, m)
+		}
+		return modules
+	}
+
+	old := parse(
+		"mod 'puppetlabs/apache', '5.0.0'",
+		"mod 'puppetlabs/ntp', '0.0.3'",
+		"mod 'acme/foo', :git => 'https://git.example.com/foo.git', :tag => 'v1'",
+		"mod 'acme/bar', :git => 'https://git.example.com/bar.git', :tag => 'v1'",
+		"mod 'puppetlabs/stdlib', '4.0.0'",
+	)
+	updated := parse(
+		"mod 'puppetlabs-apache', '5.1.0'",
+		"mod 'acme/foo', :git => 'https://git.example.com/fork/foo.git', :tag => 'v1'",
+		"mod 'acme/bar', :git => 'https://git.example.com/bar.git', :tag => 'v1', :install_path => 'site'",
+		"mod 'puppetlabs/stdlib', '4.0.0'",
+		"mod 'puppetlabs/concat', '2.0.0'",
+	)
+
+	var out bytes.Buffer
+	if err := printDiff(&out, diffModules(old, updated), "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `~ acme/bar tag v1 (install_path changed)
+~ acme/foo tag v1 (git https://git.example.com/foo.git) -> tag v1 (git https://git.example.com/fork/foo.git)
+~ puppetlabs-apache 5.0.0 -> 5.1.0
++ puppetlabs/concat 2.0.0 (forge)
+- puppetlabs/ntp 0.0.3 (forge)
+`
+	if out.String() != expected {
+		t.Errorf("expected diff:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := printDiff(&out, diffModules(updated, updated), "json"); err != nil {
+		t.Fatal(err)
+	}
+	var changes []moduleChange
+	if err := json.Unmarshal(out.Bytes(), &changes); err != nil || len(changes) != 0 {
+		t.Errorf("expected no change, got %s (%v)", out.String(), err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// ErrDiskFull is returned when the filesystem holding path does not have
+// enough space left. Retrying can not succeed, the run should be aborted.
+type ErrDiskFull struct {
+	path      string
+	needed    int64
+	available uint64
+	inodes    bool // needed and available are numbers of inodes, not bytes
+}
+
+func (e ErrDiskFull) Error() string {
+	if e.inodes {
+		return fmt.Sprintf("not enough inodes left on %s to create %s: %d files needed, %d available",
+			mountPoint(existingParent(e.path)), e.path, e.needed, e.available)
+	}
+
+	if e.needed > 0 {
+		return fmt.Sprintf("not enough space left on %s to write %s: %d bytes needed, %d available",
+			mountPoint(existingParent(e.path)), e.path, e.needed, e.available)
+	}
+
+	return fmt.Sprintf("no space left on %s while writing %s", mountPoint(existingParent(e.path)), e.path)
+}
+
+// isNoSpaceLeft returns true if err was caused by a full filesystem
+func isNoSpaceLeft(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	return err == syscall.ENOSPC
+}
+
+// existingParent returns p, or its closest parent folder that exists
+func existingParent(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+
+		parent := path.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
+
+// checkFreeSpace returns an ErrDiskFull if writing needed bytes to p would
+// fill its filesystem. Filesystems we can not query are assumed to have
+// enough space.
+func checkFreeSpace(p string, needed int64) error {
+	if needed <= 0 {
+		return nil
+	}
+
+	available, err := freeSpace(existingParent(p))
+	if err != nil {
+		return nil
+	}
+
+	if uint64(needed) > available {
+		return ErrDiskFull{path: p, needed: needed, available: available}
+	}
+
+	return nil
+}
+
+// With --check-inodes, the number of files of modules is estimated before
+// they are installed, to abort before the filesystem runs out of inodes
+var checkInodes bool
+
+// Inodes reserved by the modules being installed, by mount point, as
+// the inodes they use are only freed from the filesystem as they are
+// created
+var inodeReservations = struct {
+	sync.Mutex
+	reserved map[string]int64
+}{reserved: make(map[string]int64)}
+
+// reserveInodes returns an ErrDiskFull if creating needed files in p
+// would use all the inodes of its filesystem, counting those reserved by
+// modules installed concurrently, and reserves them until the returned
+// function is called. Filesystems not reporting their inodes are assumed
+// to have enough.
+func reserveInodes(p string, needed int64) (func(), error) {
+	if !checkInodes || needed <= 0 {
+		return func() {}, nil
+	}
+
+	p = existingParent(p)
+	available, err := freeInodes(p)
+	if err != nil {
+		return func() {}, nil
+	}
+
+	fs := mountPoint(p)
+	inodeReservations.Lock()
+	defer inodeReservations.Unlock()
+
+	if reserved := uint64(inodeReservations.reserved[fs]); reserved < available {
+		available -= reserved
+	} else {
+		available = 0
+	}
+	if uint64(needed) > available {
+		return func() {}, ErrDiskFull{path: p, needed: needed, available: available, inodes: true}
+	}
+
+	inodeReservations.reserved[fs] += needed
+	return func() {
+		inodeReservations.Lock()
+		inodeReservations.reserved[fs] -= needed
+		inodeReservations.Unlock()
+	}, nil
+}
+
+// countFiles returns the number of files and folders in folder, and how
+// many of them are folders or symlinks, which are created again instead
+// of being hard linked when installing a copy of folder
+func countFiles(folder string) (int64, int64, error) {
+	var n, dirs int64
+	err := filepath.Walk(folder, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		n++
+		if fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 {
+			dirs++
+		}
+		return nil
+	})
+
+	return n, dirs, err
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+func freeSpace(p string) (uint64, error) {
+	return 0, errors.New("checking free space is not supported on this platform")
+}
+
+func freeInodes(p string) (uint64, error) {
+	return 0, errors.New("checking free inodes is not supported on this platform")
+}
+
+func mountPoint(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
@@ -0,0 +1,56 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem holding p
+func freeSpace(p string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// freeInodes returns the number of inodes available on the filesystem
+// holding p
+func freeInodes(p string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, err
+	}
+
+	// Filesystems allocating inodes dynamically, like btrfs, report none
+	if st.Files == 0 {
+		return 0, errors.New("the filesystem does not report its inodes")
+	}
+
+	return uint64(st.Ffree), nil
+}
+
+// mountPoint returns the mount point of the filesystem holding p
+func mountPoint(p string) string {
+	var st syscall.Stat_t
+
+	p, err := filepath.Abs(p)
+	if err != nil || syscall.Stat(p, &st) != nil {
+		return p
+	}
+
+	dev := st.Dev
+	for {
+		parent := filepath.Dir(p)
+		if parent == p || syscall.Stat(parent, &st) != nil || st.Dev != dev {
+			return p
+		}
+		p = parent
+	}
+}
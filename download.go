@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// removePartial removes the interrupted download of file, which can not
+// be resumed once what it is downloaded from changed: the tip of a
+// branch, or an archive generated by another server
+func removePartial(file string) {
+	os.Remove(file + ".part")
+	os.Remove(file + ".part.size")
+}
+
+// downloadFile downloads url to file. Data is written to file.part, which is
+// only moved to file once complete, so that a file present in the cache is
+// always complete. When a previous download was interrupted, it is resumed
+// using an HTTP range request - or restarted if the server does not
+// support them.
+func downloadFile(url string, file string) error {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed creating folder %s: %v", path.Dir(file), err)
+	}
+
+	partFile := file + ".part"
+	sizeFile := partFile + ".size"
+
+	var offset int64
+	if fi, err := os.Stat(partFile); err == nil {
+		offset = fi.Size()
+	}
+
+	if expected := readExpectedSize(sizeFile); offset > 0 && offset == expected {
+		return completeDownload(partFile, file)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(runContext)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	setCredentials(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return redirectError(url, err)
+	}
+	if final := resp.Request.URL.String(); final != url {
+		tracef("%s resolved to %s\n", url, final)
+	}
+	defer resp.Body.Close()
+
+	var size int64
+	flags := os.O_WRONLY | os.O_CREATE
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			os.Remove(partFile)
+			return fmt.Errorf("failed resuming download of %s, invalid Content-Range", url)
+		}
+		flags |= os.O_APPEND
+		size = total
+
+	case resp.StatusCode == http.StatusOK:
+		// Either a new download, or the server does not support range requests
+		offset = 0
+		flags |= os.O_TRUNC
+		size = resp.ContentLength
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The remote file changed since the download started
+		os.Remove(partFile)
+		return fmt.Errorf("failed resuming download of %s - %s", url, resp.Status)
+
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound{fmt.Sprintf("%s not found", url)}
+
+	default:
+		return fmt.Errorf("failed retrieving %s - %s", url, resp.Status)
+	}
+
+	if maxArchiveSize > 0 && size > maxArchiveSize {
+		os.Remove(partFile)
+		return ErrTooLarge{what: url, limit: maxArchiveSize}
+	}
+
+	if size >= 0 {
+		if err := ioutil.WriteFile(sizeFile, []byte(strconv.FormatInt(size, 10)), 0644); err != nil {
+			return writeError(sizeFile, err)
+		}
+		if err := checkFreeSpace(file, size-offset); err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(partFile, flags, 0644)
+	if err != nil {
+		return writeError(partFile, err)
+	}
+	defer out.Close()
+
+	// The size announced by the server is not trusted
+	body := io.Reader(resp.Body)
+	if maxArchiveSize > 0 {
+		body = io.LimitReader(resp.Body, maxArchiveSize-offset+1)
+	}
+
+	written, err := io.Copy(out, body)
+	atomic.AddInt64(&stats.bytes, written)
+	if maxArchiveSize > 0 && offset+written > maxArchiveSize {
+		out.Close()
+		os.Remove(partFile)
+		return ErrTooLarge{what: url, limit: maxArchiveSize}
+	}
+	if err != nil {
+		if isNoSpaceLeft(err) {
+			os.Remove(partFile)
+			return ErrDiskFull{path: file}
+		}
+		return fmt.Errorf("failed downloading %s: %v", url, err)
+	}
+
+	if size >= 0 && offset+written != size {
+		return fmt.Errorf("failed downloading %s: got %d bytes out of %d", url, offset+written, size)
+	}
+
+	return completeDownload(partFile, file)
+}
+
+func completeDownload(partFile string, file string) error {
+	os.Remove(partFile + ".size")
+	return os.Rename(partFile, file)
+}
+
+// readExpectedSize returns the size recorded for an interrupted download,
+// or -1 if it is unknown
+func readExpectedSize(sizeFile string) int64 {
+	b, err := ioutil.ReadFile(sizeFile)
+	if err != nil {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return size
+}
+
+// parseContentRange parses a Content-Range header, such as
+// "bytes 200-1000/1001", returning the first byte and the total size
+// (-1 if unknown)
+func parseContentRange(contentRange string) (int64, int64, error) {
+	var start, end int64
+	var total string
+
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %s", contentRange)
+	}
+
+	if total == "*" {
+		return start, -1, nil
+	}
+
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %s", contentRange)
+	}
+
+	return start, size, nil
+}
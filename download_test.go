@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileResume(t *testing.T) {
+	content := bytes.Repeat([]byte("r10k-go"), 1000)
+
+	testCases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "server supporting range requests",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "module.tar.gz", time.Time{}, bytes.NewReader(content))
+			},
+		}, {
+			name: "server not supporting range requests",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		ts := httptest.NewServer(c.handler)
+
+		dir, err := ioutil.TempDir("", "r10k-go")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file := path.Join(dir, "1.0.0.tar.gz")
+		// Simulate an interrupted download
+		if err := ioutil.WriteFile(file+".part", content[:1000], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := downloadFile(ts.URL, file); err != nil {
+			t.Errorf("%s: failed downloading: %v", c.name, err)
+		}
+
+		downloaded, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("%s: failed reading downloaded file: %v", c.name, err)
+		} else if !bytes.Equal(downloaded, content) {
+			t.Errorf("%s: downloaded file is corrupt, got %d bytes, expected %d", c.name, len(downloaded), len(content))
+		}
+
+		if _, err := os.Stat(file + ".part"); err == nil {
+			t.Errorf("%s: partial download was not removed", c.name)
+		}
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDownloadFileCredentials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "deploy" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("r10k-go"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func() { httpCredentials = nil }()
+	httpCredentials = map[string]credential{"127.0.0.1": {Username: "deploy", Password: "secret"}}
+
+	if err := downloadFile(ts.URL, path.Join(dir, "1.0.0.tar.gz")); err != nil {
+		t.Errorf("failed downloading with credentials: %v", err)
+	}
+}
+
+func TestDownloadFileRedirects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Credentials for 127.0.0.1 must not be sent to localhost
+	leaked := false
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, leaked = r.BasicAuth()
+		w.Write([]byte("r10k-go"))
+	}))
+	defer other.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1)+"/archive.tar.gz", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	defer func() { httpCredentials = nil }()
+	httpCredentials = map[string]credential{"127.0.0.1": {Username: "deploy", Password: "secret"}}
+
+	if err := downloadFile(ts.URL+"/module.tar.gz", path.Join(dir, "1.0.0.tar.gz")); err != nil {
+		t.Errorf("failed downloading redirected URL: %v", err)
+	}
+	if leaked {
+		t.Error("credentials were sent to the host of the redirect")
+	}
+
+	err = downloadFile(ts.URL+"/loop", path.Join(dir, "2.0.0.tar.gz"))
+	if err == nil || !strings.Contains(err.Error(), "redirect") {
+		t.Errorf("expected a redirect error, got %v", err)
+	}
+}
+
+func TestDownloadFileMaxSize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Chunked, the size is not known in advance
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 2048))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func() { maxArchiveSize = 0 }()
+	maxArchiveSize = 1024
+
+	file := path.Join(dir, "1.0.0.tar.gz")
+	if err := downloadFile(ts.URL, file); err == nil {
+		t.Fatal("expected an error downloading a file larger than the maximum")
+	} else if _, ok := err.(ErrTooLarge); !ok {
+		t.Errorf("expected an ErrTooLarge, got %v", err)
+	}
+
+	if _, err := os.Stat(file + ".part"); err == nil {
+		t.Errorf("the partial download should have been removed")
+	}
+}
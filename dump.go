@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// dumpedModule is the JSON representation of a module declared in a Puppetfile
+type dumpedModule struct {
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`
+	Source        string   `json:"source,omitempty"`
+	Version       string   `json:"version,omitempty"`
+	Ref           string   `json:"ref,omitempty"`
+	Tag           string   `json:"tag,omitempty"`
+	Branch        string   `json:"branch,omitempty"`
+	DefaultBranch string   `json:"default_branch,omitempty"`
+	InstallPath   string   `json:"install_path,omitempty"`
+	TagPattern    string   `json:"tag_pattern,omitempty"`
+	Subdir        string   `json:"subdir,omitempty"`
+	Checksum      string   `json:"checksum,omitempty"`
+	After         string   `json:"after,omitempty"`
+	IgnoreMissing bool     `json:"ignore_missing,omitempty"`
+	Default       bool     `json:"default,omitempty"` // Declared with :default, intentionally not pinned
+	PostExtract   []string `json:"postextract,omitempty"`
+}
+
+// dumpModule describes a parsed module, without resolving its source
+func dumpModule(m PuppetModule) dumpedModule {
+	d := dumpedModule{
+		Name:          m.Name(),
+		After:         m.After(),
+		IgnoreMissing: m.IgnoreMissing(),
+		PostExtract:   m.PostExtract(),
+	}
+
+	if u, ok := m.(interface {
+		isUnpinned() bool
+	}); ok {
+		d.Default = u.isUnpinned()
+	}
+
+	switch m := m.(type) {
+	case *ForgeModule:
+		d.Type, d.Version = "forge", m.version
+	case *GithubTarballModule:
+		d.Type, d.Source, d.Version, d.Branch = "github_tarball", m.repoName, m.version, m.branch
+		if m.requirement != "" {
+			d.Version = m.requirement
+		}
+	case *TarballModule:
+		d.Type, d.Source, d.Version, d.Checksum = "tarball", m.url, m.version, m.checksum
+	case *GitModule:
+		d.Type, d.Source, d.InstallPath, d.Subdir = "git", m.repoURL, m.installPath, m.subdir
+		d.Ref, d.Tag, d.Branch, d.DefaultBranch = m.want.ref, m.want.tag, m.want.branch, m.defaultBranch
+		d.TagPattern = m.tagPattern
+	}
+
+	return d
+}
+
+// dumpPuppetfile writes the modules of a Puppetfile as a JSON array
+func dumpPuppetfile(w io.Writer, modules []PuppetModule) error {
+	dumped := make([]dumpedModule, 0, len(modules))
+	for _, m := range modules {
+		dumped = append(dumped, dumpModule(m))
+	}
+
+	b, err := json.MarshalIndent(dumped, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
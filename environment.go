@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Environments can be deployed from a branch, a tag or a commit of the
+// control repository
+const (
+	refAuto   = "auto"
+	refBranch = "branch"
+	refTag    = "tag"
+	refCommit = "commit"
+)
+
+// Number of commits of the history of environments that are fetched,
+// with --env-depth. The full history is fetched if 0.
+var envDepth int
+
+// depthArgs returns the arguments of git clone and git fetch limiting
+// the history fetched to envDepth commits
+func depthArgs() []string {
+	if envDepth <= 0 {
+		return nil
+	}
+
+	return []string{"--depth", strconv.Itoa(envDepth)}
+}
+
+var commitRegexp = regexp.MustCompile("^[0-9a-f]{7,40}$")
+var invalidEnvironmentChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// resolveRefType returns whether ref is a branch, a tag or a commit of
+// the remote repository. Branches take precedence over tags.
+func resolveRefType(remote, ref string) (string, error) {
+	output, err := gitCmd("ls-remote", "--heads", "--tags", remote, ref).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed listing refs of %s: %v", remote, err)
+	}
+
+	refType := ""
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[1] {
+		case "refs/heads/" + ref:
+			return refBranch, nil
+		case "refs/tags/" + ref:
+			refType = refTag
+		}
+	}
+
+	if refType == "" && commitRegexp.MatchString(ref) {
+		refType = refCommit
+	}
+
+	if refType == "" {
+		return "", fmt.Errorf("%s is not a branch, tag or commit of %s", ref, remote)
+	}
+
+	return refType, nil
+}
+
+// Replacement of the characters of branches, tags and commits that are
+// not valid in environment names, set with env_name_replacement in r10k.yml
+var environmentNameReplacement = "_"
+
+// environmentDirName returns the name of the folder an environment is
+// deployed to. Puppet environment names may only contain alphanumeric
+// characters and underscores, so that feature/foo-bar is deployed to
+// feature_foo_bar. The ref itself is still checked out as is.
+func environmentDirName(ref string) string {
+	return invalidEnvironmentChars.ReplaceAllString(ref, environmentNameReplacement)
+}
+
+// environmentModulePath returns the module path of an environment of a
+// source. Environments get their own folder of an absolute module path,
+// outside of them for read-only environments, named after their source
+// too as several sources may deploy environments of the same name.
+func environmentModulePath(modulePath, sourceName, dirName string) string {
+	if !path.IsAbs(modulePath) {
+		return modulePath
+	}
+
+	return path.Join(modulePath, sourceName, dirName)
+}
+
+// fetchEnvironment clones the control repository into folder, and checks
+// out ref - a branch, tag or commit
+func fetchEnvironment(remote, ref, refType, folder string) error {
+	if refType != refCommit {
+		args := append(append([]string{"clone"}, depthArgs()...), "-b", ref, remote, folder)
+		return gitCmd(args...).Run()
+	}
+
+	// Any commit can not be fetched from a shallow clone
+	if envDepth > 0 {
+		warnf("fetching the full history of %s to deploy commit %s\n", remote, ref)
+	}
+
+	if err := gitCmd("clone", "--no-checkout", remote, folder).Run(); err != nil {
+		return err
+	}
+
+	cmd := gitCmd("checkout", "--detach", ref)
+	cmd.Dir = folder
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed checking out %s: %s", ref, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// validCheckout returns true if folder is a checkout of remote that
+// can be updated
+func validCheckout(remote, folder string) bool {
+	if _, err := os.Stat(path.Join(folder, ".git")); err != nil {
+		return false
+	}
+
+	cmd := gitCmd("config", "--get", "remote.origin.url")
+	cmd.Dir = folder
+	output, err := cmd.Output()
+	if err != nil || strings.TrimSpace(string(output)) != remote {
+		return false
+	}
+
+	cmd = gitCmd("rev-parse", "--verify", "--quiet", "HEAD")
+	cmd.Dir = folder
+	return cmd.Run() == nil
+}
+
+// updateEnvironment updates the checkout of the control repository in
+// folder to ref, keeping the modules installed in it. It is cloned again
+// if it was never deployed, or the checkout is not valid anymore.
+func updateEnvironment(remote, ref, refType, folder string) error {
+	if !validCheckout(remote, folder) {
+		if _, err := os.Stat(folder); err == nil {
+			log.Printf("%s is not a valid checkout of %s, cloning it again\n", folder, remote)
+			if err := os.RemoveAll(folder); err != nil {
+				return err
+			}
+		}
+		if err := fetchEnvironment(remote, ref, refType, folder); err != nil {
+			return err
+		}
+		return setDeployedRef(folder, ref)
+	}
+
+	args := []string{"fetch", "--tags", "--force"}
+	if refType != refCommit {
+		args = append(args, depthArgs()...)
+	} else if _, err := os.Stat(path.Join(folder, ".git", "shallow")); err == nil {
+		// Any commit can not be checked out from a shallow clone
+		args = append(args, "--unshallow")
+	}
+	fetch := gitCmd(append(args, "origin")...)
+	fetch.Dir = folder
+	if output, err := fetch.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed fetching %s: %s", remote, strings.TrimSpace(string(output)))
+	}
+
+	var cmd *exec.Cmd
+	switch refType {
+	case refBranch:
+		cmd = gitCmd("checkout", "--force", "-B", ref, "origin/"+ref)
+	case refTag:
+		cmd = gitCmd("checkout", "--force", "--detach", "refs/tags/"+ref)
+	default:
+		cmd = gitCmd("checkout", "--force", "--detach", ref)
+	}
+	cmd.Dir = folder
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed checking out %s: %s", ref, strings.TrimSpace(string(output)))
+	}
+
+	return setDeployedRef(folder, ref)
+}
+
+// Key of the git configuration of environments recording the ref they
+// are deployed from, as refs such as feature/foo and feature_foo are
+// deployed to the same folder
+const deployedRefKey = "r10k-go.ref"
+
+// deployedRef returns the ref the environment in folder is deployed from,
+// or an empty string if it was not deployed, or by an older r10k-go
+func deployedRef(folder string) string {
+	if _, err := os.Stat(path.Join(folder, ".git")); err != nil {
+		return ""
+	}
+
+	cmd := gitCmd("config", "--get", deployedRefKey)
+	cmd.Dir = folder
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// setDeployedRef records ref as the ref the environment in folder is
+// deployed from
+func setDeployedRef(folder, ref string) error {
+	cmd := gitCmd("config", deployedRefKey, ref)
+	cmd.Dir = folder
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed recording the ref of %s: %s", folder, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// remoteCommit returns the commit ref points to in the remote repository
+func remoteCommit(remote, ref, refType string) (string, error) {
+	if refType == refCommit {
+		return ref, nil
+	}
+
+	fullRef := "refs/heads/" + ref
+	if refType == refTag {
+		fullRef = "refs/tags/" + ref
+	}
+
+	output, err := gitCmd("ls-remote", remote, fullRef, fullRef+"^{}").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed listing refs of %s: %v", remote, err)
+	}
+
+	// Annotated tags are peeled to the commit they point to
+	commit := ""
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+			commit = fields[0]
+		}
+	}
+	if commit == "" {
+		return "", fmt.Errorf("%s not found in %s", ref, remote)
+	}
+
+	return commit, nil
+}
+
+// File recording the commit of the last successful deployment of an
+// environment, used by deploy --only to skip unchanged environments
+const deployStateFile = ".r10k-go.state"
+
+func readDeployState(folder string) string {
+	b, err := ioutil.ReadFile(path.Join(folder, deployStateFile))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// headCommit returns the commit checked out in folder
+func headCommit(folder string) (string, error) {
+	cmd := gitCmd("rev-parse", "HEAD")
+	cmd.Dir = folder
+	commit, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// writeDeployState records the commit checked out in folder as deployed
+func writeDeployState(folder string) error {
+	commit, err := headCommit(folder)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(folder, deployStateFile), []byte(commit+"\n"), 0644)
+}
+
+// verifyEnvironment checks the GPG signature of the environment checked out
+// in folder. If ref is a tag, the signature of the tag is verified, otherwise
+// the signature of the commit at HEAD. Only signatures made with a key
+// present in the keyring (a GnuPG home directory) are accepted.
+func verifyEnvironment(folder, ref, keyring string) error {
+	cmd := gitCmd("verify-commit", "HEAD")
+
+	showRef := gitCmd("show-ref", "--verify", "--quiet", "refs/tags/"+ref)
+	showRef.Dir = folder
+	if showRef.Run() == nil {
+		cmd = gitCmd("verify-tag", ref)
+	}
+
+	cmd.Dir = folder
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+keyring)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("signature verification failed: %s", msg)
+		}
+		return fmt.Errorf("signature verification failed: %s is not signed", ref)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestEnvironmentDirName(t *testing.T) {
+	testCases := []struct {
+		ref, replacement string
+		expected         string
+	}{
+		{"production", "_", "production"},
+		{"feature/foo-bar", "_", "feature_foo_bar"},
+		{"feature/foo-bar", "X", "featureXfooXbar"},
+		{"v1.2.0", "_", "v1_2_0"},
+	}
+
+	defer func(r string) { environmentNameReplacement = r }(environmentNameReplacement)
+	for _, c := range testCases {
+		environmentNameReplacement = c.replacement
+		if actual := environmentDirName(c.ref); actual != c.expected {
+			t.Errorf("expected %s to be deployed to %s, got %s", c.ref, c.expected, actual)
+		}
+	}
+}
+
+// TestEnvironmentModulePathSources deploys the production environment of
+// two sources to an absolute module path, purging the modules of one of
+// them must not purge those of the other
+func TestEnvironmentModulePathSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modulePath := path.Join(dir, "modules")
+	puppet := environmentModulePath(modulePath, "puppet", "production")
+	hiera := environmentModulePath(modulePath, "hiera", "production")
+	if puppet == hiera {
+		t.Fatalf("expected the sources to have their own module path, got %s for both", puppet)
+	}
+	if relative := environmentModulePath("modules", "puppet", "production"); relative != "modules" {
+		t.Errorf("expected relative module paths to be unchanged, got %s", relative)
+	}
+
+	for _, folder := range []string{path.Join(puppet, "apache"), path.Join(hiera, "stale")} {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, err := NewCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := installOptions{numWorkers: 1, depWorkers: 1, purge: true, modulePath: hiera}
+	if nErr := startInstaller(path.Join(dir, "hiera", "production"), &cache, opts).install(nil, "", nil); nErr != 0 {
+		t.Fatalf("%d error(s) deploying the environment", nErr)
+	}
+
+	if _, err := os.Stat(path.Join(hiera, "stale")); !os.IsNotExist(err) {
+		t.Errorf("expected the unmanaged module of the source to be purged")
+	}
+	if _, err := os.Stat(path.Join(puppet, "apache")); err != nil {
+		t.Errorf("expected the modules of the other source to be kept: %v", err)
+	}
+}
+
+func TestDeployedRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Branches feature/foo and feature_foo, deployed to the same folder
+	remote := path.Join(dir, "control")
+	for _, args := range [][]string{
+		{"init", "-q", remote},
+		{"-C", remote, "-c", "user.name=r10k", "-c", "user.email=r10k@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+		{"-C", remote, "branch", "feature/foo"},
+		{"-C", remote, "branch", "feature_foo"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("failed running git %v: %v: %s", args, err, output)
+		}
+	}
+
+	folder := path.Join(dir, "environments", environmentDirName("feature/foo"))
+	if actual := deployedRef(folder); actual != "" {
+		t.Errorf("expected no ref to be deployed yet, got %s", actual)
+	}
+
+	for _, ref := range []string{"feature/foo", "feature_foo"} {
+		if err := updateEnvironment(remote, ref, refBranch, folder); err != nil {
+			t.Fatal(err)
+		}
+		if actual := deployedRef(folder); actual != ref {
+			t.Errorf("expected %s to be deployed to %s, got %s", ref, folder, actual)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -14,25 +13,20 @@ import (
 	"strings"
 )
 
-type ForgeModule struct {
-	name        string
-	version     string
-	envRoot     string
-	installPath string
-	cacheFolder string
-	processed   func()
-}
+// Forge archives contain a module-version/ parent folder
+const forgeArchiveStrip = 1
 
-func (m *ForgeModule) Processed() {
-	m.processed()
-}
+// Root of the Forge API
+const forgeURL = "https://forgeapi.puppetlabs.com:443/"
 
-func (m *ForgeModule) SetEnvRoot(s string) {
-	m.envRoot = s
-}
+// Roots of the Forge APIs modules are downloaded from, tried in turn when
+// one fails, set with forge.baseurls in r10k.yml
+var forgeURLs = []string{forgeURL}
 
-func (m *ForgeModule) SetCacheFolder(folder string) {
-	m.cacheFolder = folder
+type ForgeModule struct {
+	baseModule
+	version string
+	mirror  string // Forge the module is downloaded from
 }
 
 func (m *ForgeModule) Hash() string {
@@ -41,28 +35,8 @@ func (m *ForgeModule) Hash() string {
 	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 }
 
-func (m *ForgeModule) Name() string {
-	return m.name
-}
-
-func (m *ForgeModule) TargetFolder() string {
-	if m.envRoot == "" {
-		log.Fatal("Environment root not defined")
-	}
-
-	splitPath := strings.FieldsFunc(m.name, func(r rune) bool {
-		return r == '/' || r == '-'
-	})
-	folderName := splitPath[len(splitPath)-1]
-	if folderName == "" {
-		log.Fatal("Oups")
-	}
-
-	if m.installPath != "" {
-		return path.Join(m.envRoot, m.installPath, folderName)
-	}
-
-	return path.Join(m.envRoot, "modules", folderName)
+func (m *ForgeModule) Version() string {
+	return m.version
 }
 
 type ModuleReleases struct {
@@ -72,22 +46,17 @@ type ModuleReleases struct {
 	}
 }
 
-func (m *ForgeModule) downloadToCache(r io.Reader) error {
-	if err := os.MkdirAll(m.cacheFolder, 0755); err != nil {
-		return fmt.Errorf("failed creating folder %s: %v", m.cacheFolder, err)
-	}
+// archive returns the path of the archive in the cache
+func (m *ForgeModule) archive() string {
+	return path.Join(m.cacheFolder, m.version+".tar.gz")
+}
 
-	cacheFile := path.Join(m.cacheFolder, m.version+".tar.gz")
-	out, err := os.Create(cacheFile)
-	if err != nil {
-		return fmt.Errorf("failed creating cache file %s: %v", cacheFile, err)
+func (m *ForgeModule) reuseContent() bool {
+	if m.version == "" {
+		return false
 	}
 
-	defer out.Close()
-
-	_, err = io.Copy(out, r)
-
-	return err
+	return reuseExtracted(m.archive(), forgeArchiveStrip, m.TargetFolder(), m.version)
 }
 
 func (m *ForgeModule) IsUpToDate() bool {
@@ -102,8 +71,7 @@ func (m *ForgeModule) IsUpToDate() bool {
 	versionFile := path.Join(m.TargetFolder(), ".version")
 	version, err := ioutil.ReadFile(versionFile)
 	if err != nil {
-		// TODO error handling
-		fmt.Println("Error opening version file :" + err.Error())
+		warnf("module %s has no version file, reinstalling it: %v\n", m.Name(), err)
 		return false
 	}
 	v := string(version)
@@ -111,16 +79,44 @@ func (m *ForgeModule) IsUpToDate() bool {
 	return v == m.version
 }
 
+// downloadURL returns the path of the archive of the module, from the
+// first Forge of forgeURLs that answers, recorded as its mirror
 func (m *ForgeModule) downloadURL() (string, error) {
-	forgeURL := "https://forgeapi.puppetlabs.com:443/"
+	var err error
+
+	for i, mirror := range forgeURLs {
+		var url string
+		if url, err = m.releaseURL(mirror); err == nil {
+			m.mirror = mirror
+			if i > 0 {
+				log.Printf("module %s served by Forge %s\n", m.Name(), mirror)
+			}
+			return url, nil
+		}
+
+		// A module not found would not be found on other mirrors either
+		if derr, ok := err.(*DownloadError); !ok || !derr.retryable {
+			return "", err
+		}
+		if i < len(forgeURLs)-1 {
+			warnf("failed querying Forge %s for %s: %v, trying the next one\n", mirror, m.Name(), err)
+		}
+	}
+
+	return "", err
+}
+
+// releaseURL returns the path of the archive of the module on the Forge
+// mirror, resolving the latest version if it is not pinned
+func (m *ForgeModule) releaseURL(mirror string) (string, error) {
 	APIVersion := "v3"
 
-	url := forgeURL + APIVersion + "/releases?" +
+	url := mirror + APIVersion + "/releases?" +
 		"module=" + m.Name() +
 		"&sort_by=release_date" +
 		"&limit=100"
 
-	resp, err := http.Get(url)
+	resp, err := httpGet(rewriteURL(url))
 	if err != nil {
 		return "", &DownloadError{err, true}
 	}
@@ -141,7 +137,7 @@ func (m *ForgeModule) downloadURL() (string, error) {
 	if err != nil {
 		return "", &DownloadError{err, true}
 	} else if len(mr.Results) == 0 {
-		return "", &DownloadError{fmt.Errorf("Could not find module %s", m.Name()), false}
+		return "", &DownloadError{ErrNotFound{fmt.Sprintf("Could not find module %s", m.Name())}, false}
 	}
 
 	// If version is not specified, we pick the latest version
@@ -156,7 +152,7 @@ func (m *ForgeModule) downloadURL() (string, error) {
 			}
 		}
 		if !versionFound {
-			return "", &DownloadError{fmt.Errorf("Could not find version %s for module %s", m.version, m.Name()), false}
+			return "", &DownloadError{ErrNotFound{fmt.Sprintf("Could not find version %s for module %s", m.version, m.Name())}, false}
 		}
 	} else {
 		m.version = mr.Results[0].Version
@@ -165,43 +161,100 @@ func (m *ForgeModule) downloadURL() (string, error) {
 	return mr.Results[index].File_uri, nil
 }
 
-func (m *ForgeModule) Download() DownloadError {
-	var err error
-	var url string
-
-	forgeURL := "https://forgeapi.puppetlabs.com:443/"
-	if url, err = m.downloadURL(); err != nil {
-		return DownloadError{err, true}
+// fetch downloads the archive of the module to the cache, from the first
+// Forge of forgeURLs that serves it, recorded as its mirror. When the
+// version is pinned and already in the cache, the Forge does not need
+// to be queried, so that cached modules can be deployed offline.
+func (m *ForgeModule) fetch() DownloadError {
+	if _, err := os.Stat(m.archive()); m.version != "" && err == nil && !m.noCache {
+		return DownloadError{nil, false}
 	}
 
-	if _, err = os.Stat(path.Join(m.cacheFolder, m.version+".tar.gz")); err != nil {
-		forgeArchive, err := http.Get(forgeURL + url)
-		if err != nil {
-			return DownloadError{fmt.Errorf("could not retrieve %s", forgeURL+url), true}
+	var derr DownloadError
+	for i, mirror := range forgeURLs {
+		if derr = m.fetchFrom(mirror); derr.error == nil {
+			m.mirror = mirror
+			if i > 0 {
+				log.Printf("module %s served by Forge %s\n", m.Name(), mirror)
+			}
+			return derr
 		}
-		defer forgeArchive.Body.Close()
 
-		if err := m.downloadToCache(forgeArchive.Body); err != nil {
-			return DownloadError{fmt.Errorf("could not retrieve %s", forgeURL+url), true}
+		// A module not found would not be found on other mirrors either
+		if !derr.retryable {
+			return derr
+		}
+		if i < len(forgeURLs)-1 {
+			warnf("failed downloading %s from Forge %s: %v, trying the next one\n", m.Name(), mirror, derr)
+			removePartial(m.archive())
 		}
 	}
-	r, err := os.Open(path.Join(m.cacheFolder, m.version+".tar.gz"))
+
+	return derr
+}
+
+// fetchFrom resolves the release of the module on the Forge mirror, and
+// downloads its archive from there if it is not in the cache
+func (m *ForgeModule) fetchFrom(mirror string) DownloadError {
+	url, err := m.releaseURL(mirror)
 	if err != nil {
-		return DownloadError{fmt.Errorf("could not write to %s", path.Join(m.cacheFolder, m.version+".tar.gz")), false}
+		if derr, ok := err.(*DownloadError); ok {
+			return *derr
+		}
+		return DownloadError{err, true}
+	}
+
+	if _, err = os.Stat(m.archive()); err == nil && !m.noCache {
+		return DownloadError{nil, false}
+	}
+
+	// The extracted copy would be installed instead if it was kept
+	removeArchive(m.archive())
+	// Archives are given as absolute paths, /v3/files/...
+	url = rewriteURL(strings.TrimSuffix(mirror, "/") + url)
+	if err := downloadFile(url, m.archive()); err != nil {
+		return DownloadError{err, retryable(err)}
 	}
-	defer r.Close()
+	recordSource(m.archive(), url)
+
+	return DownloadError{nil, false}
+}
 
-	if err = extract(r, m.TargetFolder()); err != nil {
+func (m *ForgeModule) cachedMetadata() ([]byte, error) {
+	return archiveFile(m.archive(), forgeArchiveStrip, "metadata.json")
+}
+
+func (m *ForgeModule) Download() DownloadError {
+	var err error
+
+	if derr := fetches.do(m, m.fetch); derr.error != nil {
+		return derr
+	}
+
+	// The extracted module takes at least as much space as the archive
+	if fi, err := os.Stat(m.archive()); err == nil {
+		if err := checkFreeSpace(m.TargetFolder(), fi.Size()); err != nil {
+			return DownloadError{err, false}
+		}
+	}
+
+	archive := m.archive()
+	download := func() error {
+		return m.fetch().error
+	}
+
+	if err = installCachedArchive(archive, m.TargetFolder(), forgeArchiveStrip, linkFromCache(m), download); err != nil {
+		if !retryable(err) {
+			return DownloadError{err, false}
+		}
+		// The archive in the cache is probably broken, download it again
+		removeArchive(m.archive())
 		return DownloadError{err, true}
 	}
 
-	versionFile := path.Join(m.TargetFolder(), ".version")
-	f, err := os.OpenFile(versionFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return DownloadError{fmt.Errorf("could not create file %s", versionFile), false}
+	if err := writeVersion(m.TargetFolder(), m.version); err != nil {
+		return DownloadError{err, false}
 	}
-	defer f.Close()
-	f.WriteString(m.version)
 
 	return DownloadError{nil, false}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestForgeMirrors(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v3/releases"):
+			fmt.Fprintf(w, `{"results": [{"version": "1.0.0", "file_uri": "/v3/files/acme-foo-1.0.0.tar.gz"}]}`)
+		case r.URL.Path == "/v3/files/acme-foo-1.0.0.tar.gz":
+			w.Write(forgeArchive(t, "acme/foo", nil))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer up.Close()
+
+	// Releases are listed, but archives fail to download
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v3/releases") {
+			fmt.Fprintf(w, `{"results": [{"version": "1.0.0", "file_uri": "/v3/files/acme-foo-1.0.0.tar.gz"}]}`)
+			return
+		}
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	defer func(urls []string) { forgeURLs = urls }(forgeURLs)
+	forgeURLs = forgeConfig{Baseurls: []string{down.URL, broken.URL, up.URL + "/"}}.urls()
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &ForgeModule{baseModule: baseModule{name: "acme/foo", envRoot: dir, cacheFolder: path.Join(dir, "cache")}}
+	if derr := m.Download(); derr.error != nil {
+		t.Fatalf("failed downloading from the second Forge: %v", derr)
+	}
+	if m.mirror != up.URL+"/" || m.Version() != "1.0.0" {
+		t.Errorf("expected version 1.0.0 from %s, got %s from %s", up.URL, m.Version(), m.mirror)
+	}
+	if _, err := os.Stat(path.Join(m.TargetFolder(), "metadata.json")); err != nil {
+		t.Errorf("module was not installed: %v", err)
+	}
+	if source := cachedSource(m); source != up.URL+"/v3/files/acme-foo-1.0.0.tar.gz" {
+		t.Errorf("expected the archive to be reported as served by %s, got %s", up.URL, source)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Whether modules are flushed to disk before being marked as installed,
+// with --fsync
+var fsyncEnabled bool
+
+// syncFile flushes a file or folder to disk
+func syncFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// syncTree flushes folder, and the files and folders it contains, to disk.
+// Symlinks are not followed.
+func syncTree(folder string) error {
+	return filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return syncFile(p)
+	})
+}
+
+// writeVersion writes the .version file marking the module installed in
+// targetFolder as up to date
+func writeVersion(targetFolder string, version string) error {
+	return writeMarker(targetFolder, ".version", version)
+}
+
+// writeMarker writes the file name of targetFolder, recording the version
+// of the module installed there. With --fsync, the module is flushed to
+// disk first, so that a crash can not leave a partially written module
+// with a version recorded.
+func writeMarker(targetFolder string, name string, version string) error {
+	versionFile := path.Join(targetFolder, name)
+
+	if fsyncEnabled {
+		if err := syncTree(targetFolder); err != nil {
+			return fmt.Errorf("failed flushing %s to disk: %v", targetFolder, err)
+		}
+	}
+
+	f, err := os.OpenFile(versionFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create file %s", versionFile)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(version); err != nil {
+		return writeError(versionFile, err)
+	}
+
+	if fsyncEnabled {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed flushing %s to disk: %v", versionFile, err)
+		}
+		// The folder of the module must be found after a crash too
+		if err := syncFile(path.Dir(targetFolder)); err != nil {
+			return fmt.Errorf("failed flushing %s to disk: %v", path.Dir(targetFolder), err)
+		}
+	}
+
+	return nil
+}
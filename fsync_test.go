@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteVersionFsync(t *testing.T) {
+	defer func(enabled bool) { fsyncEnabled = enabled }(fsyncEnabled)
+	fsyncEnabled = true
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	module := path.Join(dir, "apache")
+	if err := os.MkdirAll(path.Join(module, "manifests"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(module, "manifests", "init.pp"), []byte("class apache {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", path.Join(module, "broken")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A shorter version replaces the previous one entirely
+	for _, version := range []string{"10.0.0", "9.0.0"} {
+		if err := writeVersion(module, version); err != nil {
+			t.Fatalf("failed writing version %s: %v", version, err)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(path.Join(module, ".version")); err != nil || string(b) != "9.0.0" {
+		t.Errorf("expected version 9.0.0, got %s (%v)", b, err)
+	}
+}
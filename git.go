@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Path or name of the git command, --git-binary
+var gitBinary = "git"
+
+// Proxy of git HTTP(S) remotes, from r10k.yml
+var gitProxy string
+
+// gitCmd returns the command running git with args. The proxy of git is
+// passed to it as configuration, so that it only applies to git.
+func gitCmd(args ...string) *exec.Cmd {
+	if gitProxy != "" {
+		args = append([]string{"-c", "http.proxy=" + gitProxy}, args...)
+	}
+
+	return exec.CommandContext(runContext, gitBinary, args...)
+}
+
+// Git modules are deployed using worktrees, which appeared in git 2.5.0
+var minGitVersion = [3]int{2, 5, 0}
+
+var checkGitOnce sync.Once
+var checkGitErr error
+
+// checkGit returns an error if git is not installed, or is too old to be used
+// by r10k-go. The check only runs once.
+func checkGit() error {
+	checkGitOnce.Do(func() {
+		checkGitErr = findGit()
+	})
+
+	return checkGitErr
+}
+
+func findGit() error {
+	if _, err := exec.LookPath(gitBinary); err != nil {
+		if gitBinary != "git" {
+			return fmt.Errorf("git binary %s could not be found: %v", gitBinary, err)
+		}
+		return errors.New("git is required to deploy environments and git modules, but it could not be found in the PATH. Please install git")
+	}
+
+	output, err := gitCmd("--version").Output()
+	if err != nil {
+		return fmt.Errorf("failed running git --version: %v", err)
+	}
+
+	version, err := parseGitVersion(string(output))
+	if err != nil {
+		return err
+	}
+
+	if olderThan(version, minGitVersion) {
+		return fmt.Errorf("git %d.%d.%d is too old, please upgrade to git %d.%d.%d or newer",
+			version[0], version[1], version[2], minGitVersion[0], minGitVersion[1], minGitVersion[2])
+	}
+
+	return nil
+}
+
+// olderThan returns true if version is older than min
+func olderThan(version, min [3]int) bool {
+	for i := range version {
+		if version[i] != min[i] {
+			return version[i] < min[i]
+		}
+	}
+
+	return false
+}
+
+// Partial clones limited to some folders with git sparse-checkout
+// appeared in git 2.25.0
+var sparseGitVersion = [3]int{2, 25, 0}
+
+var gitVersionOnce sync.Once
+var gitVersion [3]int
+
+// gitSupports returns true if the installed git is version v or newer
+func gitSupports(v [3]int) bool {
+	gitVersionOnce.Do(func() {
+		if output, err := gitCmd("--version").Output(); err == nil {
+			gitVersion, _ = parseGitVersion(string(output))
+		}
+	})
+
+	return !olderThan(gitVersion, v)
+}
+
+// parseGitVersion parses the output of git --version, for example
+// "git version 2.11.0" or "git version 2.24.3 (Apple Git-128)"
+func parseGitVersion(s string) ([3]int, error) {
+	var version [3]int
+
+	fields := strings.Fields(s)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return version, fmt.Errorf("failed parsing git version from %q", s)
+	}
+
+	for i, n := range strings.SplitN(fields[2], ".", 4) {
+		if i >= len(version) {
+			break
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil {
+			return version, fmt.Errorf("failed parsing git version from %q", s)
+		}
+		version[i] = v
+	}
+
+	return version, nil
+}
@@ -2,57 +2,113 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
+// File recording the commit git modules were deployed at, not named
+// .version as the repository may have such a file
+const gitCommitFile = ".r10k-go.commit"
+
+// With --update-in-place, checkouts of git modules are updated to the
+// commit to install, instead of being removed and checked out again
+var updateInPlace bool
+
 type GitModule struct {
-	name        string
-	repoURL     string
-	envRoot     string
-	installPath string
-	cacheFolder string
-	processed   func()
-	want        struct {
+	baseModule
+	repoURL       string
+	defaultBranch string
+	subdir        string // Folder of the repository installed as the module, all of it if empty
+	ambiguousRef  sync.Once
+	want          struct {
 		ref    string
 		tag    string
 		branch string
 	}
+
+	// Pattern of the tags of the remote, v1.* for example, the highest
+	// matching one is resolved once as the tag to install
+	tagPattern  string
+	resolveTag  sync.Once
+	tagNotFound error
 }
 
-func (m *GitModule) Name() string { return m.name }
-func (m *GitModule) Processed()   { m.processed() }
+// Version returns the ref, tag or branch the module is pinned to
+func (m *GitModule) Version() string {
+	switch {
+	case m.want.ref != "":
+		return m.want.ref
+	case m.want.tag != "":
+		return m.want.tag
+	default:
+		return m.want.branch
+	}
+}
 
 func (m *GitModule) IsUpToDate() bool {
 	if _, err := os.Stat(m.TargetFolder()); err != nil {
 		return false
 	}
 
+	// The tag installed is up to date until a newer one matches
+	if err := m.resolveTagPattern(); err != nil {
+		return false
+	}
+
+	// The commit deployed is recorded, to detect modules modified since
+	if recorded, err := ioutil.ReadFile(path.Join(m.TargetFolder(), gitCommitFile)); err == nil {
+		if commit, err := m.currentCommit(); err != nil || commit != strings.TrimSpace(string(recorded)) {
+			warnf("module %s is not at the commit it was deployed at anymore, installing it again\n", m.Name())
+			return false
+		}
+	}
+
 	// folder exists, but no version specified, anything goes
 	if m.want.ref == "" && m.want.branch == "" && m.want.tag == "" {
 		return true
 	}
 
+	// Subfolders are copies, not worktrees, only the commit they were
+	// copied from is known
+	if m.subdir != "" {
+		recorded, err := m.currentCommit()
+		if err != nil {
+			return false
+		}
+		expected, err := m.resolveCommit(m.commitish(m.branch()))
+		return err == nil && recorded == expected
+	}
+
 	if m.want.ref != "" {
 		commit, err := m.currentCommit()
 		if err != nil {
 			return false
 		}
-		return m.want.ref == commit
+		if m.want.ref == commit {
+			return true
+		}
+		// Refs can also be tags or branches
+		expected, err := m.resolveCommit(m.refCommitish())
+		return err == nil && expected == commit
 	}
 
-	cmd := exec.Command("git", "show", "-s", "--pretty=%d", "HEAD")
+	cmd := gitCmd("show", "-s", "--pretty=%d", "HEAD")
 	cmd.Dir = m.TargetFolder()
 	output, _ := cmd.Output()
 
-	if m.want.branch != "" {
-		return strings.Contains(string(output), "origin/"+m.want.branch)
+	if branch := m.branch(); branch != "" {
+		return strings.Contains(string(output), "origin/"+branch)
 	}
 
 	if m.want.tag != "" {
@@ -62,51 +118,158 @@ func (m *GitModule) IsUpToDate() bool {
 	return false
 }
 
-func (m *GitModule) gitCommand(to string) []string {
-	cmd := "git worktree add --detach -f " + path.Join("..", "..", to)
-	if m.want.ref != "" {
-		cmd += " " + m.want.ref
+// resolveTagPattern sets the tag of a module with a :tag_pattern to the
+// highest matching tag of its remote
+func (m *GitModule) resolveTagPattern() error {
+	if m.tagPattern == "" {
+		return nil
 	}
 
-	if m.want.branch != "" {
-		cmd += " origin/" + m.want.branch
+	m.resolveTag.Do(func() {
+		if m.want.tag, m.tagNotFound = m.latestTag(); m.tagNotFound == nil {
+			tracef("tag %s of module %s matches %s\n", m.want.tag, m.Name(), m.tagPattern)
+		}
+	})
+
+	return m.tagNotFound
+}
+
+// latestTag returns the highest tag of the remote matching the tag
+// pattern, by semantic version, or by name if none is a version
+func (m *GitModule) latestTag() (string, error) {
+	cmd := gitCmd("ls-remote", "--tags", convertGitProtocol(rewriteURL(m.repoURL)))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed listing the tags of %s: %v", m.repoURL, err)
 	}
 
-	return strings.Split(cmd, " ")
+	var tags []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		// Annotated tags are also listed peeled, as tag^{}
+		if len(fields) != 2 || strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		tag := strings.TrimPrefix(fields[1], "refs/tags/")
+		if match, _ := path.Match(m.tagPattern, tag); match {
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(tags) == 0 {
+		return "", ErrNotFound{fmt.Sprintf("no tag of module %s matches %s", m.Name(), m.tagPattern)}
+	}
+
+	if latest, ok := latestVersion(tags); ok {
+		return tags[latest], nil
+	}
+	sort.Strings(tags)
+
+	return tags[len(tags)-1], nil
 }
 
-func (m *GitModule) SetCacheFolder(folder string) {
-	m.cacheFolder = folder
+// commitish returns what to check out: the ref, tag or branch of the
+// module, or the default branch of the remote if it is not pinned. Tags
+// and branches are given as full references, so that a tag and a
+// branch of the same name are not confused.
+func (m *GitModule) commitish(branch string) string {
+	switch {
+	case m.want.ref != "":
+		return m.refCommitish()
+	case m.want.tag != "":
+		return "refs/tags/" + m.want.tag
+	case branch != "":
+		return "refs/remotes/origin/" + branch
+	case m.cacheFolder != "" && m.hasRef("refs/remotes/origin/HEAD"):
+		// HEAD of the cache does not move when it is fetched
+		return "origin/HEAD"
+	default:
+		return "HEAD"
+	}
 }
 
-func (m *GitModule) SetEnvRoot(s string) {
-	m.envRoot = s
+func (m *GitModule) gitCommand(to string, branch string) []string {
+	return []string{"worktree", "add", "--detach", "-f", to, m.commitish(branch)}
 }
 
-func (m *GitModule) Hash() string {
-	hasher := sha1.New()
-	hasher.Write([]byte(m.repoURL))
-	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+// Commits given as :ref, which are not looked up as tags or branches
+var commitRef = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// refCommitish returns the reference the :ref of the module stands for
+// in the cache: a tag, a branch, or else a commit. Tags are preferred
+// over branches of the same name, with a warning.
+func (m *GitModule) refCommitish() string {
+	ref := m.want.ref
+	if m.cacheFolder == "" || commitRef.MatchString(ref) {
+		return ref
+	}
+
+	tag, branch := m.hasRef("refs/tags/"+ref), m.hasBranch(ref)
+	switch {
+	case tag && branch:
+		m.ambiguousRef.Do(func() {
+			warnf("ref %s of module %s is both a tag and a branch, using the tag. Use :tag or :branch instead\n", ref, m.Name())
+		})
+		return "refs/tags/" + ref
+	case tag:
+		return "refs/tags/" + ref
+	case branch:
+		return "refs/remotes/origin/" + ref
+	default:
+		return ref
+	}
 }
 
-func (m *GitModule) TargetFolder() string {
-	if m.envRoot == "" {
-		log.Fatal("Environment root not defined")
+// resolveCommit returns the commit commitish points to in the cache
+func (m *GitModule) resolveCommit(commitish string) (string, error) {
+	cmd := gitCmd("rev-parse", "--verify", "--quiet", commitish+"^{commit}")
+	cmd.Dir = m.cacheFolder
+	commit, err := cmd.Output()
+	if err != nil {
+		return "", ErrNotFound{fmt.Sprintf("%s not found in the repository of module %s", commitish, m.Name())}
 	}
 
-	splitPath := strings.FieldsFunc(m.name, func(r rune) bool {
-		return r == '/' || r == '-'
-	})
-	folderName := splitPath[len(splitPath)-1]
-	if folderName == "" {
-		log.Fatal("Oups")
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// hasBranch returns true if the cached repository has the branch
+func (m *GitModule) hasBranch(branch string) bool {
+	return m.hasRef("refs/remotes/origin/" + branch)
+}
+
+// hasRef returns true if the cached repository has the reference
+func (m *GitModule) hasRef(ref string) bool {
+	cmd := gitCmd("rev-parse", "--verify", "--quiet", ref)
+	cmd.Dir = m.cacheFolder
+	return cmd.Run() == nil
+}
+
+// branch returns the branch to deploy: the requested one, or the
+// default branch if the repository does not have the requested one
+func (m *GitModule) branch() string {
+	if m.want.branch == "" {
+		return m.defaultBranch
 	}
 
-	if m.installPath != "" {
-		return path.Join(m.envRoot, m.installPath, folderName)
+	if m.defaultBranch == "" || m.hasBranch(m.want.branch) {
+		return m.want.branch
 	}
 
-	return path.Join(m.envRoot, "modules", folderName)
+	return m.defaultBranch
+}
+
+// Hash identifies the cache of the module by its remote, so that modules
+// of the same repository share a single clone, whatever the protocol
+// of their remote
+func (m *GitModule) Hash() string {
+	hasher := sha1.New()
+	hasher.Write([]byte(normalizeGitRemote(m.repoURL)))
+	if m.subdir != "" {
+		// Sparse clones only have the files of their subfolder
+		hasher.Write([]byte("//" + m.subdir))
+	}
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 }
 
 func (m *GitModule) currentCommit() (string, error) {
@@ -114,6 +277,14 @@ func (m *GitModule) currentCommit() (string, error) {
 	var err error
 	worktreeFolder := ""
 
+	if m.subdir != "" {
+		commit, err := ioutil.ReadFile(path.Join(m.TargetFolder(), gitCommitFile))
+		if err != nil {
+			return "", fmt.Errorf("failed getting current commit for %s", m.Name())
+		}
+		return strings.TrimSpace(string(commit)), nil
+	}
+
 	if gitFile, err = os.Open(path.Join(m.TargetFolder(), ".git")); err != nil {
 		return "", fmt.Errorf("Error getting current commit for %s", m.Name())
 	}
@@ -149,8 +320,13 @@ func (m *GitModule) updateCache() error {
 			// Cache folder exists, but is not a GIT Repo - we remove it and redownload
 			os.RemoveAll(m.cacheFolder)
 		} else {
-			// Cache exists and is a git repository, we try to update it
-			cmd = exec.Command("git", "fetch")
+			// Cache exists and is a git repository, we try to update it.
+			// Tags are only moved when refreshed, with :no_cache.
+			args := []string{"fetch"}
+			if m.noCache {
+				args = append(args, "--force", "--prune", "--tags")
+			}
+			cmd = gitCmd(args...)
 			cmd.Dir = m.cacheFolder
 			if err := cmd.Run(); err != nil {
 				return &DownloadError{error: err, retryable: true}
@@ -159,29 +335,269 @@ func (m *GitModule) updateCache() error {
 		}
 	}
 
-	cmd = exec.Command("git", "clone", m.repoURL, m.cacheFolder)
-	if err := cmd.Run(); err != nil {
+	args := []string{"clone", convertGitProtocol(rewriteURL(m.repoURL)), m.cacheFolder}
+	sparse := m.subdir != "" && gitSupports(sparseGitVersion)
+	switch {
+	case sparse:
+		// Only the files of the subfolder are downloaded, when checked out
+		args = append(args, "--no-checkout", "--filter=blob:none", "--sparse")
+	case m.subdir != "":
+		args = append(args, "--no-checkout")
+	}
+
+	cmd = gitCmd(args...)
+	// Messages of git are not translated, missing repositories are
+	// detected from them
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(m.cacheFolder)
+		if o := strings.ToLower(string(output)); strings.Contains(o, "not found") || strings.Contains(o, "does not exist") {
+			return &DownloadError{error: ErrNotFound{fmt.Sprintf("repository %s not found", m.repoURL)}, retryable: false}
+		}
 		return &DownloadError{error: err, retryable: true}
 	}
 
+	if sparse {
+		for _, args := range [][]string{{"sparse-checkout", "init", "--cone"}, {"sparse-checkout", "set", m.subdir}} {
+			cmd = gitCmd(args...)
+			cmd.Dir = m.cacheFolder
+			if output, err := cmd.CombinedOutput(); err != nil {
+				os.RemoveAll(m.cacheFolder)
+				return &DownloadError{error: fmt.Errorf("failed setting up the sparse checkout of %s: %v: %s", m.subdir, err, strings.TrimSpace(string(output))), retryable: true}
+			}
+		}
+	}
+
 	return nil
 }
 
+// fetch clones the repository of the module to the cache, or updates it
+func (m *GitModule) fetch() DownloadError {
+	if err := m.updateCache(); err != nil {
+		if derr, ok := err.(*DownloadError); ok {
+			return *derr
+		}
+		return DownloadError{error: err, retryable: true}
+	}
+
+	return DownloadError{nil, false}
+}
+
 func (m *GitModule) Download() DownloadError {
 	var cmd *exec.Cmd
 	var err error
 
-	if err = m.updateCache(); err != nil {
+	if err := m.resolveTagPattern(); err != nil {
+		if _, ok := err.(ErrNotFound); ok {
+			return DownloadError{error: err, retryable: false}
+		}
 		return DownloadError{error: err, retryable: true}
 	}
 
-	gc := m.gitCommand(m.TargetFolder())
-	cmd = exec.Command(gc[0], gc[1:]...)
+	if derr := fetches.do(m, m.fetch); derr.error != nil {
+		return derr
+	}
+
+	// The worktree is created from the cache folder, the target must not be relative
+	to, err := filepath.Abs(m.TargetFolder())
+	if err != nil {
+		return DownloadError{error: err, retryable: false}
+	}
+
+	branch := m.branch()
+	if m.want.branch != "" && branch != m.want.branch {
+		warnf("module %s has no branch %s, deploying default branch %s\n", m.Name(), m.want.branch, branch)
+	}
+
+	expected, err := m.resolveCommit(m.commitish(branch))
+	if err != nil {
+		return DownloadError{error: err, retryable: false}
+	}
+
+	if m.subdir != "" {
+		return m.installSubdir(to, expected)
+	}
+
+	if m.updatesInPlace() {
+		if err := m.updateCheckout(to, expected); err == nil {
+			return DownloadError{error: nil, retryable: false}
+		} else if _, statErr := os.Stat(to); statErr == nil {
+			tracef("not updating %s in place: %v\n", to, err)
+		}
+		if err := os.RemoveAll(to); err != nil {
+			return DownloadError{error: err, retryable: false}
+		}
+	}
+
+	if checkInodes {
+		if n, err := m.countFiles(expected); err == nil {
+			release, err := reserveInodes(to, n)
+			if err != nil {
+				return DownloadError{error: err, retryable: false}
+			}
+			defer release()
+		}
+	}
+
+	gc := m.gitCommand(to, branch)
+	cmd = gitCmd(gc...)
 	cmd.Dir = m.cacheFolder
 
 	if err = cmd.Run(); err != nil {
 		return DownloadError{error: err, retryable: true}
 	}
 
+	// A failed checkout must not go unnoticed
+	if actual, err := headCommit(to); err != nil || actual != expected {
+		os.RemoveAll(to)
+		return DownloadError{error: fmt.Errorf("module %s was checked out at %s instead of %s", m.Name(), actual, expected), retryable: false}
+	}
+
+	if err := writeMarker(to, gitCommitFile, expected); err != nil {
+		return DownloadError{error: err, retryable: false}
+	}
+
+	return DownloadError{error: nil, retryable: false}
+}
+
+// updatesInPlace returns true if previous checkouts of the module are
+// updated rather than removed, subfolders are copies and always replaced
+func (m *GitModule) updatesInPlace() bool {
+	return updateInPlace && m.subdir == ""
+}
+
+// updateCheckout checks out commit in the folder to, if it is a worktree
+// of the cache of the module, discarding any local change. Checkouts of
+// another repository, or that git can't read, are left untouched.
+func (m *GitModule) updateCheckout(to string, commit string) error {
+	if _, err := os.Stat(path.Join(to, ".git")); err != nil {
+		return err
+	}
+
+	cmd := gitCmd("rev-parse", "--git-common-dir")
+	cmd.Dir = to
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("not a valid checkout: %v", err)
+	}
+	gitDir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(to, gitDir)
+	}
+	cacheDir, err := filepath.Abs(path.Join(m.cacheFolder, ".git"))
+	if err != nil {
+		return err
+	}
+	if !sameFile(gitDir, cacheDir) {
+		return fmt.Errorf("checkout of another repository, %s", gitDir)
+	}
+
+	for _, args := range [][]string{{"checkout", "--detach", "-f", commit}, {"clean", "-ffdx"}} {
+		cmd := gitCmd(args...)
+		cmd.Dir = to
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed updating checkout: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	if actual, err := headCommit(to); err != nil || actual != commit {
+		return fmt.Errorf("checked out at %s instead of %s", actual, commit)
+	}
+
+	return writeMarker(to, gitCommitFile, commit)
+}
+
+// sameFile returns true if both paths exist and are the same file
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fa, fb)
+}
+
+// cachedMetadata returns the metadata.json of the commit to install, as
+// fetched in the cache
+func (m *GitModule) cachedMetadata() ([]byte, error) {
+	if err := m.resolveTagPattern(); err != nil {
+		return nil, err
+	}
+
+	commit, err := m.resolveCommit(m.commitish(m.branch()))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only fails if the file does not exist, the commit being known
+	cmd := gitCmd("show", commit+":"+path.Join(m.subdir, "metadata.json"))
+	cmd.Dir = m.cacheFolder
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	return out, nil
+}
+
+// countFiles returns the number of files and folders of the repository
+// at commit, as listed in the cache
+func (m *GitModule) countFiles(commit string) (int64, error) {
+	cmd := gitCmd("ls-tree", "-r", "-t", "--name-only", "-z", commit)
+	cmd.Dir = m.cacheFolder
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(bytes.Count(out, []byte{0})), nil
+}
+
+// Checkouts of the cache of modules with a subdir, by cache folder, as
+// modules of the same subfolder at different commits share it
+var subdirCheckouts = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// installSubdir checks out commit in the cache of the module, which
+// only has the files of its subdir when git supports sparse checkouts,
+// and copies the subdir to the target folder
+func (m *GitModule) installSubdir(to string, commit string) DownloadError {
+	subdirCheckouts.Lock()
+	lock, ok := subdirCheckouts.locks[m.cacheFolder]
+	if !ok {
+		lock = &sync.Mutex{}
+		subdirCheckouts.locks[m.cacheFolder] = lock
+	}
+	subdirCheckouts.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	cmd := gitCmd("checkout", "--detach", "-f", commit)
+	cmd.Dir = m.cacheFolder
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return DownloadError{error: fmt.Errorf("failed checking out %s: %v: %s", commit, err, strings.TrimSpace(string(output))), retryable: true}
+	}
+
+	src := path.Join(m.cacheFolder, m.subdir)
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return DownloadError{error: ErrNotFound{fmt.Sprintf("folder %s not found in the repository of module %s at %s", m.subdir, m.Name(), commit)}, retryable: false}
+	}
+
+	if err := installTree(src, to, false); err != nil {
+		os.RemoveAll(to)
+		return DownloadError{error: err, retryable: false}
+	}
+
+	if err := writeMarker(to, gitCommitFile, commit); err != nil {
+		return DownloadError{error: err, retryable: false}
+	}
+
 	return DownloadError{error: nil, retryable: false}
 }
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestParseGitVersion(t *testing.T) {
+	testCases := []struct {
+		output   string
+		expected [3]int
+	}{
+		{"git version 2.11.0\n", [3]int{2, 11, 0}},
+		{"git version 2.24.3 (Apple Git-128)\n", [3]int{2, 24, 3}},
+		{"git version 2.20.1.windows.1\n", [3]int{2, 20, 1}},
+		{"git version 1.8\n", [3]int{1, 8, 0}},
+	}
+
+	for _, c := range testCases {
+		version, err := parseGitVersion(c.output)
+		if err != nil {
+			t.Errorf("failed parsing %q: %v", c.output, err)
+		}
+		if version != c.expected {
+			t.Errorf("failed parsing %q, expected %v, got %v", c.output, c.expected, version)
+		}
+	}
+
+	if _, err := parseGitVersion("bash: git: command not found"); err == nil {
+		t.Error("expected an error parsing an invalid git version")
+	}
+}
+
+func TestFindGitBinary(t *testing.T) {
+	defer func(binary string) { gitBinary = binary }(gitBinary)
+
+	gitBinary = "/nonexistent/git"
+	if err := findGit(); err == nil {
+		t.Error("expected an error finding a missing git binary")
+	}
+}
@@ -5,73 +5,75 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
+// GitHub archives contain an owner-repo-sha/ parent folder
+const githubArchiveStrip = 1
+
 type GithubTarballModule struct {
-	name        string
+	baseModule
 	repoName    string
 	version     string
-	cacheFolder string
-	envRoot     string
-	installPath string
-	processed   func()
+	requirement string // Range of tags, "~> 2.1" for example, the version is resolved on download
+	branch      string // Branch whose tip is downloaded, instead of a tag
 }
 
+// Root of the GitHub API, modules releases are listed from there
+var githubAPIRoot = "https://api.github.com"
+
+// Root of GitHub, archives of branches are downloaded from there
+var githubRoot = "https://github.com"
+
+// Roots of mirrors of GitHub archives, a caching proxy for example,
+// tried in turn when an archive can not be downloaded from GitHub. They
+// serve archives at the same paths as github.com.
+var githubArchiveMirrors []string
+
 type GHModuleReleases []struct {
 	Name        string
 	Tarball_url string
 }
 
-func (m *GithubTarballModule) Name() string {
-	return m.name
+func (m *GithubTarballModule) Version() string {
+	return m.version
 }
 
-func (m *GithubTarballModule) SetEnvRoot(s string) {
-	m.envRoot = s
-}
-
-func (m *GithubTarballModule) Processed() {
-	m.processed()
+func (m *GithubTarballModule) Hash() string {
+	hasher := sha1.New()
+	hasher.Write([]byte(m.name))
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 }
 
-func (m *GithubTarballModule) TargetFolder() string {
-	if m.envRoot == "" {
-		log.Fatal("Environment root not defined")
-	}
-
-	splitPath := strings.FieldsFunc(m.name, func(r rune) bool {
-		return r == '/' || r == '-'
-	})
-	folderName := splitPath[len(splitPath)-1]
-	if folderName == "" {
-		log.Fatal("Oups")
+// archive returns the path of the archive of the module in the cache
+func (m *GithubTarballModule) archive() string {
+	if m.branch != "" {
+		return path.Join(m.cacheFolder, "branch-"+strings.Replace(m.branch, "/", "-", -1)+".tar.gz")
 	}
 
-	if m.installPath != "" {
-		return path.Join(m.envRoot, m.installPath, folderName)
-	}
-
-	return path.Join(m.envRoot, "modules", folderName)
+	return path.Join(m.cacheFolder, m.version+".tar.gz")
 }
 
-func (m *GithubTarballModule) SetCacheFolder(cacheFolder string) {
-	m.cacheFolder = cacheFolder
-}
+func (m *GithubTarballModule) reuseContent() bool {
+	if m.version == "" {
+		return false
+	}
 
-func (m *GithubTarballModule) Hash() string {
-	hasher := sha1.New()
-	hasher.Write([]byte(m.name))
-	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	return reuseExtracted(m.archive(), githubArchiveStrip, m.TargetFolder(), m.version)
 }
 
 func (m *GithubTarballModule) IsUpToDate() bool {
+	// The branch may have moved since the module was installed
+	if m.branch != "" {
+		return false
+	}
+
 	_, err := os.Stat(m.TargetFolder())
 	if err != nil {
 		return false
@@ -83,58 +85,95 @@ func (m *GithubTarballModule) IsUpToDate() bool {
 	versionFile := path.Join(m.TargetFolder(), ".version")
 	version, err := ioutil.ReadFile(versionFile)
 	if err != nil {
-		// TODO error handling
-		fmt.Println("Error opening version file :" + err.Error())
+		warnf("module %s has no version file, reinstalling it: %v\n", m.Name(), err)
 		return false
 	}
 	v := string(version)
 
+	if m.requirement != "" {
+		installed, ok := parseSemver(v)
+		if !ok {
+			return false
+		}
+		match, err := installed.satisfies(m.requirement)
+		return err == nil && match
+	}
+
 	return v == m.version
 }
 
-func (m *GithubTarballModule) downloadToCache(r io.Reader) error {
-	if err := os.MkdirAll(path.Join(m.cacheFolder), 0755); err != nil {
-		return err
+func (m *GithubTarballModule) downloadURL() (string, error) {
+	if m.branch != "" {
+		return githubRoot + "/" + m.repoName + "/archive/refs/heads/" + m.branch + ".tar.gz", nil
 	}
 
-	out, err := os.Create(path.Join(m.cacheFolder, m.version+".tar.gz"))
-	if err != nil {
-		return err
+	// Missing repositories and versions are not looked up again for a
+	// while, unless refreshed with :no_cache or --refresh. The version is
+	// resolved by the lookup.
+	lookup := m.version
+	if m.requirement != "" {
+		lookup = m.requirement
+	} else if lookup == "" {
+		lookup = "latest"
+	}
+	if !m.noCache {
+		if err, ok := notFound.get(m.cacheFolder, lookup, time.Now()); ok {
+			return "", &DownloadError{err, false}
+		}
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, r)
+	url, err := m.resolveURL()
+	if err == nil {
+		notFound.clear(m.cacheFolder)
+	} else if derr, ok := err.(*DownloadError); ok {
+		if nf, ok := derr.error.(ErrNotFound); ok {
+			notFound.put(m.cacheFolder, lookup, nf, time.Now())
+		}
+	}
 
-	return err
+	return url, err
 }
 
-func (m *GithubTarballModule) downloadURL() (string, error) {
-	ghAPIRoot := "https://api.github.com"
-
-	url := ghAPIRoot + "/repos/" + m.repoName + "/tags"
+// resolveURL resolves the version of the module with the GitHub API,
+// and returns the URL of its archive
+func (m *GithubTarballModule) resolveURL() (string, error) {
+	var gr GHModuleReleases
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", &DownloadError{err, true}
+	// The API returns at most 100 tags per page, the next one is linked
+	// to in the headers of the response
+	url := githubAPIRoot + "/repos/" + m.repoName + "/tags?per_page=100"
+	for url != "" {
+		page, next, err := m.tagsPage(url)
+		if err != nil {
+			return "", err
+		}
+		gr = append(gr, page...)
+		url = next
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", &DownloadError{fmt.Errorf("failed retrieving URL - %s", resp.Status), true}
+	if len(gr) == 0 {
+		return "", &DownloadError{ErrNotFound{fmt.Sprintf("module %s has no published tags", m.Name())}, false}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", &DownloadError{err, true}
-	}
-
-	var gr GHModuleReleases
-	if err = json.Unmarshal(body, &gr); err != nil {
-		return "", err
+	names := make([]string, len(gr))
+	for i, result := range gr {
+		names[i] = result.Name
 	}
 
 	index := 0
-	if m.version != "" {
+	switch {
+	case m.requirement != "":
+		latest, ok, err := latestMatching(names, m.requirement)
+		if err != nil {
+			return "", &DownloadError{err, false}
+		}
+		if !ok {
+			return "", &DownloadError{ErrNotFound{fmt.Sprintf("no tag of module %s matches %s", m.Name(), m.requirement)}, false}
+		}
+		index = latest
+		m.version = gr[index].Name
+
+	case m.version != "":
 		versionFound := false
 		for i, result := range gr {
 			if m.version == result.Name {
@@ -144,51 +183,182 @@ func (m *GithubTarballModule) downloadURL() (string, error) {
 			}
 		}
 		if !versionFound {
-			return "", &DownloadError{fmt.Errorf("Could not find version %s for module %s", m.version, m.Name()), false}
+			return "", &DownloadError{ErrNotFound{fmt.Sprintf("Could not find version %s for module %s", m.version, m.Name())}, false}
+		}
+
+	default:
+		// The API does not sort tags by version, only fall back to
+		// its order if the tags are not semantic versions
+		if latest, ok := latestVersion(names); ok {
+			index = latest
 		}
-	} else {
-		m.version = gr[0].Name
+		m.version = gr[index].Name
 	}
 
 	return gr[index].Tarball_url, nil
 }
 
-func (m *GithubTarballModule) Download() DownloadError {
-	var err error
-	var url string
+// tagsPage retrieves a page of the tags of the repository of the module,
+// and the URL of the next one, if any
+func (m *GithubTarballModule) tagsPage(url string) (GHModuleReleases, string, error) {
+	// Modules share the rate limit of the API
+	githubLimiter.wait()
+	resp, err := httpGet(rewriteURL(url))
+	githubLimiter.update(resp)
+	if err != nil {
+		return nil, "", &DownloadError{err, true}
+	}
+	defer resp.Body.Close()
 
-	if url, err = m.downloadURL(); err != nil {
-		return DownloadError{err, true}
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return nil, "", &DownloadError{fmt.Errorf("GitHub API rate limit exceeded resolving the version of %s", m.Name()), true}
 	}
 
-	if _, err = os.Stat(path.Join(m.cacheFolder, m.version+".tar.gz")); err != nil {
-		forgeArchive, err := http.Get(url)
-		if err != nil {
-			return DownloadError{fmt.Errorf("Failed retrieving %s", url), true}
-		}
-		defer forgeArchive.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", &DownloadError{ErrNotFound{fmt.Sprintf("repository %s not found", m.repoName)}, false}
+	}
 
-		m.downloadToCache(forgeArchive.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &DownloadError{fmt.Errorf("failed retrieving URL - %s", resp.Status), true}
 	}
 
-	r, err := os.Open(path.Join(m.cacheFolder, m.version+".tar.gz"))
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return DownloadError{err, false}
+		return nil, "", &DownloadError{err, true}
 	}
 
-	defer r.Close()
+	var gr GHModuleReleases
+	if err = json.Unmarshal(body, &gr); err != nil {
+		return nil, "", err
+	}
 
-	if err = extract(r, m.TargetFolder()); err != nil {
-		return DownloadError{err, false}
+	return gr, nextLink(resp.Header.Get("Link")), nil
+}
+
+// nextLink returns the URL of the next page in a Link header, such as
+// <https://api.github.com/repositories/1/tags?page=2>; rel="next"
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
 	}
 
-	versionFile := path.Join(m.TargetFolder(), ".version")
-	r, err = os.OpenFile(versionFile, os.O_RDWR|os.O_CREATE, 0644)
+	return ""
+}
+
+// fetch resolves the version of the module, and downloads its archive
+// to the cache
+func (m *GithubTarballModule) fetch() DownloadError {
+	url, err := m.downloadURL()
 	if err != nil {
-		return DownloadError{fmt.Errorf("Failed creating file %s", versionFile), false}
+		if derr, ok := err.(*DownloadError); ok {
+			return *derr
+		}
+		return DownloadError{err, true}
+	}
+
+	// Archives of branches in the cache are outdated once they move,
+	// their extracted copy would be installed instead if it was kept, and
+	// partial downloads of a previous tip would be resumed
+	if _, err = os.Stat(m.archive()); err != nil || m.branch != "" || m.noCache {
+		removeArchive(m.archive())
+		if m.branch != "" {
+			removePartial(m.archive())
+		}
+		if err := m.downloadArchive(url); err != nil {
+			return DownloadError{err, retryable(err)}
+		}
+	}
+
+	return DownloadError{nil, false}
+}
+
+// mirrorURLs returns the URLs of the archive of the module on the
+// mirrors of GitHub archives
+func (m *GithubTarballModule) mirrorURLs() []string {
+	ref := "refs/tags/" + m.version
+	if m.branch != "" {
+		ref = "refs/heads/" + m.branch
+	}
+
+	urls := make([]string, 0, len(githubArchiveMirrors))
+	for _, mirror := range githubArchiveMirrors {
+		urls = append(urls, strings.TrimSuffix(mirror, "/")+"/"+m.repoName+"/archive/"+ref+".tar.gz")
+	}
+
+	return urls
+}
+
+// downloadArchive downloads the archive of the module from url, then
+// from the mirrors of GitHub archives while downloads fail
+func (m *GithubTarballModule) downloadArchive(url string) error {
+	var err error
+
+	urls := append([]string{url}, m.mirrorURLs()...)
+	for i, u := range urls {
+		if err = downloadFile(rewriteURL(u), m.archive()); err == nil {
+			recordSource(m.archive(), rewriteURL(u))
+			if i > 0 {
+				log.Printf("archive of module %s served by %s\n", m.Name(), u)
+			} else {
+				tracef("archive of module %s served by %s\n", m.Name(), u)
+			}
+			return nil
+		}
+
+		// A missing tag would be missing from mirrors too
+		if !retryable(err) {
+			return err
+		}
+		if i < len(urls)-1 {
+			warnf("failed downloading the archive of %s from %s: %v, trying the next mirror\n", m.Name(), u, err)
+			// Archives generated by another server may differ, the
+			// download is not resumed from there
+			removePartial(m.archive())
+		}
+	}
+
+	return err
+}
+
+func (m *GithubTarballModule) cachedMetadata() ([]byte, error) {
+	return archiveFile(m.archive(), githubArchiveStrip, "metadata.json")
+}
+
+func (m *GithubTarballModule) Download() DownloadError {
+	var err error
+
+	if derr := fetches.do(m, m.fetch); derr.error != nil {
+		return derr
+	}
+
+	// The extracted module takes at least as much space as the archive
+	if fi, err := os.Stat(m.archive()); err == nil {
+		if err := checkFreeSpace(m.TargetFolder(), fi.Size()); err != nil {
+			return DownloadError{err, false}
+		}
+	}
+
+	download := func() error {
+		return m.fetch().error
+	}
+
+	if err = installCachedArchive(m.archive(), m.TargetFolder(), githubArchiveStrip, linkFromCache(m), download); err != nil {
+		if !retryable(err) {
+			return DownloadError{err, false}
+		}
+		// The archive in the cache is probably broken, download it again
+		removeArchive(m.archive())
+		return DownloadError{err, true}
+	}
+
+	if err := writeVersion(m.TargetFolder(), m.version); err != nil {
+		return DownloadError{err, false}
 	}
-	defer r.Close()
-	r.WriteString(m.version)
 
 	return DownloadError{nil, false}
 }
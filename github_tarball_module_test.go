@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDownloadURLNoTags(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+
+	defer func(root string) { githubAPIRoot = root }(githubAPIRoot)
+	githubAPIRoot = ts.URL
+
+	m := &GithubTarballModule{baseModule: baseModule{name: "acme/foo"}, repoName: "acme/foo"}
+	derr := m.Download()
+	if derr.error == nil {
+		t.Fatal("expected an error downloading a module without tags")
+	}
+	if derr.retryable {
+		t.Errorf("downloading a module without tags should not be retried")
+	}
+}
+
+func TestDownloadURLRange(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name": "v2.5.0", "tarball_url": "https://example.com/v2.5.0"}, {"name": "v3.0.0", "tarball_url": "https://example.com/v3.0.0"},
+			{"name": "nightly", "tarball_url": "https://example.com/nightly"}, {"name": "v2.1.0", "tarball_url": "https://example.com/v2.1.0"}]`))
+	}))
+	defer ts.Close()
+
+	defer func(root string) { githubAPIRoot = root }(githubAPIRoot)
+	githubAPIRoot = ts.URL
+
+	pf := PuppetFile{}
+	pm, err := pf.parseModule("mod 'acme/foo', :github_tarball => 'acme/foo', :version => '~> 2.1'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := pm.(*GithubTarballModule)
+	url, err := m.downloadURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != "https://example.com/v2.5.0" || m.Version() != "v2.5.0" {
+		t.Errorf("expected v2.5.0 to be downloaded, got %s (%s)", m.Version(), url)
+	}
+}
+
+func TestDownloadURLPages(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("per_page") != "100" {
+			t.Errorf("expected 100 tags per page to be requested, got %s", r.URL.RawQuery)
+		}
+		if r.URL.Query().Get("page") == "2" {
+			w.Write([]byte(`[{"name": "v3.0.0", "tarball_url": "https://example.com/v3.0.0"}]`))
+			return
+		}
+		w.Header().Set("Link", "<"+ts.URL+"/repos/acme/foo/tags?per_page=100&page=2>; rel=\"next\", <"+ts.URL+"/repos/acme/foo/tags?per_page=100&page=2>; rel=\"last\"")
+		w.Write([]byte(`[{"name": "v2.5.0", "tarball_url": "https://example.com/v2.5.0"}]`))
+	}))
+	defer ts.Close()
+
+	defer func(root string) { githubAPIRoot = root }(githubAPIRoot)
+	githubAPIRoot = ts.URL
+
+	m := &GithubTarballModule{baseModule: baseModule{name: "acme/foo"}, repoName: "acme/foo"}
+	url, err := m.downloadURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != "https://example.com/v3.0.0" || m.Version() != "v3.0.0" {
+		t.Errorf("expected the latest tag, on the second page, to be downloaded, got %s (%s)", m.Version(), url)
+	}
+}
+
+func TestDownloadURLBranch(t *testing.T) {
+	pf := PuppetFile{}
+	pm, err := pf.parseModule("mod 'acme/foo', :github_tarball => 'acme/foo', :branch => 'feature/x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := pm.(*GithubTarballModule)
+	url, err := m.downloadURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "https://github.com/acme/foo/archive/refs/heads/feature/x.tar.gz"; url != expected {
+		t.Errorf("expected branch to be downloaded from %s, got %s", expected, url)
+	}
+	if m.IsUpToDate() {
+		t.Errorf("expected modules tracking a branch to never be up to date")
+	}
+
+	if _, err := pf.parseModule("mod 'acme/foo', :github_tarball => 'acme/foo', :branch => 'main', :version => 'v1.0.0'"); err == nil {
+		t.Errorf("expected an error for a module with both a version and a branch")
+	}
+}
+
+func TestDownloadBranchMoved(t *testing.T) {
+	tip := []string{"foo-0a1b2c3/", "foo-0a1b2c3/metadata.json"}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball(t, tip).Bytes())
+	}))
+	defer ts.Close()
+
+	defer func(root string) { githubRoot = root }(githubRoot)
+	githubRoot = ts.URL
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, commit := range []string{"0a1b2c3", "4d5e6f7"} {
+		tip = []string{"foo-" + commit + "/", "foo-" + commit + "/metadata.json", "foo-" + commit + "/" + commit + ".pp"}
+		m := &GithubTarballModule{baseModule: baseModule{name: "acme/foo", cacheFolder: path.Join(dir, "cache"), envRoot: dir}, repoName: "acme/foo", branch: "main"}
+
+		// Download of the previous tip, interrupted once complete
+		if b, err := ioutil.ReadFile(m.archive()); err == nil {
+			ioutil.WriteFile(m.archive()+".part", b, 0644)
+			ioutil.WriteFile(m.archive()+".part.size", []byte(strconv.Itoa(len(b))), 0644)
+		}
+
+		if derr := m.Download(); derr.error != nil {
+			t.Fatalf("failed installing %s: %v", commit, derr)
+		}
+		if _, err := os.Stat(path.Join(m.TargetFolder(), commit+".pp")); err != nil {
+			t.Errorf("expected the tip of the branch, %s, to be installed: %v", commit, err)
+		}
+	}
+}
+
+func TestDownloadArchiveMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/acme/foo/archive/refs/tags/v1.0.0.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("archive"))
+	}))
+	defer mirror.Close()
+
+	defer func(mirrors []string) { githubArchiveMirrors = mirrors }(githubArchiveMirrors)
+	githubArchiveMirrors = []string{mirror.URL + "/"}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &GithubTarballModule{baseModule: baseModule{name: "acme/foo", cacheFolder: dir}, repoName: "acme/foo", version: "v1.0.0"}
+	if err := m.downloadArchive(primary.URL + "/acme/foo/v1.0.0"); err != nil {
+		t.Fatalf("expected the archive to be downloaded from the mirror: %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(m.archive()); err != nil || string(b) != "archive" {
+		t.Errorf("expected the archive of the mirror, got %s (%v)", b, err)
+	}
+}
+
+func TestDownloadURLNotFoundCached(t *testing.T) {
+	requests, tags := 0, `[{"name": "v1.0.0", "tarball_url": "https://example.com/v1.0.0"}]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(tags))
+	}))
+	defer ts.Close()
+
+	defer func(root string) { githubAPIRoot = root }(githubAPIRoot)
+	githubAPIRoot = ts.URL
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &GithubTarballModule{baseModule: baseModule{name: "acme/foo", cacheFolder: dir}, repoName: "acme/foo", version: "v2.0.0"}
+	for i := 0; i < 2; i++ {
+		if _, err := m.downloadURL(); err == nil {
+			t.Fatalf("expected version v2.0.0 not to be found")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the missing version to be looked up once, got %d requests", requests)
+	}
+
+	// Expired entries are looked up again, and forgotten once found
+	tags = `[{"name": "v2.0.0", "tarball_url": "https://example.com/v2.0.0"}]`
+	if _, ok := notFound.get(dir, "v2.0.0", time.Now().Add(notFoundTTL)); ok {
+		t.Errorf("expected the failed lookup to expire")
+	}
+	notFound.put(dir, "v2.0.0", ErrNotFound{"expired"}, time.Now().Add(-notFoundTTL))
+	if url, err := m.downloadURL(); err != nil || url != "https://example.com/v2.0.0" {
+		t.Errorf("expected v2.0.0 to be found, got %s (%v)", url, err)
+	}
+	if _, err := os.Stat(path.Join(dir, notFoundFile)); !os.IsNotExist(err) {
+		t.Errorf("expected failed lookups to be forgotten once found")
+	}
+
+	// Refreshed modules are looked up again
+	notFound.put(dir, "v2.0.0", ErrNotFound{"cached"}, time.Now())
+	m.noCache = true
+	if url, err := m.downloadURL(); err != nil || url != "https://example.com/v2.0.0" {
+		t.Errorf("expected v2.0.0 to be looked up again with :no_cache, got %s (%v)", url, err)
+	}
+}
@@ -7,85 +7,561 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 )
 
-func extract(r io.Reader, targetFolder string) error {
+// writeError reports a failure to write p, as an ErrDiskFull
+// if the filesystem is full
+func writeError(p string, err error) error {
+	if isNoSpaceLeft(err) {
+		return ErrDiskFull{path: p}
+	}
+
+	return fmt.Errorf("failed creating %s: %v", p, err)
+}
+
+// ErrCorruptArchive is returned when an archive can not be read, for
+// example because its download was truncated
+type ErrCorruptArchive struct {
+	archive string
+	err     error
+}
+
+func (e ErrCorruptArchive) Error() string {
+	return fmt.Sprintf("archive %s is corrupt: %v", e.archive, e.err)
+}
+
+// Archives smaller than this are extracted serially with --parallel-extract,
+// as writing their files concurrently would not be faster
+const parallelExtractMinSize = 16 << 20
+
+// Whether the files of large archives are written concurrently, with
+// --parallel-extract
+var parallelExtract bool
+
+// extract extracts the tar.gz archive r to targetFolder, removing the
+// strip leading components of the paths, like tar --strip-components
+func extract(r io.Reader, targetFolder string, strip int) error {
+	return extractFiles(r, targetFolder, strip, 1)
+}
+
+// stripPath removes the strip leading components of the path of a file of
+// an archive, returning an empty path if nothing is left. Paths outside
+// of the folder the archive is extracted to are refused.
+func stripPath(name string, strip int) (string, error) {
+	namePath := strings.Split(strings.Trim(name, "/"), "/")
+	if len(namePath) <= strip {
+		return "", nil
+	}
+
+	stripped := path.Clean(strings.Join(namePath[strip:], "/"))
+	if outside(stripped) {
+		return "", fmt.Errorf("refusing to extract %s, outside of the module", name)
+	}
+
+	return stripped, nil
+}
+
+// outside returns true if the relative path p is outside of its root
+func outside(p string) bool {
+	p = path.Clean(p)
+	return path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// symlinkPath returns true if, relative to the folder the archive is
+// extracted to, p goes through one of the symlinks of the archive, or
+// outside of the folder, ".." being resolved after the symlinks
+func symlinkPath(symlinks map[string]bool, p string) bool {
+	var components []string
+	for _, c := range strings.Split(p, "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(components) == 0 || symlinks[strings.Join(components, "/")] {
+				return true
+			}
+			components = components[:len(components)-1]
+			continue
+		}
+		if symlinks[strings.Join(components, "/")] {
+			return true
+		}
+		components = append(components, c)
+	}
+
+	return false
+}
+
+// fileToWrite is a regular file of an archive, read but not written yet
+type fileToWrite struct {
+	name string
+	data []byte
+	mode os.FileMode
+}
+
+// extractFiles extracts the archive like extract, with up to workers
+// files being written at once. The archive is read sequentially, files
+// are then written concurrently, hard links once all files are written.
+func extractFiles(r io.Reader, targetFolder string, strip int, workers int) error {
 	gzf, err := gzip.NewReader(r)
 	if err != nil {
-		return err
+		return ErrCorruptArchive{err: err}
 	}
 
 	tarReader := tar.NewReader(gzf)
 	i := 0
+	var extracted int64
 
 	if _, err = os.Stat(targetFolder); err != nil {
-		if err := os.MkdirAll(targetFolder, 0755); err != nil {
-			return err
+		if err := os.MkdirAll(targetFolder, extractedDirMode()); err != nil {
+			return writeError(targetFolder, err)
 		}
 	}
 
-	for {
-		header, err := tarReader.Next()
+	// The first error of the workers writing files
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var writeErr error
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writeErr
+	}
 
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
+	files := make(chan fileToWrite)
+	for w := 0; w < workers-1; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if err := ioutil.WriteFile(f.name, f.data, f.mode); err != nil {
+					mu.Lock()
+					if writeErr == nil {
+						writeErr = writeError(f.name, err)
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
 
-		name := header.Name
-
-		// The files in the archive are all in a parent folder,
-		// we want to extract all files directly to TargetFolder
-		namePath := strings.Split(name, "/")
-		switch len(namePath) {
-		case 0:
-			break
-		case 1:
-			name = "/"
-		default:
-			name = strings.Join(namePath[1:], "/")
-		}
+	// Hard links are created last, their target may not be written yet
+	links := make(map[string]string)
+
+	// Files are never written through symlinks, or replaced by one, as
+	// chained symlinks could lead outside of the module
+	symlinks := make(map[string]bool)
+	seen := make(map[string]bool)
 
-		targetFilename := path.Join(targetFolder, name)
+	err = func() error {
+		defer func() {
+			close(files)
+			wg.Wait()
+		}()
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err = os.MkdirAll(targetFilename, 0755); err != nil {
-				return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+		for {
+			header, err := tarReader.Next()
+
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return ErrCorruptArchive{err: err}
+			}
+			if err := failed(); err != nil {
+				return err
 			}
-			continue
 
-		case tar.TypeReg:
-			var data bytes.Buffer
-			io.Copy(&data, tarReader)
-			if err := ioutil.WriteFile(targetFilename, data.Bytes(), os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+			// Archives usually have all files in a parent folder, that
+			// we strip to extract all files directly to targetFolder
+			name, err := stripPath(header.Name, strip)
+			if err != nil {
+				return err
+			}
+			if name == "" {
+				continue
 			}
 
-		case tar.TypeSymlink:
-			if err := os.Symlink(header.Linkname, targetFilename); err != nil {
-				return fmt.Errorf("failed creating symlink %s to %s : %v", targetFilename, header.Linkname, err)
+			targetFilename := path.Join(targetFolder, name)
+
+			if symlinks[name] || symlinkPath(symlinks, name) {
+				return fmt.Errorf("refusing to extract %s through a symlink", header.Name)
 			}
+			replaced := seen[name]
+			seen[name] = true
+
+			switch header.Typeflag {
+			case tar.TypeDir:
+				if err = os.MkdirAll(targetFilename, extractedDirMode()); err != nil {
+					return writeError(targetFilename, err)
+				}
+				continue
+
+			case tar.TypeReg:
+				// Sizes in headers can not be trusted, bytes are counted
+				content := io.Reader(tarReader)
+				if maxExtractedSize > 0 {
+					content = io.LimitReader(tarReader, maxExtractedSize-extracted+1)
+				}
 
-		case tar.TypeLink:
-			if os.Link(header.Linkname, targetFilename) != nil {
-				return fmt.Errorf("failed creating hardlink %s to %s : %v", targetFilename, header.Linkname, err)
+				var data bytes.Buffer
+				n, err := io.Copy(&data, content)
+				if err != nil {
+					return ErrCorruptArchive{err: err}
+				}
+				if extracted += n; maxExtractedSize > 0 && extracted > maxExtractedSize {
+					return ErrTooLarge{what: "content of the archive", limit: maxExtractedSize}
+				}
+
+				if workers > 1 {
+					files <- fileToWrite{targetFilename, data.Bytes(), extractedFileMode(os.FileMode(header.Mode))}
+				} else if err := ioutil.WriteFile(targetFilename, data.Bytes(), extractedFileMode(os.FileMode(header.Mode))); err != nil {
+					return writeError(targetFilename, err)
+				}
+
+			case tar.TypeSymlink:
+				// Symlinks could be used to write files anywhere
+				if path.IsAbs(header.Linkname) || symlinkPath(symlinks, path.Dir(name)+"/"+header.Linkname) {
+					return fmt.Errorf("refusing to extract symlink %s to %s, outside of the module", name, header.Linkname)
+				}
+				if replaced {
+					return fmt.Errorf("refusing to replace %s with a symlink", header.Name)
+				}
+				symlinks[name] = true
+				if err := os.Symlink(header.Linkname, targetFilename); err != nil {
+					return fmt.Errorf("failed creating symlink %s to %s : %v", targetFilename, header.Linkname, err)
+				}
+
+			case tar.TypeLink:
+				linkname, err := stripPath(header.Linkname, strip)
+				if err != nil || linkname == "" || symlinkPath(symlinks, linkname) {
+					return fmt.Errorf("refusing to extract hardlink %s to %s, outside of the module", name, header.Linkname)
+				}
+				links[targetFilename] = path.Join(targetFolder, linkname)
+
+			case tar.TypeXGlobalHeader:
+				continue
+
+			default:
+				return fmt.Errorf("failed extracting tar file: unsupported type %c of %s", header.Typeflag, header.Name)
 			}
 
-		case tar.TypeXGlobalHeader:
-			continue
+			i++
+		}
+	}()
+	if err == nil {
+		err = failed()
+	}
+	if err != nil {
+		return err
+	}
 
-		default:
-			return fmt.Errorf("failed extracting tar file: %v", err)
+	for link, target := range links {
+		if err := os.Link(target, link); err != nil {
+			return fmt.Errorf("failed creating hardlink %s to %s : %v", link, target, err)
 		}
+	}
 
-		i++
+	// A truncated archive can extract to an empty folder, which would
+	// then be considered up to date
+	if i == 0 {
+		return ErrCorruptArchive{err: fmt.Errorf("no file extracted to %s, the archive may be truncated", targetFolder)}
+	}
+
+	if !exists(path.Join(targetFolder, "metadata.json")) && !exists(path.Join(targetFolder, "manifests")) {
+		warnf("neither metadata.json nor manifests/ found in %s\n", targetFolder)
 	}
 
 	return nil
 }
+
+// extractArchive extracts an archive of the cache to targetFolder. With
+// --parallel-extract, files of large archives are written concurrently,
+// falling back to writing them one at a time if that fails.
+func extractArchive(archive string, targetFolder string, strip int) error {
+	r, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	if !parallelExtract || fi.Size() < parallelExtractMinSize {
+		return extract(r, targetFolder, strip)
+	}
+
+	err = extractFiles(r, targetFolder, strip, runtime.NumCPU())
+	switch err.(type) {
+	case nil, ErrCorruptArchive, ErrTooLarge, ErrDiskFull:
+		return err
+	}
+
+	log.Printf("failed extracting %s in parallel: %v, extracting it serially\n", archive, err)
+	if err := os.RemoveAll(targetFolder); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return extract(r, targetFolder, strip)
+}
+
+// archiveFile returns the content of the file name of an archive, once
+// the strip leading components of its path removed. Returns an error
+// satisfying os.IsNotExist if the archive has no such file.
+func archiveFile(archive string, strip int, name string) ([]byte, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, ErrCorruptArchive{archive: archive, err: err}
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, ErrCorruptArchive{archive: archive, err: err}
+		}
+
+		if p, err := stripPath(header.Name, strip); err == nil && p == name && header.Typeflag == tar.TypeReg {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// archiveCommit returns the commit an archive generated by git archive
+// was made from, as recorded in its global header, or "" if it has none
+func archiveCommit(archive string) string {
+	f, err := os.Open(archive)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return ""
+	}
+	defer gzr.Close()
+
+	header, err := tar.NewReader(gzr).Next()
+	if err != nil || header.Typeflag != tar.TypeXGlobalHeader {
+		return ""
+	}
+
+	return header.PAXRecords["comment"]
+}
+
+// countArchiveEntries returns the number of files and folders of an
+// archive, as listed in it, and how many of them are folders or symlinks
+func countArchiveEntries(archive string) (int64, int64, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer gzr.Close()
+
+	var n, dirs int64
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return n, dirs, nil
+		} else if err != nil {
+			return n, dirs, err
+		}
+		n++
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeSymlink {
+			dirs++
+		}
+	}
+}
+
+// reserveArchiveInodes reserves, with --check-inodes, the inodes needed
+// to install the archive to targetFolder, and to extract it to the cache
+// if extracted does not exist yet, see reserveInodes. The number of files
+// is that of the copy already extracted, or listed in the archive. Hard
+// linked files use no inode of their own, only folders and symlinks are
+// created again in targetFolder if link is true.
+func reserveArchiveInodes(archive, extracted, targetFolder string, link bool) (func(), error) {
+	if !checkInodes {
+		return func() {}, nil
+	}
+
+	releaseExtracted := func() {}
+	n, dirs, err := countFiles(extracted)
+	if err != nil {
+		if n, dirs, err = countArchiveEntries(archive); err != nil {
+			// Broken archives are reported when extracted
+			return func() {}, nil
+		}
+		if releaseExtracted, err = reserveInodes(extracted, n); err != nil {
+			return func() {}, err
+		}
+	}
+
+	if link {
+		n = dirs
+	}
+	releaseTarget, err := reserveInodes(targetFolder, n)
+	if err != nil {
+		releaseExtracted()
+		return func() {}, err
+	}
+
+	return func() {
+		releaseExtracted()
+		releaseTarget()
+	}, nil
+}
+
+// Locks of the archives of the cache, by archive, held while they are
+// extracted, installed or removed, as a module declared with several
+// install paths is installed concurrently from the same archive
+var archiveLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockArchive locks archive, and returns its lock to unlock it
+func lockArchive(archive string) *sync.Mutex {
+	archiveLocks.Lock()
+	lock, ok := archiveLocks.locks[archive]
+	if !ok {
+		lock = &sync.Mutex{}
+		archiveLocks.locks[archive] = lock
+	}
+	archiveLocks.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// linkFromCache returns true if the files of a module can be hard linked
+// to the copy of its archive extracted in the cache, shared with other
+// environments, which must then not be modified once installed
+func linkFromCache(m PuppetModule) bool {
+	// Post-extract commands may edit files in place, changing the owner
+	// or the permissions of a file changes those of all its links
+	return len(m.PostExtract()) == 0 && chownUID < 0 && dirMode == 0 && fileMode == 0
+}
+
+// installArchive installs the content of an archive of the cache to
+// targetFolder. Archives are extracted once, next to the archive, and
+// hard linked to the folders of the modules if link is true, copied
+// otherwise.
+func installArchive(archive string, targetFolder string, strip int, link bool) error {
+	defer lockArchive(archive).Unlock()
+
+	return installLockedArchive(archive, targetFolder, strip, link)
+}
+
+// installLockedArchive installs an archive like installArchive, the
+// archive being locked by the caller
+func installLockedArchive(archive string, targetFolder string, strip int, link bool) error {
+	extracted := strings.TrimSuffix(archive, ".tar.gz")
+
+	release, err := reserveArchiveInodes(archive, extracted, targetFolder, link)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := os.Stat(extracted); err != nil {
+		// Extracted to a temporary folder first, so that a failed
+		// extraction never leaves a partial copy in the cache
+		tmp := extracted + ".tmp"
+		os.RemoveAll(tmp)
+		if err := extractArchive(archive, tmp, strip); err != nil {
+			os.RemoveAll(tmp)
+			if cerr, ok := err.(ErrCorruptArchive); ok {
+				cerr.archive = archive
+				return cerr
+			}
+			return err
+		}
+		if err := os.Rename(tmp, extracted); err != nil {
+			return err
+		}
+	}
+
+	if err := installTree(extracted, targetFolder, link); err != nil {
+		return err
+	}
+
+	// The copy in the cache may have been extracted with other modes,
+	// modules are then copied from it, see linkFromCache
+	return applyModes(targetFolder)
+}
+
+// installCachedArchive installs an archive of the cache to targetFolder.
+// If the archive is corrupt, it is removed and downloaded again once.
+func installCachedArchive(archive string, targetFolder string, strip int, link bool, download func() error) error {
+	lock := lockArchive(archive)
+	err := installLockedArchive(archive, targetFolder, strip, link)
+	if _, ok := err.(ErrCorruptArchive); !ok {
+		lock.Unlock()
+		return err
+	}
+
+	log.Printf("%v, downloading it again\n", err)
+	removeLockedArchive(archive)
+	lock.Unlock()
+
+	// Unlocked while downloading, fetches may remove the archive
+	if err := download(); err != nil {
+		return err
+	}
+
+	if err = installArchive(archive, targetFolder, strip, link); err == nil {
+		log.Printf("recovered corrupt cache entry %s\n", archive)
+	}
+
+	return err
+}
+
+// removeArchive removes an archive from the cache, with its extracted
+// copy, once the modules being installed from it are
+func removeArchive(archive string) {
+	defer lockArchive(archive).Unlock()
+
+	removeLockedArchive(archive)
+}
+
+// removeLockedArchive removes an archive like removeArchive, the archive
+// being locked by the caller
+func removeLockedArchive(archive string) {
+	os.Remove(archive)
+	os.Remove(sourceFile(archive))
+	os.RemoveAll(strings.TrimSuffix(archive, ".tar.gz"))
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tarball returns a tar.gz archive containing the given files,
+// names ending with / are folders
+func tarball(t *testing.T, files []string) *bytes.Buffer {
+	return tarballContents(t, files, nil)
+}
+
+// tarballContents returns a tar.gz archive containing the given files,
+// with their content in contents. Files missing from contents contain
+// their name.
+func tarballContents(t *testing.T, files []string, contents map[string][]byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for _, f := range files {
+		if strings.HasSuffix(f, "/") {
+			if err := tw.WriteHeader(&tar.Header{Name: f, Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		content, ok := contents[f]
+		if !ok {
+			content = []byte(f)
+		}
+		hdr := &tar.Header{Name: f, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tw.Close()
+	gzw.Close()
+	return &buf
+}
+
+func TestExtractStrip(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    []string
+		strip    int
+		expected []string
+	}{
+		{
+			name:     "archive with a wrapper folder",
+			files:    []string{"puppetlabs-apache-0a1b2c3/", "puppetlabs-apache-0a1b2c3/metadata.json", "puppetlabs-apache-0a1b2c3/manifests/", "puppetlabs-apache-0a1b2c3/manifests/init.pp"},
+			strip:    1,
+			expected: []string{"metadata.json", "manifests/init.pp"},
+		}, {
+			name:     "archive without a wrapper folder",
+			files:    []string{"metadata.json", "manifests/", "manifests/init.pp"},
+			strip:    0,
+			expected: []string{"metadata.json", "manifests/init.pp"},
+		},
+	}
+
+	for _, c := range testCases {
+		dir, err := ioutil.TempDir("", "r10k-go")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := extract(tarball(t, c.files), dir, c.strip); err != nil {
+			t.Errorf("%s: failed extracting: %v", c.name, err)
+		}
+
+		for _, f := range c.expected {
+			if _, err := os.Stat(path.Join(dir, f)); err != nil {
+				t.Errorf("%s: %s was not extracted", c.name, f)
+			}
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExtractParallel(t *testing.T) {
+	files := []string{"acme-foo-1.0.0/", "acme-foo-1.0.0/manifests/"}
+	for i := 0; i < 50; i++ {
+		files = append(files, fmt.Sprintf("acme-foo-1.0.0/manifests/class%d.pp", i))
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractFiles(tarball(t, files), dir, 1, 8); err != nil {
+		t.Fatalf("failed extracting: %v", err)
+	}
+
+	for _, f := range files[2:] {
+		name := strings.TrimPrefix(f, "acme-foo-1.0.0/")
+		if content, err := ioutil.ReadFile(path.Join(dir, name)); err != nil || string(content) != f {
+			t.Errorf("%s was not extracted: %v", name, err)
+		}
+	}
+}
+
+func TestExtractOutside(t *testing.T) {
+	testCases := [][]*tar.Header{
+		{{Name: "acme-foo-1.0.0/../../evil.rb", Mode: 0644, Typeflag: tar.TypeReg}},
+		{{Name: "acme-foo-1.0.0/lib", Linkname: "/etc", Typeflag: tar.TypeSymlink}},
+		{{Name: "acme-foo-1.0.0/lib", Linkname: "../../etc", Typeflag: tar.TypeSymlink}},
+		{{Name: "acme-foo-1.0.0/passwd", Linkname: "acme-foo-1.0.0/../../etc/passwd", Typeflag: tar.TypeLink}},
+		// Chained symlinks, each in the module
+		{
+			{Name: "acme-foo-1.0.0/d/", Mode: 0755, Typeflag: tar.TypeDir},
+			{Name: "acme-foo-1.0.0/d/l", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: "acme-foo-1.0.0/d/l/m", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: "acme-foo-1.0.0/d/l/m/evil.rb", Mode: 0644, Typeflag: tar.TypeReg},
+		},
+		{
+			{Name: "acme-foo-1.0.0/d/", Mode: 0755, Typeflag: tar.TypeDir},
+			{Name: "acme-foo-1.0.0/d/l", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: "acme-foo-1.0.0/d/m", Linkname: "l/..", Typeflag: tar.TypeSymlink},
+		},
+		// Files written through a symlink replacing them
+		{
+			{Name: "acme-foo-1.0.0/evil.rb", Mode: 0644, Typeflag: tar.TypeReg},
+			{Name: "acme-foo-1.0.0/evil.rb", Linkname: "manifests", Typeflag: tar.TypeSymlink},
+		},
+	}
+
+	for _, headers := range testCases {
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gzw)
+		for _, hdr := range headers {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		gzw.Close()
+
+		dir, err := ioutil.TempDir("", "r10k-go")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := headers[len(headers)-1]
+		if err := extract(&buf, path.Join(dir, "module"), 1); err == nil {
+			t.Errorf("expected an error extracting %s to %s", last.Name, last.Linkname)
+		}
+		if _, err := os.Stat(path.Join(dir, "evil.rb")); err == nil {
+			t.Errorf("%s was extracted outside of the module", last.Name)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExtractEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extract(tarball(t, []string{"puppetlabs-apache-0a1b2c3/"}), dir, 1); err == nil {
+		t.Errorf("expected an error extracting an archive without files")
+	}
+}
+
+func TestInstallArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "1.0.0.tar.gz")
+	if err := ioutil.WriteFile(archive, tarball(t, []string{"apache-1.0.0/", "apache-1.0.0/metadata.json"}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both environments get the files extracted once in the cache
+	for _, env := range []string{"production", "development"} {
+		if err := installArchive(archive, path.Join(dir, env, "apache"), 1, true); err != nil {
+			t.Fatalf("failed installing archive to %s: %v", env, err)
+		}
+	}
+
+	cached, err := os.Stat(path.Join(dir, "1.0.0", "metadata.json"))
+	if err != nil {
+		t.Fatalf("archive was not extracted to the cache: %v", err)
+	}
+	for _, env := range []string{"production", "development"} {
+		fi, err := os.Stat(path.Join(dir, env, "apache", "metadata.json"))
+		if err != nil || !os.SameFile(cached, fi) {
+			t.Errorf("expected metadata.json of %s to be linked to the cache", env)
+		}
+	}
+
+	// Copies can be modified without changing the cache
+	if err := installArchive(archive, path.Join(dir, "staging", "apache"), 1, false); err != nil {
+		t.Fatalf("failed copying archive: %v", err)
+	}
+	if fi, err := os.Stat(path.Join(dir, "staging", "apache", "metadata.json")); err != nil || os.SameFile(cached, fi) {
+		t.Errorf("expected metadata.json to be copied from the cache, %v", err)
+	}
+}
+
+func TestInstallArchiveConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{"apache-1.0.0/", "apache-1.0.0/metadata.json", "apache-1.0.0/manifests/", "apache-1.0.0/manifests/init.pp"}
+	for i := 0; i < 200; i++ {
+		files = append(files, fmt.Sprintf("apache-1.0.0/manifests/class%d.pp", i))
+	}
+	archive := path.Join(dir, "1.0.0.tar.gz")
+	if err := ioutil.WriteFile(archive, tarball(t, files).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive is extracted to the cache by only one of them
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- installArchive(archive, path.Join(dir, fmt.Sprintf("env%d", i), "apache"), 1, true)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("failed installing archive concurrently: %v", err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if _, err := os.Stat(path.Join(dir, fmt.Sprintf("env%d", i), "apache", "manifests", "init.pp")); err != nil {
+			t.Errorf("module was not installed: %v", err)
+		}
+	}
+}
+
+func TestInstallCachedArchiveCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "1.0.0.tar.gz")
+	valid := tarball(t, []string{"apache-1.0.0/", "apache-1.0.0/metadata.json"}).Bytes()
+
+	// A truncated download
+	if err := ioutil.WriteFile(archive, valid[:len(valid)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	downloads := 0
+	download := func() error {
+		downloads++
+		return ioutil.WriteFile(archive, valid, 0644)
+	}
+
+	if err := installCachedArchive(archive, path.Join(dir, "production", "apache"), 1, true, download); err != nil {
+		t.Fatalf("failed recovering corrupt archive: %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("expected the archive to be downloaded again once, got %d downloads", downloads)
+	}
+	if _, err := os.Stat(path.Join(dir, "production", "apache", "metadata.json")); err != nil {
+		t.Errorf("module was not installed: %v", err)
+	}
+}
+
+func TestExtractMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func() { maxExtractedSize = 0 }()
+	maxExtractedSize = 20
+
+	// Contents of files are their names
+	archive := tarball(t, []string{"apache/", "apache/metadata.json", "apache/manifests/", "apache/manifests/init.pp"})
+	if err := extract(archive, dir, 1); err == nil {
+		t.Errorf("expected an error extracting an archive larger than the maximum")
+	} else if _, ok := err.(ErrTooLarge); !ok || retryable(err) {
+		t.Errorf("expected a non retryable error, got %v", err)
+	}
+}
+
+func TestCheckArchiveInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "1.0.0.tar.gz")
+	files := []string{"apache-1.0.0/", "apache-1.0.0/metadata.json", "apache-1.0.0/manifests/", "apache-1.0.0/manifests/init.pp"}
+	if err := ioutil.WriteFile(archive, tarball(t, files).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, dirs, err := countArchiveEntries(archive); err != nil || n != 4 || dirs != 2 {
+		t.Errorf("expected 4 entries, 2 folders, in the archive, got %d, %d (%v)", n, dirs, err)
+	}
+
+	defer func() { checkInodes = false }()
+	checkInodes = true
+	release, err := reserveArchiveInodes(archive, path.Join(dir, "1.0.0"), path.Join(dir, "apache"), false)
+	if err != nil {
+		t.Errorf("expected enough inodes to install 4 files: %v", err)
+	}
+	release()
+
+	if _, err := freeInodes(dir); err != nil {
+		t.Skipf("the filesystem does not report its inodes: %v", err)
+	}
+	if _, err := reserveInodes(dir, 1<<62); err == nil {
+		t.Errorf("expected an error creating more files than there are inodes")
+	} else if _, ok := err.(ErrDiskFull); !ok {
+		t.Errorf("expected an ErrDiskFull, got %v", err)
+	}
+
+	// Extracted, the archive needs 102 inodes copied, 2 hard linked,
+	// while another module reserves all the others but 50
+	archive = path.Join(dir, "2.0.0.tar.gz")
+	files = []string{"apache-2.0.0/", "apache-2.0.0/files/"}
+	for i := 0; i < 100; i++ {
+		files = append(files, fmt.Sprintf("apache-2.0.0/files/%d", i))
+	}
+	if err := ioutil.WriteFile(archive, tarball(t, files).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractArchive(archive, path.Join(dir, "2.0.0"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	available, err := freeInodes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther, err := reserveInodes(dir, int64(available)-50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOther()
+
+	if release, err := reserveArchiveInodes(archive, path.Join(dir, "2.0.0"), path.Join(dir, "apache"), true); err != nil {
+		t.Errorf("expected enough inodes to hard link the module: %v", err)
+	} else {
+		release()
+	}
+	if _, err := reserveArchiveInodes(archive, path.Join(dir, "2.0.0"), path.Join(dir, "apache"), false); err == nil {
+		t.Errorf("expected inodes reserved by other modules to be counted")
+	}
+}
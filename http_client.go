@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"time"
+)
+
+// Default timeouts of the HTTP client. There is no overall timeout, so
+// that large modules can be downloaded over slow links, but stalled
+// connections are dropped after readTimeout without receiving data.
+var (
+	connectTimeout = 30 * time.Second // To establish TCP connections, and then TLS sessions
+	readTimeout    = 60 * time.Second
+)
+
+// Redirects followed before giving up, GitHub archives are redirected
+// to codeload for example
+const maxRedirects = 10
+
+// Client used to download modules
+var httpClient = newHTTPClient()
+
+// idleTimeoutConn fails reads when no data is received for timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	timeout := readTimeout
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := dialer.Dial(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &idleTimeoutConn{Conn: conn, timeout: timeout}, nil
+			},
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: readTimeout,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	// Credentials are only sent to the hosts they are configured for
+	if req.URL.Host != via[len(via)-1].URL.Host {
+		req.Header.Del("Authorization")
+		setCredentials(req)
+	}
+
+	tracef("following redirect from %s to %s\n", via[len(via)-1].URL, req.URL)
+	return nil
+}
+
+// redirectError makes errors happening after a redirect of the
+// requested URL explicit
+func redirectError(requested string, err error) error {
+	if uerr, ok := err.(*neturl.Error); ok && uerr.URL != requested {
+		return fmt.Errorf("failed following redirect of %s to %s: %v", requested, uerr.URL, uerr.Err)
+	}
+
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// With --max-load, no module starts installing while the load average
+// of the system is above maxLoad. 0 disables the check.
+var maxLoad float64
+
+// How often the load average is checked while waiting
+var loadCheckInterval = 5 * time.Second
+
+// waitForLoad blocks until the load average is below maxLoad
+func waitForLoad() {
+	if maxLoad <= 0 {
+		return
+	}
+
+	for waiting := false; ; waiting = true {
+		load, err := loadAverage()
+		if err != nil || load <= maxLoad {
+			return
+		}
+
+		if !waiting {
+			log.Printf("load average %.2f is above %.2f, waiting to install more modules\n", load, maxLoad)
+		}
+		time.Sleep(loadCheckInterval)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func loadAverage() (float64, error) {
+	return 0, errors.New("load average not supported on this platform")
+}
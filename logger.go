@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Number of warnings logged during the run
+var warningsCount int32
+
+// warnf logs a warning. Warnings are counted, so that they can fail the
+// run when using --strict-warnings.
+func warnf(format string, v ...interface{}) {
+	atomic.AddInt32(&warningsCount, 1)
+	log.Printf("warning: "+format, v...)
+}
+
+func warnings() int {
+	return int(atomic.LoadInt32(&warningsCount))
+}
+
+// Whether to log details useful to debug downloads, with --trace
+var traceEnabled bool
+
+func tracef(format string, v ...interface{}) {
+	if traceEnabled {
+		log.Printf("trace: "+format, v...)
+	}
+}
@@ -3,26 +3,41 @@ package main
 // Todo: Remove duplication between modules
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Context of the run, cancelled when --deploy-timeout expires
+var runContext = context.Background()
+
 // ForgeModule, GitModule, GithubTarballModule, ....
 type PuppetModule interface {
 	Name() string
+	Version() string
 	Download() DownloadError
 	SetEnvRoot(string)
+	SetModulePath(string)
 	TargetFolder() string
 	SetCacheFolder(string)
+	CacheFolder() string
 	Hash() string
 	IsUpToDate() bool
 	Processed()
+	After() string
+	IgnoreMissing() bool
+	NoCache() bool
+	NoDeps() bool
+	PostExtract() []string
 }
 
 // Can be a PuppetFile or a metadata.json file
@@ -37,110 +52,333 @@ type DownloadError struct {
 	retryable bool
 }
 
-type DownloadResult struct {
-	err       DownloadError
-	skipped   bool
-	willRetry bool
-	m         PuppetModule
+// ErrNotFound is returned when a module, or the version requested, does
+// not exist. Retrying can not succeed.
+type ErrNotFound struct{ s string }
+
+func (e ErrNotFound) Error() string { return e.s }
+
+// retryable returns true if downloading a module failing with err can
+// succeed when retried
+func retryable(err error) bool {
+	switch err.(type) {
+	case ErrDiskFull, ErrNotFound, ErrTooLarge:
+		return false
+	}
+
+	return true
 }
 
-func downloadModules(c chan PuppetModule, results chan DownloadResult, envBaseDir string) {
-	maxTries := 3
-	retryDelay := 5 * time.Second
+type DownloadResult struct {
+	err         DownloadError
+	skipped     bool
+	willRetry   bool
+	unsupported bool // The module does not support --target-os, it was not installed
+	m           PuppetModule
+}
 
+// downloadModules installs the modules of c, or only downloads them to
+// the cache if cacheOnly is true, and sends the results of each try
+func downloadModules(c chan PuppetModule, results chan DownloadResult, cacheOnly bool) {
 	for m := range c {
-		derr := DownloadError{nil, false}
+		status.start(m.Name())
 
-		if m.IsUpToDate() {
-			go func(m PuppetModule) {
-				results <- DownloadResult{err: DownloadError{nil, false}, skipped: true, willRetry: false, m: m}
-			}(m)
+		// Modules not supporting --target-os are not installed, their
+		// metadata.json is read from the cache
+		if targetOS != "" {
+			if derr := withRetries(m, results, prefetch); derr.error != nil {
+				results <- DownloadResult{err: derr, skipped: false, willRetry: false, m: m}
+				continue
+			}
+			if !supportsTargetOS(m) {
+				results <- DownloadResult{err: DownloadError{nil, false}, skipped: true, unsupported: true, m: m}
+				continue
+			}
+		}
+
+		if cacheOnly {
+			results <- DownloadResult{err: withRetries(m, results, prefetch), skipped: false, willRetry: false, m: m}
 			continue
 		}
 
-		if err := os.RemoveAll(m.TargetFolder()); err != nil {
-			log.Fatalf("Error removing folder: %s", m.TargetFolder())
+		// Modules not using the cache are installed again
+		if !m.NoCache() && m.IsUpToDate() {
+			results <- DownloadResult{err: DownloadError{nil, false}, skipped: true, willRetry: false, m: m}
+			continue
 		}
 
-		derr = m.Download()
-		for i := 0; derr.error != nil && i < maxTries-1 && derr.retryable; i++ {
-			go func(derr DownloadError, m PuppetModule) {
-				results <- DownloadResult{err: derr, skipped: false, willRetry: true, m: m}
-			}(derr, m)
-			time.Sleep(retryDelay)
-			derr = m.Download()
+		waitForLoad()
+
+		if r, ok := m.(contentReuser); ok && compareContent && !m.NoCache() && r.reuseContent() {
+			results <- DownloadResult{err: postExtract(m), skipped: true, willRetry: false, m: m}
+			continue
 		}
 
+		if err := prepareTarget(m); err != nil {
+			log.Fatalf("Error preparing folder %s: %v", m.TargetFolder(), err)
+		}
+
+		moduleLogf(m.Name(), "installing %s %s to %s\n", m.Name(), m.Version(), m.TargetFolder())
+		start := time.Now()
+		derr := withRetries(m, results, download)
+		atomic.AddInt64(&stats.downloadTime, int64(time.Since(start)))
+
 		if derr.error != nil {
-			go func(derr DownloadError, m PuppetModule) {
-				results <- DownloadResult{err: derr, skipped: false, willRetry: false, m: m}
-			}(derr, m)
+			results <- DownloadResult{err: derr, skipped: false, willRetry: false, m: m}
 			continue
 		}
 
-		// Success
-		go func(m PuppetModule) {
-			results <- DownloadResult{err: DownloadError{nil, false}, skipped: false, willRetry: false, m: m}
-		}(m)
+		results <- DownloadResult{err: postExtract(m), skipped: false, willRetry: false, m: m}
+	}
+}
+
+// Delay before trying to download a module again
+var retryDelay = 5 * time.Second
+
+// withRetries runs install for the module, trying again on retryable
+// errors while the retry budget allows it. Failed tries are sent to
+// results, the error of the last one is returned. The module is retried
+// by the same worker, without being queued or started again.
+func withRetries(m PuppetModule, results chan<- DownloadResult, install func(PuppetModule) DownloadError) DownloadError {
+	maxTries := 3
+
+	derr := install(m)
+	for i := 0; derr.error != nil && i < maxTries-1 && derr.retryable && takeRetry(); i++ {
+		results <- DownloadResult{err: derr, skipped: false, willRetry: true, m: m}
+		time.Sleep(retryDelay)
+		derr = install(m)
+	}
+
+	return derr
+}
+
+// prepareTarget removes any previous installation of the module, and
+// creates the folder it is installed in, which may not exist yet when
+// using a custom install_path. With --update-in-place, modules able to
+// update their previous installation remove it themselves if they can't.
+// Modules installed from an archive keep it until it is replaced, see
+// installTree.
+func prepareTarget(m PuppetModule) error {
+	u, ok := m.(interface {
+		updatesInPlace() bool
+	})
+	_, fromArchive := m.(archived)
+	if !fromArchive && (!ok || !u.updatesInPlace()) {
+		if err := os.RemoveAll(m.TargetFolder()); err != nil {
+			return err
+		}
 	}
+
+	return os.MkdirAll(path.Dir(m.TargetFolder()), 0755)
 }
 
-func deduplicate(in <-chan PuppetModule, out chan<- PuppetModule, cache *Cache, environmentRootFolder string, done chan<- bool) {
-	modules := make(map[string]bool)
+// postExtract runs the post-extract commands of a freshly installed
+// module, then changes the owner of its files with --chown. The module
+// is removed if they fail, so that they run again next time.
+func postExtract(m PuppetModule) DownloadError {
+	if err := runPostExtract(m); err != nil {
+		os.RemoveAll(m.TargetFolder())
+		return DownloadError{err, false}
+	}
+
+	if err := chownTree(m.TargetFolder()); err != nil {
+		os.RemoveAll(m.TargetFolder())
+		return DownloadError{fmt.Errorf("failed changing the owner of %s: %v", m.TargetFolder(), err), false}
+	}
+
+	return DownloadError{nil, false}
+}
+
+// normalizeModuleName returns the canonical form of a module name:
+// PuppetLabs/Apache and puppetlabs-apache are the same module
+func normalizeModuleName(name string) string {
+	return strings.Replace(strings.ToLower(name), "/", "-", -1)
+}
+
+// deduplicate forwards modules to install once, they are recorded in
+// managed by the folder they are installed to. If staging is not empty,
+// modules of the Puppetfile are installed there instead, so that only
+// their dependencies are installed to the environment, and not recorded.
+func deduplicate(in <-chan PuppetModule, out chan<- PuppetModule, cache *Cache, environmentRootFolder string, modulePath string, staging string, managed map[string]PuppetModule, done chan<- bool) {
+	type declaration struct {
+		name, version string
+		source        string // Type and source of the module, "git https://..." for example
+	}
+	modules := make(map[string]declaration)
+	declared := make(map[string]bool) // Modules of the Puppetfile, with a staging folder
 
 	for m := range in {
+		if _, ok := m.(*GitModule); ok {
+			if err := checkGit(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		m.SetEnvRoot(environmentRootFolder)
+		m.SetModulePath(modulePath)
 		m.SetCacheFolder(path.Join(cache.folder, m.Hash()))
 
-		if _, ok := modules[m.TargetFolder()]; ok {
+		dep, ok := m.(interface {
+			isDependency() bool
+		})
+		isDependency := ok && dep.isDependency()
+
+		if staging != "" {
+			if !isDependency {
+				declared[normalizeModuleName(m.Name())] = true
+				m.(interface {
+					stage(string)
+				}).stage(staging)
+			} else if declared[normalizeModuleName(m.Name())] {
+				// Provided separately, like the other modules of the Puppetfile
+				status.drop()
+				m.Processed()
+				continue
+			}
+		}
+
+		// Module folders only differing by case would collide once deployed
+		key := strings.ToLower(m.TargetFolder())
+
+		d := dumpModule(m)
+		source := strings.TrimSpace(d.Type + " " + d.Source)
+
+		if first, ok := modules[key]; ok {
+			// Dependencies are satisfied by modules declared in the
+			// Puppetfile, wherever they are downloaded from
+			if first.source != source && !isDependency {
+				warnf("modules %s (%s) and %s (%s) are both installed to %s, using %s\n",
+					first.name, first.source, m.Name(), source, m.TargetFolder(), first.name)
+			} else if normalizeModuleName(first.name) == normalizeModuleName(m.Name()) &&
+				first.version != "" && m.Version() != "" && first.version != m.Version() {
+				warnf("module %s declared with version %s and %s as %s, using %s\n",
+					first.name, first.version, m.Version(), m.Name(), first.version)
+			}
+			status.drop()
 			m.Processed()
 			continue
 		}
 
-		modules[m.TargetFolder()] = true
+		modules[key] = declaration{name: m.Name(), version: m.Version(), source: source}
+		if staging == "" || isDependency {
+			managed[m.TargetFolder()] = m
+		}
+		status.queue()
 		out <- m
 	}
 
 	done <- true
 }
 
-func processModuleFiles(moduleFiles <-chan moduleFile, modules chan PuppetModule, wg *sync.WaitGroup, done chan bool) {
-	for mf := range moduleFiles {
-		if err := mf.Process(modules, func() { wg.Done() }); err != nil {
-			if serr, ok := err.(ErrMalformedPuppetfile); ok {
-				log.Fatal(serr)
-			} else {
-				log.Printf("failed parsing %s: %v\n", mf.Filename(), err)
+// processModuleFiles parses Puppetfiles and metadata.json files, with
+// up to workers files processed at once, so that dependencies of deep
+// dependency trees are resolved in parallel
+func processModuleFiles(moduleFiles <-chan moduleFile, modules chan PuppetModule, wg *sync.WaitGroup, workers int, keepGoing bool, errorsCount chan<- int) {
+	var parseErrors int32
+	var pool sync.WaitGroup
+
+	for w := 1; w <= workers; w++ {
+		pool.Add(1)
+		go func() {
+			defer pool.Done()
+
+			for mf := range moduleFiles {
+				if err := mf.Process(modules, func() { wg.Done() }); err != nil {
+					if serr, ok := err.(ErrMalformedPuppetfile); ok {
+						if !keepGoing {
+							log.Fatal(serr)
+						}
+						log.Printf("skipping modules: %v\n", serr)
+						atomic.AddInt32(&parseErrors, 1)
+					} else {
+						log.Printf("failed parsing %s: %v\n", mf.Filename(), err)
+					}
+				}
+				mf.Close()
 			}
-		}
-		mf.Close()
+		}()
 	}
 
-	done <- true
+	pool.Wait()
+	errorsCount <- int(parseErrors)
 }
 
-func parseResults(results <-chan DownloadResult, downloadDeps bool, metadataFiles chan<- moduleFile, wg *sync.WaitGroup, errorsCount chan<- int) {
+// parseResults reports the results of the workers, and queues the
+// dependencies of installed modules. The folders of modules not
+// supporting --target-os are recorded in unsupported.
+func parseResults(results <-chan DownloadResult, opts installOptions, metadataFiles chan<- moduleFile, wg *sync.WaitGroup, unsupported map[string]bool, errorsCount chan<- int) {
 	downloadErrors := 0
+	unchanged := 0
 
 	for res := range results {
 		if res.err.error != nil {
-			if res.err.retryable == true && res.willRetry == true {
-				log.Printf("failed downloading %s: %v... Retrying\n", res.m.Name(), res.err)
+			if _, ok := res.err.error.(ErrDiskFull); ok {
+				// No other module will be able to install either
+				moduleLogf(res.m.Name(), "failed downloading %s: %v. Aborting!", res.m.Name(), res.err)
+				log.Fatalf("failed downloading %s: %v. Aborting!", res.m.Name(), res.err)
+			}
+
+			if _, ok := res.err.error.(ErrNotFound); ok && res.m.IgnoreMissing() {
+				warnf("ignoring missing module %s: %v\n", res.m.Name(), res.err)
+				moduleLogf(res.m.Name(), "ignoring missing module %s: %v\n", res.m.Name(), res.err)
+				status.finish(res.m.Name(), false)
+				res.m.Processed()
+			} else if res.err.retryable == true && res.willRetry == true {
+				logModule(res.m.Name(), "failed downloading %s: %v... Retrying\n", res.m.Name(), res.err)
 			} else {
-				log.Printf("failed downloading %s: %v. Giving up!\n", res.m.Name(), res.err)
+				logModule(res.m.Name(), "failed downloading %s: %v. Giving up!\n", res.m.Name(), res.err)
 				downloadErrors++
+				atomic.AddInt64(&stats.failed, 1)
+				status.finish(res.m.Name(), true)
 				res.m.Processed()
 			}
 			continue
 		}
 
-		if res.skipped != true {
-			log.Println("Downloaded " + res.m.Name())
+		if res.unsupported {
+			warnf("module %s does not support %s, skipping it\n", res.m.Name(), targetOS)
+			moduleLogf(res.m.Name(), "module %s does not support %s, skipping it\n", res.m.Name(), targetOS)
+			// Installed by a previous run
+			if !opts.cacheOnly {
+				os.RemoveAll(res.m.TargetFolder())
+			}
+			unsupported[res.m.TargetFolder()] = true
+			atomic.AddInt64(&stats.skipped, 1)
+			status.finish(res.m.Name(), false)
+			res.m.Processed()
+			continue
+		}
+
+		if opts.cacheOnly {
+			if source := cachedSource(res.m); source != "" {
+				logModule(res.m.Name(), "Fetched %s to %s from %s\n", res.m.Name(), cachedPath(res.m), source)
+			} else {
+				logModule(res.m.Name(), "Fetched %s to %s\n", res.m.Name(), cachedPath(res.m))
+			}
+			atomic.AddInt64(&stats.downloaded, 1)
+		} else if res.skipped != true {
+			logModule(res.m.Name(), "Downloaded %s\n", res.m.Name())
+			atomic.AddInt64(&stats.downloaded, 1)
+		} else {
+			moduleLogf(res.m.Name(), "%s is up to date\n", res.m.Name())
+			unchanged++
+			atomic.AddInt64(&stats.skipped, 1)
 		}
+		status.finish(res.m.Name(), false)
+
+		usedArchives.record(res.m)
 
-		if downloadDeps {
-			mf := NewMetadataFile(path.Join(res.m.TargetFolder(), "metadata.json"))
+		// Dependencies of modules declared with :resolve_deps => false
+		// are managed elsewhere
+		if opts.downloadDeps && !res.m.NoDeps() {
+			var mf *MetadataFile
+			if opts.cacheOnly {
+				mf = cachedMetadataFile(res.m)
+			} else {
+				mf = NewMetadataFile(path.Join(res.m.TargetFolder(), "metadata.json"))
+			}
 			if mf != nil {
+				status.expectDeps()
 				wg.Add(1)
 				go func() { metadataFiles <- mf }()
 			}
@@ -149,27 +387,489 @@ func parseResults(results <-chan DownloadResult, downloadDeps bool, metadataFile
 		res.m.Processed()
 	}
 
+	if opts.onlyChanged {
+		log.Printf("%d module(s) unchanged\n", unchanged)
+	}
+
 	errorsCount <- downloadErrors
 }
 
+type installOptions struct {
+	numWorkers   int
+	depWorkers   int // Number of metadata.json files processed in parallel
+	resultBuffer int // Number of download results that can be queued
+	downloadDeps bool
+	keepGoing    bool
+	onlyChanged  bool // Only report the number of up to date modules
+
+	// Number of versions of each module kept in the cache, all if 0
+	keepCacheVersions int
+
+	// Remove the folders of module paths that are not modules of the
+	// Puppetfile, except those matching excludeSpec
+	purge       bool
+	excludeSpec []string
+
+	// Folder modules without install_path are installed to, relative
+	// to the environment unless absolute. "modules" if empty.
+	modulePath string
+
+	// Install the largest modules first, by their size in the cache
+	scheduleBySize bool
+
+	// Only install the dependencies of the modules of the Puppetfile,
+	// which are installed to a temporary folder to resolve them
+	onlyDeps bool
+
+	// Only download modules to the cache, dependencies being read from
+	// there, without installing them to the environment
+	cacheOnly bool
+}
+
+// installer is a pipeline of workers installing modules to an
+// environment. It is started before the Puppetfile is available, so
+// workers are ready while the environment is being fetched.
+type installer struct {
+	results             chan DownloadResult
+	modules             chan PuppetModule
+	modulesDeduplicated chan PuppetModule
+	moduleFiles         chan moduleFile
+	wg                  sync.WaitGroup
+
+	environmentRootFolder string
+	opts                  installOptions
+	managed               map[string]PuppetModule // Modules installed, by folder
+	unsupported           map[string]bool         // Folders of modules not supporting --target-os
+	staging               string                  // Folder modules of the Puppetfile are installed to with --only-deps
+
+	done            chan bool
+	parseErrorCount chan int
+	errorCount      chan int
+}
+
+// startInstaller starts the workers installing modules to the
+// environment folder, using the given cache
+func startInstaller(environmentRootFolder string, cache *Cache, opts installOptions) *installer {
+	i := &installer{
+		// Workers block sending results when the buffer is full, this
+		// bounds the memory used by large Puppetfiles
+		results:             make(chan DownloadResult, opts.resultBuffer),
+		modules:             make(chan PuppetModule),
+		modulesDeduplicated: make(chan PuppetModule),
+		moduleFiles:         make(chan moduleFile),
+		done:                make(chan bool),
+		parseErrorCount:     make(chan int),
+		errorCount:          make(chan int),
+
+		environmentRootFolder: environmentRootFolder,
+		opts:                  opts,
+		managed:               make(map[string]PuppetModule),
+		unsupported:           make(map[string]bool),
+	}
+
+	if opts.onlyDeps {
+		staging, err := ioutil.TempDir("", "r10k-go-staging")
+		if err != nil {
+			log.Fatalf("failed creating a staging folder: %v", err)
+		}
+		i.staging = staging
+	}
+
+	// The scheduler closes the channel of the workers once
+	// modulesDeduplicated is closed
+	toInstall := i.modulesDeduplicated
+	if opts.scheduleBySize {
+		scheduled := make(chan PuppetModule)
+		go scheduleBySize(i.modulesDeduplicated, scheduled, cachedSize)
+		toInstall = scheduled
+	}
+
+	for w := 1; w <= opts.numWorkers; w++ {
+		go downloadModules(toInstall, i.results, opts.cacheOnly)
+	}
+
+	go processModuleFiles(i.moduleFiles, i.modules, &i.wg, opts.depWorkers, opts.keepGoing, i.parseErrorCount)
+	go deduplicate(i.modules, i.modulesDeduplicated, cache, environmentRootFolder, opts.modulePath, i.staging, i.managed, i.done)
+	go parseResults(i.results, opts, i.moduleFiles, &i.wg, i.unsupported, i.errorCount)
+
+	return i
+}
+
+// install installs the modules of the Puppetfile, with the override of
+// the environment if not nil, and their dependencies, then stops the
+// workers and purges unmanaged modules with --purge. No module is
+// installed if puppetfile is empty. Returns the number of errors.
+func (i *installer) install(puppetfiles []string, controlBranch string, override *environmentOverride) int {
+	// Modules declared in several Puppetfiles are deduplicated like
+	// those declared twice in the same one
+	for _, puppetfile := range puppetfiles {
+		pf := NewPuppetFile(puppetfile, controlBranch)
+		pf.override = override
+		i.wg.Add(1)
+		i.moduleFiles <- pf
+	}
+
+	nErr := i.wait()
+	if i.opts.purge && !i.opts.cacheOnly {
+		// Modules of a Puppetfile that failed to parse would be purged
+		if nErr > 0 {
+			log.Printf("not purging %s, as modules failed to install\n", i.environmentRootFolder)
+		} else {
+			nErr += purgeUnmanaged(i.environmentRootFolder, i.opts.modulePath, i.managed, i.opts.excludeSpec)
+		}
+	}
+
+	return nErr
+}
+
+// wait waits for the modules being installed, then stops the workers
+// and removes the staging folder of --only-deps. Returns the number of
+// errors.
+func (i *installer) wait() int {
+	i.wg.Wait()
+	close(i.modules)
+	close(i.modulesDeduplicated)
+	close(i.moduleFiles)
+	close(i.results)
+
+	<-i.done
+	nErr := <-i.errorCount + <-i.parseErrorCount
+	close(i.errorCount)
+	close(i.parseErrorCount)
+
+	// Modules not installed are neither managed nor deployed
+	for folder := range i.unsupported {
+		delete(i.managed, folder)
+	}
+
+	if i.staging != "" {
+		os.RemoveAll(i.staging)
+	}
+
+	return nErr
+}
+
+// installModules downloads the modules of the Puppetfile, with the
+// override of the environment if not nil, and their dependencies, to
+// the environment folder. Returns the number of errors.
+func installModules(puppetfiles []string, environmentRootFolder string, controlBranch string, override *environmentOverride, cache *Cache, opts installOptions) int {
+	return startInstaller(environmentRootFolder, cache, opts).install(puppetfiles, controlBranch, override)
+}
+
+// applyR10kConfig applies the settings of r10k.yml about how modules
+// are downloaded, unless they are given on the command line
+func applyR10kConfig(r10kConfig *r10kConfig, cliOpts map[string]interface{}, opts *installOptions, cacheDir *string, hostKeys, knownHosts string) {
+	if urls := r10kConfig.Forge.urls(); len(urls) > 0 {
+		forgeURLs = urls
+	}
+	githubArchiveMirrors = r10kConfig.Github.ArchiveMirrors
+
+	if r10kConfig.Git.Binary != "" && cliOpts["--git-binary"] == nil {
+		gitBinary = r10kConfig.Git.Binary
+	}
+
+	// The key of r10k.yml overrides the GIT_SSH_COMMAND of the user
+	if r10kConfig.Git.PrivateKey != "" {
+		if err := setupGitSSH(hostKeys, knownHosts, r10kConfig.Git.PrivateKey, true); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if r10kConfig.Git.Proxy != "" {
+		if err := setupGitProxy(r10kConfig.Git.Proxy); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if r10kConfig.Cachedir != "" && cliOpts["--cachedir"] == nil {
+		*cacheDir = r10kConfig.Cachedir
+	}
+
+	if opts.keepCacheVersions == 0 {
+		opts.keepCacheVersions = r10kConfig.KeepCacheVersions
+	}
+
+	urlRewrites = r10kConfig.URLRewrites
+	moduleOverrides = make(map[string]map[string]string)
+	for name, params := range r10kConfig.ModuleOverrides {
+		moduleOverrides[normalizeModuleName(name)] = params
+	}
+	httpCredentials = r10kConfig.Credentials
+}
+
+// exitCode returns the exit code for a run with nErr errors. With
+// --strict-warnings, warnings count as errors.
+func exitCode(nErr int, strictWarnings bool) int {
+	if strictWarnings && warnings() > 0 {
+		log.Printf("%d warning(s) logged, failing due to --strict-warnings\n", warnings())
+		nErr += warnings()
+	}
+
+	return nErr
+}
+
 func main() {
 	var err error
-	var numWorkers int
 	var cache Cache
 
+	start := time.Now()
 	cliOpts := cli()
 
-	if cliOpts["--workers"] == nil {
-		numWorkers = 4
-	} else {
-		numWorkers, err = strconv.Atoi(cliOpts["--workers"].(string))
+	opts := installOptions{
+		numWorkers:     4,
+		depWorkers:     4,
+		downloadDeps:   cliOpts["--no-deps"] != true,
+		keepGoing:      cliOpts["--keep-going"] == true,
+		onlyChanged:    cliOpts["--only-changed"] == true,
+		purge:          cliOpts["--purge"] == true,
+		scheduleBySize: cliOpts["--schedule-by-size"] == true,
+		onlyDeps:       cliOpts["--only-deps"] == true,
+	}
+
+	// Modules of the Puppetfile are provided separately with --only-deps,
+	// they would be purged
+	if opts.onlyDeps && (!opts.downloadDeps || opts.purge) {
+		log.Fatalf("--only-deps can not be used with --no-deps or --purge")
+	}
+
+	if cliOpts["--modulePath"] != nil {
+		opts.modulePath = cliOpts["--modulePath"].(string)
+	}
+
+	if cliOpts["--deploy-timeout"] != nil {
+		seconds, err := strconv.Atoi(cliOpts["--deploy-timeout"].(string))
+		if err != nil || seconds < 1 {
+			log.Fatalf("Parameter --deploy-timeout should be a strictly positive number of seconds")
+		}
+
+		var cancel context.CancelFunc
+		runContext, cancel = context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
+		defer cancel()
+
+		go func() {
+			<-runContext.Done()
+			// Give git commands being killed a moment to exit
+			time.Sleep(time.Second)
+			log.Fatalf("deploy timed out after %d seconds", seconds)
+		}()
+	}
+
+	maxWorkers, err := strconv.Atoi(cliOpts["--max-workers"].(string))
+	if err != nil || maxWorkers < 1 {
+		log.Fatalf("Parameter --max-workers should be a strictly positive integer")
+	}
+
+	if cliOpts["--workers"] == "auto" {
+		var gitWorkers int
+		opts.numWorkers, gitWorkers = autoWorkers(runtime.NumCPU(), maxWorkers)
+		gitSlots = make(chan struct{}, gitWorkers)
+		log.Printf("using %d workers, %d of them installing git modules at once\n", opts.numWorkers, gitWorkers)
+	} else if cliOpts["--workers"] != nil {
+		opts.numWorkers, err = strconv.Atoi(cliOpts["--workers"].(string))
 		if err != nil {
-			log.Fatalf("Parameter --workers should be an integer")
+			log.Fatalf("Parameter --workers should be an integer or auto")
+		}
+	}
+
+	if cliOpts["--dependency-workers"] != nil {
+		opts.depWorkers, err = strconv.Atoi(cliOpts["--dependency-workers"].(string))
+		if err != nil || opts.depWorkers < 1 {
+			log.Fatalf("Parameter --dependency-workers should be a strictly positive integer")
+		}
+	}
+
+	opts.resultBuffer = opts.numWorkers
+	if cliOpts["--result-buffer"] != nil {
+		opts.resultBuffer, err = strconv.Atoi(cliOpts["--result-buffer"].(string))
+		if err != nil || opts.resultBuffer < 0 {
+			log.Fatalf("Parameter --result-buffer should be a non-negative integer")
+		}
+	}
+
+	if cliOpts["--git-protocol"] != nil {
+		gitProtocol = cliOpts["--git-protocol"].(string)
+		if gitProtocol != "https" && gitProtocol != "ssh" {
+			log.Fatalf("Parameter --git-protocol should be https or ssh")
 		}
 	}
 
-	environmentRootFolder := "."
+	if cliOpts["--keep-cache-versions"] != nil {
+		opts.keepCacheVersions, err = strconv.Atoi(cliOpts["--keep-cache-versions"].(string))
+		if err != nil || opts.keepCacheVersions < 1 {
+			log.Fatalf("Parameter --keep-cache-versions should be a strictly positive integer")
+		}
+	}
+
+	if cliOpts["--puppet-version"] != nil {
+		puppetVersion = cliOpts["--puppet-version"].(string)
+		if _, ok := parseSemver(puppetVersion); !ok {
+			log.Fatalf("Parameter --puppet-version should be a version, 6.4.2 for example")
+		}
+	}
+
+	if cliOpts["--retry-budget"] != nil {
+		n, err := strconv.Atoi(cliOpts["--retry-budget"].(string))
+		if err != nil || n < 0 {
+			log.Fatalf("Parameter --retry-budget should be a non-negative integer")
+		}
+		retryBudget = int64(n)
+	}
+
+	if cliOpts["--refresh"] != nil {
+		for _, name := range strings.Split(cliOpts["--refresh"].(string), ",") {
+			refreshModules[normalizeModuleName(strings.TrimSpace(name))] = true
+		}
+	}
+
+	requirePinned = cliOpts["--require-pinned"] == true
+	checkInodes = cliOpts["--check-inodes"] == true
+	updateInPlace = cliOpts["--update-in-place"] == true
+
+	if pins, ok := cliOpts["--pin"].([]string); ok {
+		for _, pin := range pins {
+			parts := strings.SplitN(pin, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+				log.Fatalf("Parameter --pin should be a module and a version, like puppetlabs/stdlib=4.25.1")
+			}
+			pinnedVersions[normalizeModuleName(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if cliOpts["--modules-from"] != nil {
+		// Modules not selected would be purged
+		if opts.purge {
+			log.Fatalf("--modules-from can not be used with --purge")
+		}
+		if selectedModules, err = readModuleList(cliOpts["--modules-from"].(string)); err != nil {
+			log.Fatalf("failed reading modules to install: %v", err)
+		}
+	}
+
+	if cliOpts["--chown"] != nil {
+		setOwner(cliOpts["--chown"].(string))
+	}
+
+	// Temporary files of r10k-go, and of the commands it runs, are
+	// created in TMPDIR
+	if cliOpts["--tmpdir"] != nil {
+		dir := cliOpts["--tmpdir"].(string)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			log.Fatalf("Parameter --tmpdir should be an existing folder")
+		}
+		os.Setenv("TMPDIR", dir)
+	}
+
+	if cliOpts["--dir-mode"] != nil {
+		setMode(&dirMode, cliOpts["--dir-mode"].(string), "--dir-mode")
+	}
+	if cliOpts["--file-mode"] != nil {
+		setMode(&fileMode, cliOpts["--file-mode"].(string), "--file-mode")
+	}
+
+	if cliOpts["--target-os"] != nil {
+		targetOS = cliOpts["--target-os"].(string)
+	}
+
+	if cliOpts["--not-found-ttl"] != nil {
+		seconds, err := strconv.Atoi(cliOpts["--not-found-ttl"].(string))
+		if err != nil || seconds < 0 {
+			log.Fatalf("Parameter --not-found-ttl should be a non-negative number of seconds")
+		}
+		notFoundTTL = time.Duration(seconds) * time.Second
+	}
+
+	for flag, timeout := range map[string]*time.Duration{"--connect-timeout": &connectTimeout, "--read-timeout": &readTimeout} {
+		if cliOpts[flag] == nil {
+			continue
+		}
+		seconds, err := strconv.Atoi(cliOpts[flag].(string))
+		if err != nil || seconds < 1 {
+			log.Fatalf("Parameter %s should be a strictly positive number of seconds", flag)
+		}
+		*timeout = time.Duration(seconds) * time.Second
+	}
+	httpClient = newHTTPClient()
+
+	if cliOpts["--max-load"] != nil {
+		if maxLoad, err = strconv.ParseFloat(cliOpts["--max-load"].(string), 64); err != nil || maxLoad <= 0 {
+			log.Fatalf("Parameter --max-load should be a positive number")
+		}
+	}
+
+	if cliOpts["--max-archive-size"] != nil {
+		if maxArchiveSize, err = parseSize(cliOpts["--max-archive-size"].(string)); err != nil {
+			log.Fatalf("Parameter --max-archive-size should be a number of bytes, optionally followed by K, M or G")
+		}
+	}
+
+	if cliOpts["--max-extract-size"] != nil {
+		if maxExtractedSize, err = parseSize(cliOpts["--max-extract-size"].(string)); err != nil {
+			log.Fatalf("Parameter --max-extract-size should be a number of bytes, optionally followed by K, M or G")
+		}
+	}
+
+	if cliOpts["--git-binary"] != nil {
+		gitBinary = cliOpts["--git-binary"].(string)
+		if err := checkGit(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The GIT_SSH_COMMAND of the user is kept unless options are given
+	hostKeys := cliOpts["--ssh-host-keys"].(string)
+	knownHosts := ""
+	if cliOpts["--ssh-known-hosts"] != nil {
+		knownHosts = cliOpts["--ssh-known-hosts"].(string)
+	}
+	explicit := hostKeys != hostKeyAcceptNew || knownHosts != ""
+	if err := setupGitSSH(hostKeys, knownHosts, "", explicit); err != nil {
+		log.Fatalf("Parameter --ssh-host-keys: %v", err)
+	}
+
+	traceEnabled = cliOpts["--trace"] == true
+	fsyncEnabled = cliOpts["--fsync"] == true
+	parallelExtract = cliOpts["--parallel-extract"] == true
+	compareContent = cliOpts["--compare-content"] == true
+	allowPrerelease = cliOpts["--allow-prerelease"] == true
+	strictWarnings := cliOpts["--strict-warnings"] == true
+	showStats := cliOpts["--stats"] == true
 	cacheDir := ".cache"
+	if cliOpts["--cachedir"] != nil {
+		cacheDir = cliOpts["--cachedir"].(string)
+	}
+
+	if cliOpts["--log-dir"] != nil {
+		logDir = cliOpts["--log-dir"].(string)
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			log.Fatalf("failed creating the log folder %s: %v", logDir, err)
+		}
+	}
+
+	// Metrics of the run, written with --metrics-file
+	metricsFile := ""
+	if cliOpts["--metrics-file"] != nil {
+		metricsFile = cliOpts["--metrics-file"].(string)
+	}
+
+	// Record of the modules deployed, written with --manifest
+	var deployment manifest
+	manifestFile := ""
+	if cliOpts["--manifest"] != nil {
+		manifestFile = cliOpts["--manifest"].(string)
+	}
+
+	// The status server is stopped once modules are installed
+	stopStatus := func() {}
+	if cliOpts["--status-addr"] != nil {
+		l, err := serveStatus(cliOpts["--status-addr"].(string))
+		if err != nil {
+			log.Fatalf("failed serving the status on %s: %v", cliOpts["--status-addr"], err)
+		}
+		stopStatus = func() { l.Close() }
+	}
+
+	if cliOpts["deploy"] == true && cliOpts["--cache-only"] == true {
+		log.Fatalf("--cache-only can not be used with deploy, which checks out the environment")
+	}
 
 	if cliOpts["deploy"] == true {
 		r10kFile := "r10k.yml"
@@ -178,68 +878,362 @@ func main() {
 			log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
 		}
 
-		for _, source := range r10kConfig.Sources {
+		if r10kConfig.Deploy.WriteLock != "" {
+			log.Fatalf("deployments are locked: %s", r10kConfig.Deploy.WriteLock)
+		}
+
+		verifySignature := cliOpts["--verify-signature"] == true
+		keyring := ""
+		if verifySignature {
+			if cliOpts["--keyring"] == nil {
+				log.Fatalf("--verify-signature requires the keyring of allowed signers to be set with --keyring")
+			}
+			keyring = cliOpts["--keyring"].(string)
+		}
+
+		if r10kConfig.Deploy.Chown != "" && cliOpts["--chown"] == nil {
+			setOwner(r10kConfig.Deploy.Chown)
+		}
+		if r10kConfig.Deploy.DirMode != "" && cliOpts["--dir-mode"] == nil {
+			setMode(&dirMode, r10kConfig.Deploy.DirMode, "dir_mode")
+		}
+		if r10kConfig.Deploy.FileMode != "" && cliOpts["--file-mode"] == nil {
+			setMode(&fileMode, r10kConfig.Deploy.FileMode, "file_mode")
+		}
+
+		applyR10kConfig(r10kConfig, cliOpts, &opts, &cacheDir, hostKeys, knownHosts)
+		opts.excludeSpec = r10kConfig.Deploy.ExcludeSpec
+
+		if cache, err = NewCache(cacheDir); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := checkGit(); err != nil {
+			log.Fatal(err)
+		}
+
+		sources := r10kConfig.Sources
+		if cliOpts["--source"] != nil {
+			name := cliOpts["--source"].(string)
+			s, ok := r10kConfig.Sources[name]
+			if !ok {
+				log.Fatalf("source %s is not defined in %s", name, r10kFile)
+			}
+			sources = map[string]source{name: s}
+		}
+
+		refType := cliOpts["--ref-type"].(string)
+		switch refType {
+		case refAuto, refBranch, refTag, refCommit:
+		default:
+			log.Fatalf("Parameter --ref-type should be one of auto, branch, tag or commit")
+		}
+
+		if r10kConfig.Deploy.EnvNameReplacement != "" {
+			environmentNameReplacement = r10kConfig.Deploy.EnvNameReplacement
+		}
+
+		envDepth = r10kConfig.Deploy.EnvDepth
+		if cliOpts["--env-depth"] != nil {
+			if envDepth, err = strconv.Atoi(cliOpts["--env-depth"].(string)); err != nil || envDepth < 1 {
+				log.Fatalf("Parameter --env-depth should be a strictly positive integer")
+			}
+		}
+
+		// With --only, unchanged environments are skipped
+		only := cliOpts["--only"] == true
+
+		nErr := 0
+		for sourceName, source := range sources {
 			envName := cliOpts["<env>"].(string)
-			environmentRootFolder = path.Join(source.Basedir, envName)
-			cmd := exec.Command("git", "clone", "-b", envName, source.Remote, environmentRootFolder)
-			if err := cmd.Run(); err != nil {
-				log.Fatalf("failed downloading environment: %v", err)
+			remote := convertGitProtocol(source.Remote)
+
+			envRefType := refType
+			if envRefType == refAuto {
+				if envRefType, err = resolveRefType(remote, envName); err != nil {
+					if !opts.keepGoing {
+						log.Fatalf("failed downloading environment: %v", err)
+					}
+					log.Printf("skipping source %s: failed downloading environment: %v\n", sourceName, err)
+					nErr++
+					continue
+				}
+			}
+
+			dirName := environmentDirName(envName)
+			environmentRootFolder := path.Join(source.Basedir, dirName)
+			if dirName != envName {
+				log.Printf("deploying environment %s to %s\n", envName, dirName)
+			}
+
+			// Refs deployed to the same folder would replace each other
+			if deployed := deployedRef(environmentRootFolder); deployed != "" && deployed != envName {
+				if !opts.keepGoing {
+					log.Fatalf("environment %s of source %s would replace environment %s, deployed to %s", envName, sourceName, deployed, dirName)
+				}
+				log.Printf("skipping source %s: environment %s would replace environment %s, deployed to %s\n", sourceName, envName, deployed, dirName)
+				nErr++
+				continue
+			}
+			if deployed := readDeployState(environmentRootFolder); only && deployed != "" {
+				if commit, err := remoteCommit(remote, envName, envRefType); err == nil && strings.HasPrefix(deployed, commit) {
+					log.Printf("environment %s is up to date\n", envName)
+					continue
+				}
+			}
+
+			sourceCache := cache
+			if source.Cachedir != "" {
+				if sourceCache, err = NewCache(source.Cachedir); err != nil {
+					log.Fatal(err)
+				}
 			}
+
+			envOpts := opts
+			envOpts.modulePath = environmentModulePath(opts.modulePath, sourceName, dirName)
+
+			// Workers start while the environment is being fetched, the
+			// Puppetfile is only parsed once it has been checked out
+			inst := startInstaller(environmentRootFolder, &sourceCache, envOpts)
+
+			if err := updateEnvironment(remote, envName, envRefType, environmentRootFolder); err != nil {
+				if !opts.keepGoing {
+					log.Fatalf("failed downloading environment: %v", err)
+				}
+				inst.wait()
+				log.Printf("skipping source %s: failed downloading environment: %v\n", sourceName, err)
+				nErr++
+				continue
+			}
+
+			if verifySignature {
+				if err := verifyEnvironment(environmentRootFolder, envName, keyring); err != nil {
+					// Do not leave an unverified environment around for Puppet to use
+					os.RemoveAll(environmentRootFolder)
+					log.Fatalf("refusing to deploy environment %s: %v", envName, err)
+				}
+			}
+
+			var override *environmentOverride
+			if o, ok := r10kConfig.Overrides[envName]; ok {
+				override = &o
+			}
+
+			// Environments without a Puppetfile have no modules to install
+			var puppetfiles []string
+			if puppetfile := findPuppetfile(environmentRootFolder); puppetfile != "" {
+				puppetfiles = append(puppetfiles, puppetfile)
+			}
+			envErr := inst.install(puppetfiles, envName, override)
+
+			// Modules are only downloaded once, to the first basedir. A
+			// failed deployment is not mirrored, the other basedirs keep
+			// their previous copy of the environment.
+			for _, basedir := range source.Basedirs {
+				if envErr > 0 {
+					log.Printf("not deploying environment %s to %s, as it failed to deploy\n", envName, basedir)
+					continue
+				}
+				mirror := path.Join(basedir, dirName)
+				if err := linkTree(environmentRootFolder, mirror); err != nil {
+					log.Printf("failed deploying environment %s to %s: %v\n", envName, basedir, err)
+					envErr++
+					continue
+				}
+
+				// Modules of an absolute module path are outside of the
+				// environment, the other basedirs have none and get them
+				// in the modules folder of theirs
+				if path.IsAbs(envOpts.modulePath) && exists(envOpts.modulePath) {
+					if err := linkTree(envOpts.modulePath, path.Join(mirror, "modules")); err != nil {
+						log.Printf("failed deploying the modules of environment %s to %s: %v\n", envName, basedir, err)
+						envErr++
+					}
+				}
+			}
+
+			// Deploying some modules does not deploy the environment
+			if only && envErr == 0 && selectedModules == nil {
+				if err := writeDeployState(environmentRootFolder); err != nil {
+					warnf("failed recording the deployment of %s: %v\n", envName, err)
+				}
+			}
+
+			if manifestFile != "" {
+				commit, err := headCommit(environmentRootFolder)
+				if err != nil {
+					warnf("failed getting the commit of %s: %v\n", envName, err)
+				}
+				deployment.Environments = append(deployment.Environments, manifestEnvironment{
+					Name: envName, Source: sourceName, Commit: commit, Modules: manifestModules(inst.managed),
+				})
+			}
+			nErr += envErr
+		}
+
+		// The cache is pruned once all environments are deployed,
+		// keeping the archives any of them uses
+		if opts.keepCacheVersions > 0 && nErr == 0 {
+			usedArchives.prune(opts.keepCacheVersions)
+		}
+		if manifestFile != "" {
+			nErr += saveManifest(manifestFile, deployment, nErr)
 		}
+		stopStatus()
+		if showStats {
+			stats.print(time.Since(start))
+		}
+		if metricsFile != "" {
+			nErr += saveMetrics(metricsFile, cliOpts["<env>"].(string), time.Since(start), nErr)
+		}
+		os.Exit(exitCode(nErr, strictWarnings))
+	}
 
-		if r10kConfig.Cachedir != "" {
-			cacheDir = r10kConfig.Cachedir
+	if cliOpts["clean"] == true {
+		modulePath := "modules"
+		if opts.modulePath != "" {
+			modulePath = opts.modulePath
 		}
+
+		os.Exit(exitCode(cleanOrphans(modulePath), strictWarnings))
 	}
 
-	if cache, err = NewCache(cacheDir); err != nil {
-		log.Fatal(err)
+	if cliOpts["validate"] == true {
+		puppetfiles := []string{"Puppetfile"}
+		if cliOpts["--puppetfile"] != nil {
+			puppetfiles = []string{cliOpts["--puppetfile"].(string)}
+		}
+		if cliOpts["--puppetfile-dir"] != nil {
+			if puppetfiles, err = findPuppetfiles(cliOpts["--puppetfile-dir"].(string)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := validatePuppetfiles(puppetfiles); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(exitCode(0, strictWarnings))
 	}
 
-	if cliOpts["install"] == true || cliOpts["deploy"] == true {
-		// TODO: This needs to run for all sources that have a Puppetfile
-		puppetfile := ""
+	if cliOpts["check"] == true {
+		puppetfiles := []string{"Puppetfile"}
+		if cliOpts["--puppetfile"] != nil {
+			puppetfiles = []string{cliOpts["--puppetfile"].(string)}
+		}
+		if cliOpts["--puppetfile-dir"] != nil {
+			if puppetfiles, err = findPuppetfiles(cliOpts["--puppetfile-dir"].(string)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		nErr := checkModules(os.Stdout, puppetfiles, opts.numWorkers)
+		if nErr > 0 {
+			log.Printf("%d source(s) could not be reached\n", nErr)
+		}
+		os.Exit(exitCode(nErr, strictWarnings))
+	}
 
-		if cliOpts["--puppetfile"] == nil {
-			puppetfile = path.Join(environmentRootFolder, "Puppetfile")
-		} else {
+	if cliOpts["dump"] == true {
+		puppetfile := "Puppetfile"
+		if cliOpts["--puppetfile"] != nil {
 			puppetfile = cliOpts["--puppetfile"].(string)
 		}
 
-		results := make(chan DownloadResult)
-		modules := make(chan PuppetModule)
-		modulesDeduplicated := make(chan PuppetModule)
+		pf := NewPuppetFile(puppetfile, "")
+		defer pf.Close()
+		modules, err := pf.load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = dumpPuppetfile(os.Stdout, modules); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cliOpts["diff"] == true {
+		var modules [2][]PuppetModule
+		for i, puppetfile := range []string{cliOpts["<old>"].(string), cliOpts["<new>"].(string)} {
+			pf := NewPuppetFile(puppetfile, "")
+			if modules[i], err = pf.load(); err != nil {
+				log.Fatal(err)
+			}
+			pf.Close()
+		}
 
-		for w := 1; w <= numWorkers; w++ {
-			go downloadModules(modulesDeduplicated, results, ".")
+		if err := printDiff(os.Stdout, diffModules(modules[0], modules[1]), cliOpts["--output"].(string)); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		var wg sync.WaitGroup
-		moduleFiles := make(chan moduleFile)
+	// install --cache-only downloads modules to the cache, without
+	// extracting them, like prefetch. Modules are downloaded as deploy
+	// would, with the settings of r10k.yml if there is one.
+	if cliOpts["prefetch"] == true || (cliOpts["install"] == true && cliOpts["--cache-only"] == true) {
+		if _, err := os.Stat("r10k.yml"); err == nil || hasConfigEnv(os.Environ()) {
+			r10kConfig, err := NewR10kConfig("r10k.yml")
+			if err != nil {
+				log.Fatalf("Error parsing r10k configuration file r10k.yml: %v", err)
+			}
+			applyR10kConfig(r10kConfig, cliOpts, &opts, &cacheDir, hostKeys, knownHosts)
+		}
 
-		done := make(chan bool)
-		errorCount := make(chan int)
+		if cache, err = NewCache(cacheDir); err != nil {
+			log.Fatal(err)
+		}
 
-		go processModuleFiles(moduleFiles, modules, &wg, done)
-		go deduplicate(modules, modulesDeduplicated, &cache, environmentRootFolder, done)
-		go parseResults(results, !cliOpts["--no-deps"].(bool), moduleFiles, &wg, errorCount)
+		puppetfiles := []string{"Puppetfile"}
+		if cliOpts["--puppetfile"] != nil {
+			puppetfiles = []string{cliOpts["--puppetfile"].(string)}
+		}
+		if cliOpts["--puppetfile-dir"] != nil {
+			if puppetfiles, err = findPuppetfiles(cliOpts["--puppetfile-dir"].(string)); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-		if pf := NewPuppetFile(puppetfile); pf != nil {
-			wg.Add(1)
-			moduleFiles <- pf
+		opts.cacheOnly = true
+		nErr := startInstaller(".", &cache, opts).install(puppetfiles, "", nil)
+		stopStatus()
+		if showStats {
+			stats.print(time.Since(start))
 		}
+		if metricsFile != "" {
+			nErr += saveMetrics(metricsFile, "", time.Since(start), nErr)
+		}
+		os.Exit(exitCode(nErr, strictWarnings))
+	}
 
-		wg.Wait()
-		close(modules)
-		close(modulesDeduplicated)
-		close(moduleFiles)
-		close(results)
+	if cliOpts["install"] == true {
+		if cache, err = NewCache(cacheDir); err != nil {
+			log.Fatal(err)
+		}
 
-		<-done
-		<-done
-		nErr := <-errorCount
-		close(errorCount)
+		puppetfiles := []string{"Puppetfile"}
+		if cliOpts["--puppetfile"] != nil {
+			puppetfiles = []string{cliOpts["--puppetfile"].(string)}
+		}
+		if cliOpts["--puppetfile-dir"] != nil {
+			if puppetfiles, err = findPuppetfiles(cliOpts["--puppetfile-dir"].(string)); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-		os.Exit(nErr)
+		inst := startInstaller(".", &cache, opts)
+		nErr := inst.install(puppetfiles, "", nil)
+		if opts.keepCacheVersions > 0 && nErr == 0 {
+			usedArchives.prune(opts.keepCacheVersions)
+		}
+		if manifestFile != "" {
+			deployment.Environments = []manifestEnvironment{{Modules: manifestModules(inst.managed)}}
+			nErr += saveManifest(manifestFile, deployment, nErr)
+		}
+		stopStatus()
+		if showStats {
+			stats.print(time.Since(start))
+		}
+		if metricsFile != "" {
+			nErr += saveMetrics(metricsFile, "", time.Since(start), nErr)
+		}
+		os.Exit(exitCode(nErr, strictWarnings))
 	}
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// forgeArchive returns the Forge archive of a module depending on deps
+func forgeArchive(t *testing.T, name string, deps []string) []byte {
+	meta := Metadata{Name: name}
+	for _, d := range deps {
+		meta.Dependencies = append(meta.Dependencies, metadataDependency{Name: d, Version_requirement: ">= 1.0.0"})
+	}
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := strings.Replace(name, "/", "-", -1) + "-1.0.0/"
+	files := []string{root, root + "manifests/", root + "manifests/init.pp", root + "metadata.json"}
+	contents := map[string][]byte{root + "manifests/init.pp": []byte("class {}"), root + "metadata.json": metadata}
+
+	return tarballContents(t, files, contents).Bytes()
+}
+
+// TestInstallDependencyTree installs a module with a tree of dependencies
+// several levels deep from a fake Forge
+func TestInstallDependencyTree(t *testing.T) {
+	const depth, width = 4, 3
+
+	// acme/l0n0 depends on acme/l1n0...acme/l1n2, each of which
+	// depends on 3 modules of the next level...
+	deps := make(map[string][]string)
+	total := 0
+	for level, n := 0, 1; level < depth; level, n = level+1, n*width {
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("acme/l%dn%d", level, i)
+			total++
+			if level == depth-1 {
+				continue
+			}
+			for j := 0; j < width; j++ {
+				deps[name] = append(deps[name], fmt.Sprintf("acme/l%dn%d", level+1, i*width+j))
+			}
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v3/releases"):
+			name := r.URL.Query().Get("module")
+			fmt.Fprintf(w, `{"results": [{"version": "1.0.0", "file_uri": "/files/%s.tar.gz"}]}`, name)
+		case strings.HasPrefix(r.URL.Path, "/files/"):
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/files/"), ".tar.gz")
+			w.Write(forgeArchive(t, name, deps[name]))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	defer func(rewrites []urlRewrite) { urlRewrites = rewrites }(urlRewrites)
+	urlRewrites = []urlRewrite{{Match: `^https://forgeapi\.puppetlabs\.com:443/+`, Replace: ts.URL + "/"}}
+	if err := urlRewrites[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	puppetfile := path.Join(dir, "Puppetfile")
+	if err := ioutil.WriteFile(puppetfile, []byte("mod 'acme/l0n0'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dependencies are resolved from the cache when prefetching
+	opts := installOptions{numWorkers: 4, depWorkers: 4, resultBuffer: 4, downloadDeps: true, cacheOnly: true}
+	if nErr := installModules([]string{puppetfile}, dir, "", nil, &cache, opts); nErr != 0 {
+		t.Fatalf("%d error(s) prefetching the dependency tree", nErr)
+	}
+	if _, err := os.Stat(path.Join(dir, "modules")); err == nil {
+		t.Errorf("expected no module to be installed when prefetching")
+	}
+	if cached, err := ioutil.ReadDir(cache.folder); err != nil || len(cached) != total {
+		t.Errorf("expected %d modules to be prefetched, got %d (%v)", total, len(cached), err)
+	}
+
+	opts.cacheOnly = false
+	if nErr := installModules([]string{puppetfile}, dir, "", nil, &cache, opts); nErr != 0 {
+		t.Fatalf("%d error(s) installing the dependency tree", nErr)
+	}
+
+	folders, err := ioutil.ReadDir(path.Join(dir, "modules"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != total {
+		t.Errorf("expected %d modules to be installed, got %d", total, len(folders))
+	}
+}
+
+// TestInstallTargetOS installs modules without their dependencies, those
+// not supporting --target-os must not be installed nor managed
+func TestInstallTargetOS(t *testing.T) {
+	defer func(target string) { targetOS = target }(targetOS)
+	targetOS = "RedHat-8"
+
+	supported := map[string]string{"acme/linux": "RedHat", "acme/windows": "windows"}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v3/releases"):
+			name := r.URL.Query().Get("module")
+			fmt.Fprintf(w, `{"results": [{"version": "1.0.0", "file_uri": "/files/%s.tar.gz"}]}`, name)
+		case strings.HasPrefix(r.URL.Path, "/files/"):
+			name := strings.Replace(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/files/"), ".tar.gz"), "-", "/", 1)
+			metadata := fmt.Sprintf(`{"name": "%s", "operatingsystem_support": [{"operatingsystem": "%s"}]}`, name, supported[name])
+
+			w.Write(tarballContents(t, []string{"module/metadata.json"}, map[string][]byte{"module/metadata.json": []byte(metadata)}).Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	defer func(rewrites []urlRewrite) { urlRewrites = rewrites }(urlRewrites)
+	urlRewrites = []urlRewrite{{Match: `^https://forgeapi\.puppetlabs\.com:443/+`, Replace: ts.URL + "/"}}
+	if err := urlRewrites[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	puppetfile := path.Join(dir, "Puppetfile")
+	if err := ioutil.WriteFile(puppetfile, []byte("mod 'acme/linux'\nmod 'acme/windows'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Installed before --target-os was given
+	if err := os.MkdirAll(path.Join(dir, "modules", "windows"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := startInstaller(dir, &cache, installOptions{numWorkers: 2, depWorkers: 1, resultBuffer: 2})
+	if nErr := inst.install([]string{puppetfile}, "", nil); nErr != 0 {
+		t.Fatalf("%d error(s) installing the modules", nErr)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "modules", "linux", "metadata.json")); err != nil {
+		t.Errorf("expected acme/linux to be installed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "modules", "windows")); err == nil {
+		t.Errorf("expected acme/windows not to be installed")
+	}
+	if _, ok := inst.managed[path.Join(dir, "modules", "windows")]; ok || len(inst.managed) != 1 {
+		t.Errorf("expected only acme/linux to be managed, got %v", inst.managed)
+	}
+}
+
+func TestDeduplicateConflicts(t *testing.T) {
+	testCases := []struct {
+		modules          []PuppetModule
+		expectedWarnings int
+	}{
+		{
+			modules: []PuppetModule{
+				&GitModule{baseModule: baseModule{name: "acme/apache"}, repoURL: "https://example.com/apache.git"},
+				&ForgeModule{baseModule: baseModule{name: "puppetlabs/apache"}, version: "5.0.0"},
+			},
+			expectedWarnings: 1,
+		}, {
+			// Dependencies can be satisfied by modules from any source
+			modules: []PuppetModule{
+				&GitModule{baseModule: baseModule{name: "puppetlabs/apache"}, repoURL: "https://example.com/apache.git"},
+				&ForgeModule{baseModule: baseModule{name: "puppetlabs/apache", dependency: true}},
+			},
+			expectedWarnings: 0,
+		}, {
+			modules: []PuppetModule{
+				&ForgeModule{baseModule: baseModule{name: "puppetlabs/apache"}, version: "5.0.0"},
+				&ForgeModule{baseModule: baseModule{name: "puppetlabs-apache"}, version: "5.0.0"},
+			},
+			expectedWarnings: 0,
+		},
+	}
+
+	for i, c := range testCases {
+		in, out, done := make(chan PuppetModule), make(chan PuppetModule, len(c.modules)), make(chan bool, 1)
+		go deduplicate(in, out, &Cache{folder: ".cache"}, ".", "", "", make(map[string]PuppetModule), done)
+
+		before := warnings()
+		for _, m := range c.modules {
+			m.(interface{ setProcessed(func()) }).setProcessed(func() {})
+			in <- m
+		}
+		close(in)
+		<-done
+
+		if len(out) != 1 {
+			t.Errorf("test %d: expected 1 module to be installed, got %d", i, len(out))
+		}
+		if actual := warnings() - before; actual != c.expectedWarnings {
+			t.Errorf("test %d: expected %d warning(s), got %d", i, c.expectedWarnings, actual)
+		}
+	}
+}
+
+func TestDeduplicateStaging(t *testing.T) {
+	modules := []PuppetModule{
+		&ForgeModule{baseModule: baseModule{name: "puppetlabs/apache", installPath: "/srv/modules"}, version: "5.0.0"},
+		&ForgeModule{baseModule: baseModule{name: "puppetlabs/stdlib", dependency: true}},
+		&ForgeModule{baseModule: baseModule{name: "puppetlabs-apache", dependency: true}},
+	}
+
+	in, out, done := make(chan PuppetModule), make(chan PuppetModule, len(modules)), make(chan bool, 1)
+	managed := make(map[string]PuppetModule)
+	go deduplicate(in, out, &Cache{folder: ".cache"}, "env", "", "/tmp/staging", managed, done)
+
+	for _, m := range modules {
+		m.(interface{ setProcessed(func()) }).setProcessed(func() {})
+		in <- m
+	}
+	close(in)
+	<-done
+	close(out)
+
+	var folders []string
+	for m := range out {
+		folders = append(folders, m.TargetFolder())
+	}
+
+	// Modules of the Puppetfile are staged, and are not installed again
+	// as dependencies
+	if expected := []string{"/tmp/staging/apache", "env/modules/stdlib"}; !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected modules to be installed to %v, got %v", expected, folders)
+	}
+	if _, ok := managed["env/modules/stdlib"]; len(managed) != 1 || !ok {
+		t.Errorf("expected only stdlib to be managed, got %v", managed)
+	}
+}
+
+// TestWaitRemovesStaging stops an installer with nothing installed, like
+// deploy --keep-going does when the environment fails to download
+func TestWaitRemovesStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := startInstaller(dir, &cache, installOptions{numWorkers: 1, depWorkers: 1, onlyDeps: true})
+	if inst.staging == "" {
+		t.Fatal("expected a staging folder with --only-deps")
+	}
+	if nErr := inst.wait(); nErr != 0 {
+		t.Errorf("expected no error, got %d", nErr)
+	}
+	if _, err := os.Stat(inst.staging); !os.IsNotExist(err) {
+		t.Errorf("expected the staging folder %s to be removed", inst.staging)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestModule is the exact source a module was installed from
+type manifestModule struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Source  string `json:"source"`
+	Version string `json:"version,omitempty"`
+	Commit  string `json:"commit,omitempty"` // Git modules and GitHub archives
+	SHA256  string `json:"sha256,omitempty"` // Checksum of the archive of other modules
+	Path    string `json:"path"`
+}
+
+type manifestEnvironment struct {
+	Name    string           `json:"name,omitempty"`
+	Source  string           `json:"source,omitempty"`
+	Commit  string           `json:"commit,omitempty"` // Commit of the control repository
+	Modules []manifestModule `json:"modules"`
+}
+
+// manifest records what was deployed by a run, written with --manifest
+type manifest struct {
+	Deployed     time.Time             `json:"deployed"`
+	Environments []manifestEnvironment `json:"environments"`
+}
+
+// archived is implemented by modules installed from an archive in the cache
+type archived interface {
+	archive() string
+}
+
+// archiveSource is where an archive of the cache was downloaded from,
+// recorded next to it
+type archiveSource struct {
+	URL    string `json:"url"`
+	Commit string `json:"commit,omitempty"`
+}
+
+// sourceFile returns the path of the file the source of archive is
+// recorded in
+func sourceFile(archive string) string {
+	return archive + ".source"
+}
+
+// recordSource records that archive was downloaded from url, with the
+// commit it was generated from for archives of git repositories
+func recordSource(archive string, url string) {
+	b, err := json.Marshal(archiveSource{URL: url, Commit: archiveCommit(archive)})
+	if err == nil {
+		err = ioutil.WriteFile(sourceFile(archive), b, 0644)
+	}
+	if err != nil {
+		warnf("failed recording the source of %s: %v\n", archive, err)
+	}
+}
+
+// readSource returns the source recorded for archive, false if it was
+// downloaded before sources were recorded
+func readSource(archive string) (archiveSource, bool) {
+	var src archiveSource
+
+	b, err := ioutil.ReadFile(sourceFile(archive))
+	if err != nil || json.Unmarshal(b, &src) != nil || src.URL == "" {
+		return src, false
+	}
+
+	return src, true
+}
+
+// installedVersion returns the version of the module, as recorded when
+// it was installed if it was not pinned
+func installedVersion(m PuppetModule) string {
+	if m.Version() != "" {
+		return m.Version()
+	}
+
+	version, err := ioutil.ReadFile(path.Join(m.TargetFolder(), ".version"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(version))
+}
+
+func fileSHA256(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// manifestModules describes the installed modules, by folder, sorted by
+// folder
+func manifestModules(installed map[string]PuppetModule) []manifestModule {
+	folders := make([]string, 0, len(installed))
+	for folder := range installed {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+
+	modules := make([]manifestModule, 0, len(installed))
+	for _, folder := range folders {
+		m := installed[folder]
+		mm := manifestModule{Name: m.Name(), Path: folder}
+
+		switch m := m.(type) {
+		case *ForgeModule:
+			mm.Type, mm.Version = "forge", installedVersion(m)
+			mirror := m.mirror
+			if mirror == "" {
+				mirror = forgeURLs[0]
+			}
+			mm.Source = rewriteURL(mirror + "v3/files/" + normalizeModuleName(m.Name()) + "-" + mm.Version + ".tar.gz")
+		case *GithubTarballModule:
+			mm.Type, mm.Version, mm.Source = "github_tarball", installedVersion(m), "https://github.com/"+m.repoName
+			if m.branch != "" {
+				mm.Version = m.branch
+			}
+		case *TarballModule:
+			mm.Type, mm.Version, mm.Source = "tarball", installedVersion(m), rewriteURL(m.url)
+		case *GitModule:
+			mm.Type, mm.Version, mm.Source = "git", m.Version(), convertGitProtocol(rewriteURL(m.repoURL))
+			if commit, err := m.currentCommit(); err == nil {
+				mm.Commit = commit
+			}
+		}
+
+		if a, ok := m.(archived); ok {
+			mm.SHA256 = fileSHA256(a.archive())
+			// The archive may have come from a mirror
+			if src, ok := readSource(a.archive()); ok {
+				mm.Source, mm.Commit = src.URL, src.Commit
+			}
+		}
+
+		modules = append(modules, mm)
+	}
+
+	return modules
+}
+
+// saveManifest writes the manifest of a run with nErr errors to file.
+// Failed runs have no manifest, as it records what was deployed.
+// Returns the number of errors.
+func saveManifest(file string, m manifest, nErr int) int {
+	if nErr > 0 {
+		log.Printf("not writing manifest %s, as the run failed\n", file)
+		return 0
+	}
+
+	m.Deployed = time.Now().UTC()
+	if err := writeManifest(file, m); err != nil {
+		log.Printf("failed writing manifest %s: %v\n", file, err)
+		return 1
+	}
+
+	return 0
+}
+
+// writeManifest writes the manifest to file as JSON. The file is
+// replaced atomically, so that it is never found half written.
+func writeManifest(file string, m manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(file+".part", append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".part", file)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifestModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &TarballModule{
+		baseModule: baseModule{name: "acme/foo", envRoot: dir, cacheFolder: dir},
+		url:        "https://example.com/foo-1.0.0.tar.gz",
+		version:    "1.0.0",
+	}
+	if err := ioutil.WriteFile(m.archive(), []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modules := manifestModules(map[string]PuppetModule{m.TargetFolder(): m})
+	expected := manifestModule{
+		Name:    "acme/foo",
+		Type:    "tarball",
+		Source:  "https://example.com/foo-1.0.0.tar.gz",
+		Version: "1.0.0",
+		SHA256:  "0eb3e36bfb24dcd9bb1d1bece1531216b59539a8fde17ee80224af0653c92aa3",
+		Path:    m.TargetFolder(),
+	}
+	if len(modules) != 1 || modules[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, modules)
+	}
+
+	file := path.Join(dir, "manifest.json")
+	if nErr := saveManifest(file, manifest{Environments: []manifestEnvironment{{Name: "production", Modules: modules}}}, 0); nErr != 0 {
+		t.Fatalf("failed writing manifest %s", file)
+	}
+
+	var written manifest
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatalf("failed parsing manifest: %v", err)
+	}
+	if len(written.Environments) != 1 || written.Environments[0].Modules[0] != expected || written.Deployed.IsZero() {
+		t.Errorf("unexpected manifest written: %s", b)
+	}
+
+	os.Remove(file)
+	saveManifest(file, manifest{}, 1)
+	if _, err := os.Stat(file); err == nil {
+		t.Errorf("expected no manifest to be written for a failed run")
+	}
+}
+
+func TestManifestSources(t *testing.T) {
+	commit := "0a1b2c3d4e5f60718293a4b5c6d7e8f901234567"
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	// As written by git archive
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": commit}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "foo-main/", Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gzw.Close()
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer mirror.Close()
+
+	defer func(mirrors []string) { githubArchiveMirrors = mirrors }(githubArchiveMirrors)
+	githubArchiveMirrors = []string{mirror.URL}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &GithubTarballModule{baseModule: baseModule{name: "acme/foo", envRoot: dir, cacheFolder: dir}, repoName: "acme/foo", branch: "main"}
+	if err := m.downloadArchive(primary.URL + "/acme/foo/archive/refs/heads/main.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	modules := manifestModules(map[string]PuppetModule{m.TargetFolder(): m})
+	source := mirror.URL + "/acme/foo/archive/refs/heads/main.tar.gz"
+	if len(modules) != 1 || modules[0].Source != source || modules[0].Commit != commit || modules[0].Version != "main" {
+		t.Errorf("expected branch main at %s from %s, got %+v", commit, source, modules)
+	}
+
+	removeArchive(m.archive())
+	if _, err := os.Stat(sourceFile(m.archive())); err == nil {
+		t.Errorf("expected the source of removed archives to be removed")
+	}
+}
@@ -3,21 +3,153 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 )
 
 type Metadata struct {
 	Name         string
-	Dependencies []struct {
+	Dependencies []metadataDependency
+	Requirements []struct {
 		Name                string
 		Version_requirement string
 	}
+	Operatingsystem_support []struct {
+		Operatingsystem        string
+		Operatingsystemrelease []string
+	}
+}
+
+// metadataDependency is a dependency of a module. Besides Forge modules,
+// dependencies can be git repositories with the non standard git field,
+// and ref, tag or branch: {"name": "acme/foo", "git": "https://...", "tag": "v1.0.0"}
+type metadataDependency struct {
+	Name                string `json:"name"`
+	Version_requirement string `json:"version_requirement,omitempty"`
+	Git                 string `json:"git,omitempty"`
+	Ref                 string `json:"ref,omitempty"`
+	Tag                 string `json:"tag,omitempty"`
+	Branch              string `json:"branch,omitempty"`
+
+	// Why the dependency can not be installed, if it is in an unknown
+	// format. It is then skipped.
+	unknown string
+}
+
+// UnmarshalJSON decodes a dependency, dependencies in an unknown format
+// are not an error but recorded as unknown, so that others are installed
+func (d *metadataDependency) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		d.unknown = "not an object: " + string(b)
+		return nil
+	}
+
+	values := map[string]*string{"name": &d.Name, "version_requirement": &d.Version_requirement, "git": &d.Git, "ref": &d.Ref, "tag": &d.Tag, "branch": &d.Branch}
+	for key, raw := range fields {
+		value, ok := values[strings.ToLower(key)]
+		if !ok {
+			d.unknown = "unknown field " + key
+			return nil
+		}
+		if err := json.Unmarshal(raw, value); err != nil {
+			d.unknown = fmt.Sprintf("field %s is not a string", key)
+			return nil
+		}
+	}
+
+	if d.Name == "" {
+		d.unknown = "no name"
+	}
+
+	return nil
+}
+
+// Version of Puppet modules are checked against with --puppet-version
+var puppetVersion string
+
+// checkPuppetVersion warns if the module does not support the Puppet
+// version modules are deployed for
+func (meta *Metadata) checkPuppetVersion() {
+	v, ok := parseSemver(puppetVersion)
+	if !ok {
+		return
+	}
+
+	for _, req := range meta.Requirements {
+		if req.Name != "puppet" {
+			continue
+		}
+
+		supported, err := v.satisfies(req.Version_requirement)
+		if err != nil {
+			warnf("module %s: %v\n", meta.Name, err)
+		} else if !supported {
+			warnf("module %s requires Puppet %s, which does not include %s\n", meta.Name, req.Version_requirement, puppetVersion)
+		}
+	}
+}
+
+// Operating system modules are deployed for with --target-os, for
+// example RedHat or RedHat-8. Modules are not checked if empty.
+var targetOS string
+
+// supportsOS returns true if the module supports the operating system,
+// given as name-release or name. Modules not listing the operating
+// systems they support are assumed to support all of them.
+func (meta *Metadata) supportsOS(target string) bool {
+	if len(meta.Operatingsystem_support) == 0 {
+		return true
+	}
+
+	name, release := target, ""
+	if i := strings.LastIndex(target, "-"); i > 0 {
+		name, release = target[:i], target[i+1:]
+	}
+
+	for _, supported := range meta.Operatingsystem_support {
+		if !strings.EqualFold(supported.Operatingsystem, name) {
+			continue
+		}
+
+		if release == "" || len(supported.Operatingsystemrelease) == 0 {
+			return true
+		}
+
+		// Release 8 matches 8.4, and the other way around
+		for _, r := range supported.Operatingsystemrelease {
+			if r == release || strings.HasPrefix(release, r+".") || strings.HasPrefix(r, release+".") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// supportsTargetOS returns false if the module, in the cache, lists the
+// operating systems it supports in its metadata.json and --target-os is
+// not one of them
+func supportsTargetOS(m PuppetModule) bool {
+	r, ok := m.(metadataReader)
+	if !ok {
+		return true
+	}
+
+	var meta Metadata
+	b, err := r.cachedMetadata()
+	if err != nil || json.Unmarshal(b, &meta) != nil {
+		return true
+	}
+
+	return meta.supportsOS(targetOS)
 }
 
 type MetadataFile struct {
-	*os.File
+	r        io.ReadCloser
 	wg       *sync.WaitGroup
 	filename string
 }
@@ -29,17 +161,61 @@ func NewMetadataFile(metadataFile string) *MetadataFile {
 		return nil
 	}
 
-	return &MetadataFile{File: f, filename: metadataFile, wg: &sync.WaitGroup{}}
+	return &MetadataFile{r: f, filename: metadataFile, wg: &sync.WaitGroup{}}
 }
 
 func (m *MetadataFile) moduleProcessedCallback() { m.wg.Done() }
-func (m *MetadataFile) Close()                   { m.File.Close() }
+func (m *MetadataFile) Close()                   { m.r.Close() }
 func (m *MetadataFile) Filename() string         { return m.filename }
 
+// dependency returns the module to install for a dependency, from the
+// Forge or its git repository, unless its source is overridden in
+// r10k.yml. Forge modules are installed at their latest version unless
+// pinned with --pin.
+func (m *MetadataFile) dependency(req metadataDependency) (PuppetModule, error) {
+	_, overridden := moduleOverrides[normalizeModuleName(req.Name)]
+	_, pinned := pinnedVersions[normalizeModuleName(req.Name)]
+	if overridden || pinned || req.Git != "" {
+		params := make(map[string]string)
+		for key, value := range map[string]string{"git": req.Git, "ref": req.Ref, "tag": req.Tag, "branch": req.Branch} {
+			if value != "" {
+				params[key] = value
+			}
+		}
+
+		pf := &PuppetFile{filename: m.filename}
+		dep, err := pf.newModule(req.Name, params)
+		if err != nil {
+			if req.Git != "" {
+				return nil, err
+			}
+			warnf("ignoring the override of module %s: %v\n", req.Name, err)
+		} else {
+			d := dep.(interface {
+				setProcessed(func())
+				setDependency()
+			})
+			d.setProcessed(m.moduleProcessedCallback)
+			d.setDependency()
+			return dep, nil
+		}
+	}
+
+	return &ForgeModule{
+		baseModule: baseModule{
+			name:       req.Name,
+			noCache:    refreshModules[normalizeModuleName(req.Name)],
+			dependency: true,
+			processed:  m.moduleProcessedCallback,
+		},
+	}, nil
+}
+
 func (m *MetadataFile) Process(modulesChan chan<- PuppetModule, done func()) error {
 	var meta Metadata
+	defer status.resolveDeps()
 
-	metadataFile, err := ioutil.ReadAll(m.File)
+	metadataFile, err := ioutil.ReadAll(m.r)
 	if err != nil {
 		done()
 		return fmt.Errorf("could not read JSON file %v", err)
@@ -50,14 +226,28 @@ func (m *MetadataFile) Process(modulesChan chan<- PuppetModule, done func()) err
 		return fmt.Errorf("JSON file malformed: %v", err)
 	}
 
-	for _, req := range meta.Dependencies {
+	meta.checkPuppetVersion()
+
+	var deps []PuppetModule
+	for i, req := range meta.Dependencies {
+		if req.unknown != "" {
+			warnf("skipping dependency %d of module %s, in an unknown format: %s\n", i+1, meta.Name, req.unknown)
+			continue
+		}
+		dep, err := m.dependency(req)
+		if err != nil {
+			warnf("skipping dependency %s of module %s: %v\n", req.Name, meta.Name, err)
+			continue
+		}
+		deps = append(deps, dep)
+	}
+
+	status.declare(len(deps))
+	for _, dep := range deps {
 		// modulesChan <- p.compute(&ForgeModule{name: req.Name, version_requirement: req.Version_requirement})
 		m.wg.Add(1)
 
-		modulesChan <- &ForgeModule{
-			name:      req.Name,
-			processed: m.moduleProcessedCallback,
-		}
+		modulesChan <- dep
 	}
 
 	go func() {
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestSupportsOS(t *testing.T) {
+	metadata := `{
+		"name": "puppetlabs-apache",
+		"operatingsystem_support": [
+			{"operatingsystem": "RedHat", "operatingsystemrelease": ["7", "8"]},
+			{"operatingsystem": "Debian", "operatingsystemrelease": ["10.2"]},
+			{"operatingsystem": "Windows"}
+		]
+	}`
+
+	var meta Metadata
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		t.Fatalf("failed parsing metadata: %v", err)
+	}
+
+	testCases := []struct {
+		target   string
+		expected bool
+	}{
+		{"RedHat", true},
+		{"redhat-8", true},
+		{"RedHat-8.4", true},
+		{"RedHat-6", false},
+		{"Debian-10", true},
+		{"Debian-9", false},
+		{"Windows-2019", true},
+		{"Ubuntu", false},
+	}
+
+	for _, c := range testCases {
+		if actual := meta.supportsOS(c.target); actual != c.expected {
+			t.Errorf("expected %s supporting %s to be %t", meta.Name, c.target, c.expected)
+		}
+	}
+
+	if !(&Metadata{Name: "puppetlabs-stdlib"}).supportsOS("Ubuntu") {
+		t.Errorf("expected modules without operatingsystem_support to support all systems")
+	}
+}
+
+func TestMetadataGitDependencies(t *testing.T) {
+	metadata := `{
+		"name": "acme-profile",
+		"dependencies": [
+			{"name": "puppetlabs/stdlib", "version_requirement": ">= 4.0.0"},
+			{"name": "acme/foo", "git": "https://git.example.com/foo.git", "tag": "v1.0.0"},
+			{"name": "acme/bar", "svn": "https://svn.example.com/bar"},
+			"acme/baz",
+			{"version_requirement": ">= 1.0.0"}
+		]
+	}`
+
+	var meta Metadata
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		t.Fatalf("failed parsing metadata: %v", err)
+	}
+	if len(meta.Dependencies) != 5 {
+		t.Fatalf("expected 5 dependencies, got %d", len(meta.Dependencies))
+	}
+	for i, d := range meta.Dependencies[2:] {
+		if d.unknown == "" {
+			t.Errorf("expected dependency %d to be in an unknown format", i+3)
+		}
+	}
+
+	mf := MetadataFile{wg: &sync.WaitGroup{}}
+	dep, err := mf.dependency(meta.Dependencies[0])
+	if _, ok := dep.(*ForgeModule); err != nil || !ok {
+		t.Errorf("expected puppetlabs/stdlib to be installed from the Forge, got %T (%v)", dep, err)
+	}
+
+	dep, err = mf.dependency(meta.Dependencies[1])
+	gm, ok := dep.(*GitModule)
+	if err != nil || !ok {
+		t.Fatalf("expected acme/foo to be installed from git, got %T (%v)", dep, err)
+	}
+	if gm.repoURL != "https://git.example.com/foo.git" || gm.want.tag != "v1.0.0" || !gm.isDependency() {
+		t.Errorf("failed parsing git dependency, got %+v", gm)
+	}
+}
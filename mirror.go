@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// linkTree replaces the folder dst with a copy of src. Files are hard
+// linked when possible, and copied when src and dst are on different
+// filesystems. The previous dst is kept if the copy fails, see
+// installTree.
+func linkTree(src, dst string) error {
+	return installTree(src, dst, true)
+}
+
+// installTree replaces the folder dst with a copy of src, hard linked
+// if link is true: src is copied to a temporary folder next to dst, on
+// the same filesystem. The previous dst is then renamed aside, and the
+// copy renamed to dst, so that dst is only missing between both renames
+// and is never found partially copied.
+func installTree(src, dst string, link bool) error {
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return writeError(path.Dir(dst), err)
+	}
+
+	tmp, err := ioutil.TempDir(path.Dir(dst), "."+path.Base(dst)+".r10k-tmp-")
+	if err != nil {
+		return writeError(path.Dir(dst), err)
+	}
+
+	if err := copyTree(src, tmp, link); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	old := tmp + ".old"
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		// Put the previous copy back
+		os.Rename(old, dst)
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// copyTree copies src to the folder dst, hard linking files if link
+// is true
+func copyTree(src, dst string, link bool) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		default:
+			if link && os.Link(p, target) == nil {
+				return nil
+			}
+			return copyFile(p, target, fi.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return writeError(dst, err)
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return writeError(dst, err)
+	}
+
+	return out.Close()
+}
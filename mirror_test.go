@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestInstallTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	if err := os.MkdirAll(path.Join(src, "manifests"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(src, "manifests", "init.pp"), []byte("class apache {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := path.Join(dir, "modules", "apache")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dst, "stale.pp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := installTree(src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(path.Join(dst, "manifests", "init.pp")); err != nil || string(b) != "class apache {}" {
+		t.Errorf("expected manifests/init.pp to be installed, got %q, %v", b, err)
+	}
+	if _, err := os.Stat(path.Join(dst, "stale.pp")); !os.IsNotExist(err) {
+		t.Errorf("expected stale.pp to be removed")
+	}
+
+	files, err := ioutil.ReadDir(path.Join(dir, "modules"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".r10k-tmp-") {
+			t.Errorf("temporary folder %s was not removed", f.Name())
+		}
+	}
+}
+
+func TestLinkTreeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := path.Join(dir, "dr", "production")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dst, "Puppetfile"), []byte("mod 'puppetlabs/stdlib'"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := linkTree(path.Join(dir, "missing"), dst); err == nil {
+		t.Fatal("expected linking a missing folder to fail")
+	}
+
+	if b, err := ioutil.ReadFile(path.Join(dst, "Puppetfile")); err != nil || string(b) != "mod 'puppetlabs/stdlib'" {
+		t.Errorf("expected the previous copy to be kept, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Permissions of the folders and files of modules installed from
+// archives, set with --dir-mode and --file-mode. Those of the archive
+// are kept when 0.
+var (
+	dirMode  os.FileMode
+	fileMode os.FileMode
+)
+
+// parseMode parses permissions given in octal, 0750 for example
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %s, should be octal permissions like 0750", s)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// setMode sets the permissions *mode to s, given with option
+func setMode(mode *os.FileMode, s string, option string) {
+	m, err := parseMode(s)
+	if err != nil {
+		log.Fatalf("Parameter %s: %v", option, err)
+	}
+
+	*mode = m
+}
+
+// extractedDirMode returns the permissions of folders created while
+// extracting an archive
+func extractedDirMode() os.FileMode {
+	if dirMode != 0 {
+		return dirMode
+	}
+
+	return 0755
+}
+
+// extractedFileMode returns the permissions of a file of an archive,
+// whose header has the permissions mode
+func extractedFileMode(mode os.FileMode) os.FileMode {
+	if fileMode != 0 {
+		return fileMode
+	}
+
+	return mode
+}
+
+// applyModes sets the permissions of the folders and files of folder
+// to those of --dir-mode and --file-mode, whatever the umask. Symlinks
+// are not followed.
+func applyModes(folder string) error {
+	if dirMode == 0 && fileMode == 0 {
+		return nil
+	}
+
+	return filepath.Walk(folder, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir() && dirMode != 0:
+			return os.Chmod(p, dirMode)
+		case fi.Mode().IsRegular() && fileMode != 0:
+			return os.Chmod(p, fileMode)
+		}
+
+		return nil
+	})
+}
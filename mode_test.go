@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	testCases := []struct {
+		mode     string
+		expected os.FileMode
+		err      bool
+	}{
+		{"0750", 0750, false},
+		{"640", 0640, false},
+		{"0", 0, true},
+		{"0888", 0, true},
+		{"01777", 0, true},
+		{"rwx", 0, true},
+	}
+
+	for _, c := range testCases {
+		mode, err := parseMode(c.mode)
+		if (err != nil) != c.err || mode != c.expected {
+			t.Errorf("parsing %s: expected %o (error: %t), got %o (%v)", c.mode, c.expected, c.err, mode, err)
+		}
+	}
+}
+
+func TestInstallArchiveModes(t *testing.T) {
+	defer func(d, f os.FileMode) { dirMode, fileMode = d, f }(dirMode, fileMode)
+	dirMode, fileMode = 0750, 0600
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "1.0.0.tar.gz")
+	files := []string{"apache-1.0.0/", "apache-1.0.0/metadata.json", "apache-1.0.0/manifests/", "apache-1.0.0/manifests/init.pp"}
+	if err := ioutil.WriteFile(archive, tarball(t, files).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &ForgeModule{baseModule: baseModule{name: "puppetlabs/apache"}}
+	target := path.Join(dir, "production", "apache")
+	if err := installArchive(archive, target, 1, linkFromCache(m)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"", 0750},
+		{"manifests", 0750},
+		{"metadata.json", 0600},
+		{"manifests/init.pp", 0600},
+	} {
+		fi, err := os.Stat(path.Join(target, c.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != c.mode {
+			t.Errorf("expected %s to have mode %o, got %o", path.Join(target, c.name), c.mode, fi.Mode().Perm())
+		}
+	}
+
+	// Environments deployed with other modes do not share the files
+	fileMode = 0644
+	if err := installArchive(archive, path.Join(dir, "development", "apache"), 1, linkFromCache(m)); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path.Join(target, "metadata.json")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected %s to keep its mode, %v", path.Join(target, "metadata.json"), err)
+	}
+}
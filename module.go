@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// baseModule holds the attributes shared by all types of modules
+type baseModule struct {
+	name          string
+	envRoot       string
+	modulePath    string // Folder modules are installed to, "modules" if empty
+	installPath   string
+	cacheFolder   string
+	after         string   // Module that must be installed before this one
+	ignoreMissing bool     // Do not fail if the module does not exist
+	noCache       bool     // Download the module again, even if it is in the cache
+	dependency    bool     // Required by another module, rather than declared in a Puppetfile
+	noDeps        bool     // Do not install the dependencies of the module
+	unpinned      bool     // Declared with :default or :latest, intentionally not pinned
+	postExtract   []string // Commands to run once the module is installed
+	processed     func()
+}
+
+func (m *baseModule) Name() string                 { return m.name }
+func (m *baseModule) Processed()                   { m.processed() }
+func (m *baseModule) After() string                { return m.after }
+func (m *baseModule) setAfter(s string)            { m.after = s }
+func (m *baseModule) IgnoreMissing() bool          { return m.ignoreMissing }
+func (m *baseModule) NoCache() bool                { return m.noCache }
+func (m *baseModule) NoDeps() bool                 { return m.noDeps }
+func (m *baseModule) PostExtract() []string        { return m.postExtract }
+func (m *baseModule) SetEnvRoot(s string)          { m.envRoot = s }
+func (m *baseModule) SetModulePath(s string)       { m.modulePath = s }
+func (m *baseModule) setProcessed(f func())        { m.processed = f }
+func (m *baseModule) setDependency()               { m.dependency = true }
+func (m *baseModule) isDependency() bool           { return m.dependency }
+func (m *baseModule) isUnpinned() bool             { return m.unpinned }
+func (m *baseModule) stage(folder string)          { m.installPath, m.modulePath = "", folder }
+func (m *baseModule) SetCacheFolder(folder string) { m.cacheFolder = folder }
+func (m *baseModule) CacheFolder() string          { return m.cacheFolder }
+
+func (m *baseModule) TargetFolder() string {
+	if m.envRoot == "" {
+		log.Fatal("Environment root not defined")
+	}
+
+	splitPath := strings.FieldsFunc(m.name, func(r rune) bool {
+		return r == '/' || r == '-'
+	})
+	folderName := splitPath[len(splitPath)-1]
+	if folderName == "" {
+		log.Fatal("Oups")
+	}
+
+	// Module paths can be outside of the environment, when it is read-only
+	modulePath := m.modulePath
+	if m.installPath != "" {
+		modulePath = m.installPath
+	} else if modulePath == "" {
+		modulePath = "modules"
+	}
+
+	if path.IsAbs(modulePath) {
+		return path.Join(modulePath, folderName)
+	}
+
+	return path.Join(m.envRoot, modulePath, folderName)
+}
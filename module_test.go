@@ -0,0 +1,391 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestInstallDeepInstallPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pf := PuppetFile{}
+	pm, err := pf.parseModule("mod 'acme/foo', :tarball => 'https://artifacts.example.com/foo-1.0.0.tar.gz', :version => '1.0.0', :install_path => 'site/deep/nested/modules'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := pm.(*TarballModule)
+	m.SetEnvRoot(path.Join(dir, "environment"))
+	m.SetCacheFolder(path.Join(dir, "cache"))
+
+	// The archive is already in the cache, it is not downloaded
+	if err := os.MkdirAll(m.CacheFolder(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.archive(), tarball(t, []string{"manifests/", "manifests/init.pp", "metadata.json"}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := path.Join(dir, "environment", "site", "deep", "nested", "modules", "foo")
+	if m.TargetFolder() != expected {
+		t.Fatalf("expected the module to be installed in %s, got %s", expected, m.TargetFolder())
+	}
+
+	if err := prepareTarget(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if derr := m.Download(); derr.error != nil {
+		t.Fatalf("failed installing to a deep install_path: %v", derr)
+	}
+
+	if _, err := os.Stat(path.Join(expected, "manifests", "init.pp")); err != nil {
+		t.Errorf("module was not installed: %v", err)
+	}
+}
+
+// TestPrepareTargetArchive upgrades a module installed from an archive,
+// which must remain installed until it is replaced
+func TestPrepareTargetArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &TarballModule{baseModule: baseModule{name: "acme/foo", envRoot: dir, cacheFolder: path.Join(dir, "cache")}, url: "https://artifacts.example.com/foo-2.0.0.tar.gz", version: "2.0.0"}
+	if err := os.MkdirAll(m.CacheFolder(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.archive(), tarball(t, []string{"metadata.json"}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(m.TargetFolder(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(m.TargetFolder(), "stale.pp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := prepareTarget(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(m.TargetFolder(), "stale.pp")); err != nil {
+		t.Errorf("expected the previous installation to be kept while downloading: %v", err)
+	}
+
+	if derr := m.Download(); derr.error != nil {
+		t.Fatal(derr)
+	}
+	if _, err := os.Stat(path.Join(m.TargetFolder(), "stale.pp")); !os.IsNotExist(err) {
+		t.Errorf("expected the previous installation to be replaced")
+	}
+}
+
+func TestTargetFolder(t *testing.T) {
+	testCases := []struct {
+		modulePath  string
+		installPath string
+		expected    string
+	}{
+		{"", "", "environments/production/modules/ntp"},
+		{"site-modules", "", "environments/production/site-modules/ntp"},
+		{"/var/lib/modules/production", "", "/var/lib/modules/production/ntp"},
+		{"/var/lib/modules/production", "site", "environments/production/site/ntp"},
+		{"", "/opt/modules", "/opt/modules/ntp"},
+	}
+
+	for _, c := range testCases {
+		m := &ForgeModule{baseModule: baseModule{name: "puppetlabs/ntp", envRoot: "environments/production", modulePath: c.modulePath, installPath: c.installPath}}
+		if actual := m.TargetFolder(); actual != c.expected {
+			t.Errorf("expected module to be installed to %s, got %s", c.expected, actual)
+		}
+	}
+}
+
+func TestGitModuleCommitish(t *testing.T) {
+	testCases := []struct {
+		ref, tag, branch string
+		expected         string
+	}{
+		{"ab12cd", "", "", "ab12cd"},
+		{"", "v1.0.0", "", "refs/tags/v1.0.0"},
+		{"", "", "main", "refs/remotes/origin/main"},
+		{"", "", "", "HEAD"},
+	}
+
+	for _, c := range testCases {
+		m := &GitModule{}
+		m.want.ref, m.want.tag = c.ref, c.tag
+		if actual := m.commitish(c.branch); actual != c.expected {
+			t.Errorf("expected %s to be checked out, got %s", c.expected, actual)
+		}
+	}
+}
+
+func TestGitModuleAmbiguousRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A tag and a branch named release, and a tag v1
+	remote, cache := path.Join(dir, "remote"), path.Join(dir, "cache")
+	for _, args := range [][]string{
+		{"init", "-q", remote},
+		{"-C", remote, "-c", "user.name=r10k", "-c", "user.email=r10k@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+		{"-C", remote, "tag", "release"},
+		{"-C", remote, "tag", "v1"},
+		{"-C", remote, "branch", "release"},
+		{"clone", "-q", remote, cache},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("failed running git %v: %v: %s", args, err, output)
+		}
+	}
+
+	testCases := []struct {
+		ref      string
+		expected string
+		warnings int
+	}{
+		{"release", "refs/tags/release", 1},
+		{"v1", "refs/tags/v1", 0},
+		{"abc123", "abc123", 0},
+	}
+
+	for _, c := range testCases {
+		m := &GitModule{baseModule: baseModule{name: "acme/foo", cacheFolder: cache}}
+		m.want.ref = c.ref
+
+		before := warnings()
+		m.commitish("")
+		if actual := m.commitish(""); actual != c.expected {
+			t.Errorf("expected ref %s to resolve to %s, got %s", c.ref, c.expected, actual)
+		}
+		if actual := warnings() - before; actual != c.warnings {
+			t.Errorf("expected %d warning(s) for ref %s, got %d", c.warnings, c.ref, actual)
+		}
+	}
+}
+
+func TestGitModuleTagPattern(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := path.Join(dir, "remote")
+	for _, args := range [][]string{
+		{"init", "-q", remote},
+		{"-C", remote, "-c", "user.name=r10k", "-c", "user.email=r10k@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+		{"-C", remote, "tag", "v1.2.0"},
+		{"-C", remote, "tag", "-a", "-m", "release", "v1.10.0"},
+		{"-C", remote, "tag", "v1.9.0"},
+		{"-C", remote, "tag", "v2.0.0"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("failed running git %v: %v: %s", args, err, output)
+		}
+	}
+
+	testCases := []struct {
+		pattern  string
+		expected string
+	}{
+		{"v1.*", "v1.10.0"},
+		{"v*", "v2.0.0"},
+		{"v1.2.*", "v1.2.0"},
+		{"v3.*", ""},
+	}
+
+	for _, c := range testCases {
+		m := &GitModule{baseModule: baseModule{name: "acme/foo"}, repoURL: remote, tagPattern: c.pattern}
+		err := m.resolveTagPattern()
+		if c.expected == "" {
+			if _, ok := err.(ErrNotFound); !ok {
+				t.Errorf("expected no tag to match %s, got %s (%v)", c.pattern, m.want.tag, err)
+			}
+			continue
+		}
+		if err != nil || m.Version() != c.expected {
+			t.Errorf("expected %s to resolve to %s, got %s (%v)", c.pattern, c.expected, m.Version(), err)
+		}
+	}
+
+	pf := PuppetFile{}
+	if _, err := pf.parseModule("mod 'acme/foo', :git => 'https://git.example.com/foo.git', :tag_pattern => 'v1.*', :tag => 'v1.0.0'"); err == nil {
+		t.Errorf("expected an error for a module with both a tag pattern and a tag")
+	}
+}
+
+// TestGitModuleNotFound clones a missing repository with the messages of
+// git translated, it must still be reported as not found
+func TestGitModuleNotFound(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, value := range map[string]string{"LC_ALL": "de_DE.UTF-8", "LANGUAGE": "de"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	m := &GitModule{baseModule: baseModule{name: "acme/foo", cacheFolder: path.Join(dir, "cache")}, repoURL: path.Join(dir, "missing")}
+	err = m.updateCache()
+	if derr, ok := err.(*DownloadError); !ok || derr.retryable {
+		t.Fatalf("expected a missing repository not to be retried, got %v", err)
+	} else if _, ok := derr.error.(ErrNotFound); !ok {
+		t.Errorf("expected the repository not to be found, got %v", derr.error)
+	}
+}
+
+func TestGitModuleUpdateInPlace(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := path.Join(dir, "remote")
+	for _, args := range [][]string{
+		{"init", "-q", remote},
+		{"-C", remote, "-c", "user.name=r10k", "-c", "user.email=r10k@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+		{"-C", remote, "tag", "v1.0.0"},
+		{"-C", remote, "-c", "user.name=r10k", "-c", "user.email=r10k@example.com", "commit", "-q", "--allow-empty", "-m", "second"},
+		{"-C", remote, "tag", "v1.1.0"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("failed running git %v: %v: %s", args, err, output)
+		}
+	}
+
+	updateInPlace = true
+	defer func() { updateInPlace = false }()
+
+	install := func(tag string) *GitModule {
+		m := &GitModule{baseModule: baseModule{name: "acme/foo"}, repoURL: remote}
+		m.want.tag = tag
+		m.SetEnvRoot(dir)
+		m.SetCacheFolder(path.Join(dir, "cache"))
+		if derr := m.Download(); derr.error != nil {
+			t.Fatalf("failed installing %s: %v", tag, derr)
+		}
+		return m
+	}
+
+	m := install("v1.0.0")
+	stray := path.Join(m.TargetFolder(), "stray")
+	if err := ioutil.WriteFile(stray, []byte("local change"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(m.TargetFolder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = install("v1.1.0")
+	after, err := os.Stat(m.TargetFolder())
+	if err != nil || !os.SameFile(before, after) {
+		t.Errorf("expected %s to be updated in place", m.TargetFolder())
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("expected local changes to be discarded, got %v", err)
+	}
+	expected, _ := m.resolveCommit("v1.1.0")
+	if commit, err := headCommit(m.TargetFolder()); err != nil || commit != expected {
+		t.Errorf("expected %s to be checked out at %s, got %s (%v)", m.TargetFolder(), expected, commit, err)
+	}
+
+	// Broken checkouts are installed again
+	if err := ioutil.WriteFile(path.Join(m.TargetFolder(), ".git"), []byte("gitdir: /nonexistent\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m = install("v1.0.0")
+	if !m.IsUpToDate() {
+		t.Errorf("expected %s to be installed again at v1.0.0", m.TargetFolder())
+	}
+}
+
+func TestGitModuleNoCache(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := path.Join(dir, "remote")
+	git := func(args ...string) {
+		args = append([]string{"-C", remote, "-c", "user.name=r10k", "-c", "user.email=r10k@example.com"}, args...)
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("failed running git %v: %v: %s", args, err, output)
+		}
+	}
+	if output, err := exec.Command("git", "init", "-q", remote).CombinedOutput(); err != nil {
+		t.Fatalf("failed creating repository: %v: %s", err, output)
+	}
+	git("commit", "-q", "--allow-empty", "-m", "first")
+	git("tag", "v1.0.0")
+
+	install := func(noCache bool) string {
+		m := &GitModule{baseModule: baseModule{name: "acme/foo", noCache: noCache}, repoURL: remote}
+		m.want.tag = "v1.0.0"
+		m.SetEnvRoot(dir)
+		m.SetCacheFolder(path.Join(dir, "cache"))
+		os.RemoveAll(m.TargetFolder())
+		// Each install is a new run
+		fetches = fetchGroup{fetches: make(map[string]*fetchCall)}
+		if derr := m.Download(); derr.error != nil {
+			t.Fatalf("failed installing v1.0.0: %v", derr)
+		}
+		commit, err := headCommit(m.TargetFolder())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commit
+	}
+
+	first := install(false)
+
+	// The tag is moved to another commit
+	git("commit", "-q", "--allow-empty", "-m", "second")
+	git("tag", "-f", "v1.0.0")
+
+	if commit := install(false); commit != first {
+		t.Errorf("expected the tag to be kept in the cache, got %s", commit)
+	}
+	if commit := install(true); commit == first {
+		t.Errorf("expected the tag to be updated with no_cache")
+	}
+}
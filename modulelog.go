@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+)
+
+// Folder each module's log is also written to, as <module>.log, with
+// --log-dir. The combined log is not affected.
+var logDir string
+
+var moduleLogs = struct {
+	sync.Mutex
+	loggers map[string]*log.Logger
+}{loggers: make(map[string]*log.Logger)}
+
+// moduleLogger returns the logger writing to the log file of the module
+// name, opening it in append mode on first use. Files stay open until
+// r10k-go exits, writes are not buffered.
+func moduleLogger(name string) (*log.Logger, error) {
+	name = normalizeModuleName(name)
+
+	moduleLogs.Lock()
+	defer moduleLogs.Unlock()
+
+	if l, ok := moduleLogs.loggers[name]; ok {
+		return l, nil
+	}
+
+	f, err := os.OpenFile(path.Join(logDir, name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	moduleLogs.loggers[name] = log.New(f, "", log.LstdFlags)
+
+	return moduleLogs.loggers[name], nil
+}
+
+// moduleLogf writes a message to the log file of module name only, with
+// --log-dir, for details that would clutter the combined log
+func moduleLogf(name string, format string, v ...interface{}) {
+	if logDir == "" {
+		return
+	}
+
+	l, err := moduleLogger(name)
+	if err != nil {
+		tracef("failed opening the log of %s: %v\n", name, err)
+		return
+	}
+	l.Output(2, fmt.Sprintf(format, v...))
+}
+
+// logModule logs a message about module name to the combined log, and
+// to the log file of the module with --log-dir
+func logModule(name string, format string, v ...interface{}) {
+	log.Printf(format, v...)
+	moduleLogf(name, format, v...)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestModuleLogf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir string) { logDir = dir }(logDir)
+	logDir = dir
+
+	// Both spellings of the module name share a log file
+	moduleLogf("puppetlabs/apache", "installing %s\n", "puppetlabs/apache")
+	moduleLogf("PuppetLabs-apache", "Downloaded %s\n", "PuppetLabs-apache")
+	moduleLogf("puppetlabs/stdlib", "Downloaded %s\n", "puppetlabs/stdlib")
+
+	b, err := ioutil.ReadFile(path.Join(dir, "puppetlabs-apache.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "installing puppetlabs/apache") || !strings.HasSuffix(lines[1], "Downloaded PuppetLabs-apache") {
+		t.Errorf("unexpected log of puppetlabs-apache: %q", lines)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "puppetlabs-stdlib.log")); err != nil {
+		t.Errorf("expected a log for puppetlabs-stdlib: %v", err)
+	}
+}
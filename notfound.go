@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Lookups of GitHub tarball modules failing because their repository or
+// version does not exist are cached for this long, so that deployments
+// of a broken Puppetfile fail fast without querying the API again.
+// Disabled if 0.
+var notFoundTTL = 5 * time.Minute
+
+// File of the cache folder of a module recording its failed lookups
+const notFoundFile = ".not-found.json"
+
+type notFoundEntry struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// notFoundCache records failed lookups in the cache folders of modules,
+// by lookup: a version, a range of versions or "latest". Modules without
+// a cache folder, checked with the check command, are not cached.
+type notFoundCache struct {
+	mu sync.Mutex
+}
+
+var notFound notFoundCache
+
+func (c *notFoundCache) load(folder string) map[string]notFoundEntry {
+	entries := make(map[string]notFoundEntry)
+	if b, err := ioutil.ReadFile(path.Join(folder, notFoundFile)); err == nil {
+		json.Unmarshal(b, &entries)
+	}
+
+	return entries
+}
+
+// get returns the error of a failed lookup, if it is recent enough
+func (c *notFoundCache) get(folder, lookup string, now time.Time) (ErrNotFound, bool) {
+	if notFoundTTL == 0 || folder == "" {
+		return ErrNotFound{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.load(folder)[lookup]
+	if !ok || now.Sub(e.Time) >= notFoundTTL || now.Before(e.Time) {
+		return ErrNotFound{}, false
+	}
+
+	return ErrNotFound{fmt.Sprintf("%s (cached, looked up again after %s)", e.Message, e.Time.Add(notFoundTTL).Format(time.RFC3339))}, true
+}
+
+// put records a failed lookup
+func (c *notFoundCache) put(folder, lookup string, err ErrNotFound, now time.Time) {
+	if notFoundTTL == 0 || folder == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.load(folder)
+	entries[lookup] = notFoundEntry{Message: err.Error(), Time: now}
+	b, jerr := json.Marshal(entries)
+	if jerr != nil {
+		return
+	}
+
+	if err := os.MkdirAll(folder, 0775); err != nil {
+		tracef("failed caching lookup %s in %s: %v\n", lookup, folder, err)
+		return
+	}
+	part := path.Join(folder, notFoundFile) + ".part"
+	if err := ioutil.WriteFile(part, b, 0644); err != nil {
+		tracef("failed caching lookup %s in %s: %v\n", lookup, folder, err)
+		return
+	}
+	os.Rename(part, path.Join(folder, notFoundFile))
+}
+
+// clear forgets the failed lookups of a module, once one succeeds
+func (c *notFoundCache) clear(folder string) {
+	if folder == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	os.Remove(path.Join(folder, notFoundFile))
+}
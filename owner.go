@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Owner of the files of installed modules, set with --chown. Files are
+// not chowned if -1.
+var chownUID, chownGID = -1, -1
+
+// parseOwner parses user:group, or user to use the primary group of the
+// user. Users and groups can be names or numeric ids.
+func parseOwner(s string) (int, int, error) {
+	userName, groupName := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		userName, groupName = s[:i], s[i+1:]
+	}
+
+	uid, err := strconv.Atoi(userName)
+	primaryGroup := ""
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return -1, -1, fmt.Errorf("unknown user %s", userName)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		primaryGroup = u.Gid
+	}
+
+	if groupName == "" {
+		if primaryGroup == "" {
+			return -1, -1, fmt.Errorf("no group given for user %s", userName)
+		}
+		groupName = primaryGroup
+	}
+
+	gid, err := strconv.Atoi(groupName)
+	if err != nil {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return -1, -1, fmt.Errorf("unknown group %s", groupName)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// setOwner sets the owner of the files of installed modules, as
+// user:group. Only root can change the owner of files.
+func setOwner(owner string) {
+	uid, gid, err := parseOwner(owner)
+	if err != nil {
+		log.Fatalf("failed setting the owner of modules to %s: %v", owner, err)
+	}
+
+	if os.Geteuid() != 0 {
+		warnf("not running as root, the owner of modules can not be changed to %s\n", owner)
+		return
+	}
+
+	chownUID, chownGID = uid, gid
+}
+
+// chownTree changes the owner of folder and all the files it contains,
+// without following symlinks
+func chownTree(folder string) error {
+	if chownUID < 0 {
+		return nil
+	}
+
+	return filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, chownUID, chownGID)
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestParseOwner(t *testing.T) {
+	testCases := []struct {
+		owner         string
+		uid, gid      int
+		expectedError bool
+	}{
+		{"0:0", 0, 0, false},
+		{"1000:50", 1000, 50, false},
+		{"root", 0, 0, false},
+		{"root:0", 0, 0, false},
+		{"1000", -1, -1, true},
+		{"r10k-go-missing-user:0", -1, -1, true},
+	}
+
+	for _, c := range testCases {
+		uid, gid, err := parseOwner(c.owner)
+		if (err != nil) != c.expectedError || uid != c.uid || gid != c.gid {
+			t.Errorf("expected %s to be %d:%d, got %d:%d (%v)", c.owner, c.uid, c.gid, uid, gid, err)
+		}
+	}
+}
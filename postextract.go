@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// splitParameters splits the declaration of a module on commas, except
+// those within quotes or lists, such as :postextract => ['a', 'b']
+func splitParameters(line string) []string {
+	var parts []string
+	var quote rune
+	depth, start := 0, 0
+
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '[':
+			depth++
+		case r == ']' && depth > 0:
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, line[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, line[start:])
+}
+
+// parseList returns the elements of a parameter given either as a
+// single value or as a list: ['a', 'b']
+func parseList(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return []string{strings.Trim(value, " \"'")}
+	}
+
+	var elements []string
+	for _, e := range splitParameters(value[1 : len(value)-1]) {
+		if e = strings.Trim(e, " \"'"); e != "" {
+			elements = append(elements, e)
+		}
+	}
+
+	return elements
+}
+
+// runPostExtract runs the :postextract commands of a module in its
+// folder, once it has been installed. Details about the module are
+// passed to the commands as environment variables.
+func runPostExtract(m PuppetModule) error {
+	env := append(os.Environ(),
+		"R10K_MODULE_NAME="+m.Name(),
+		"R10K_MODULE_VERSION="+m.Version(),
+		"R10K_MODULE_PATH="+m.TargetFolder(),
+	)
+
+	for _, command := range m.PostExtract() {
+		tracef("running %s in %s\n", command, m.TargetFolder())
+
+		cmd := exec.CommandContext(runContext, "sh", "-c", command)
+		cmd.Dir = m.TargetFolder()
+		cmd.Env = env
+		output, err := cmd.CombinedOutput()
+		moduleLogf(m.Name(), "ran %s: %s\n", command, strings.TrimSpace(string(output)))
+		if err != nil {
+			if output := strings.TrimSpace(string(output)); output != "" {
+				return fmt.Errorf("post-extract command %s failed: %v: %s", command, err, output)
+			}
+			return fmt.Errorf("post-extract command %s failed: %v", command, err)
+		}
+	}
+
+	return nil
+}
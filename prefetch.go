@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// fetcher is implemented by modules that can be downloaded to the cache
+// without being installed
+type fetcher interface {
+	fetch() DownloadError
+}
+
+// prefetch downloads a module to the cache, without installing it.
+// Modules sharing a cache folder, like git modules of the same
+// repository, are only fetched once.
+func prefetch(m PuppetModule) DownloadError {
+	f, ok := m.(fetcher)
+	if !ok {
+		return DownloadError{nil, false}
+	}
+
+	return withGitSlot(m, func() DownloadError {
+		return fetches.do(m, f.fetch)
+	})
+}
+
+// cachedPath returns the archive of the module in the cache, or the
+// cache folder of modules not downloaded as an archive, like git modules
+func cachedPath(m PuppetModule) string {
+	if a, ok := m.(interface {
+		archive() string
+	}); ok {
+		return a.archive()
+	}
+
+	return m.CacheFolder()
+}
+
+// cachedSource returns where the module in the cache was downloaded
+// from, a Forge or archive mirror for example, or "" if it is unknown
+func cachedSource(m PuppetModule) string {
+	switch m := m.(type) {
+	case *GitModule:
+		return convertGitProtocol(rewriteURL(m.repoURL))
+	case archived:
+		if src, ok := readSource(m.archive()); ok {
+			return src.URL
+		}
+	}
+
+	return ""
+}
+
+// metadataReader is implemented by modules whose metadata.json can be
+// read from the cache, before they are installed. Returns an error
+// satisfying os.IsNotExist if the module has none.
+type metadataReader interface {
+	cachedMetadata() ([]byte, error)
+}
+
+// cachedMetadataFile returns the metadata.json file of a module in the
+// cache, to resolve its dependencies without installing it. Returns nil
+// if it has none.
+func cachedMetadataFile(m PuppetModule) *MetadataFile {
+	r, ok := m.(metadataReader)
+	if !ok {
+		return nil
+	}
+
+	b, err := r.cachedMetadata()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warnf("failed reading the metadata.json of %s in %s: %v\n", m.Name(), cachedPath(m), err)
+		}
+		return nil
+	}
+
+	return &MetadataFile{r: ioutil.NopCloser(bytes.NewReader(b)), filename: cachedPath(m) + ":metadata.json", wg: &sync.WaitGroup{}}
+}
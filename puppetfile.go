@@ -2,51 +2,141 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"regexp"
 	"strings"
 	"sync"
 )
 
+// Git modules with :branch => :control_branch track the branch
+// of the environment being deployed
+const controlBranch = ":control_branch"
+
 type PuppetFile struct {
 	*os.File
-	wg       *sync.WaitGroup
-	filename string
+	wg            *sync.WaitGroup
+	filename      string
+	controlBranch string
+	override      *environmentOverride
+
+	mu      sync.Mutex
+	modules chan<- PuppetModule
+	waiting map[string][]PuppetModule // Modules waiting for the key to be processed
 }
 
-func NewPuppetFile(puppetfile string) *PuppetFile {
+// NewPuppetFile opens a Puppetfile. controlBranch is the branch of the
+// environment the Puppetfile belongs to, empty if there is none.
+func NewPuppetFile(puppetfile string, controlBranch string) *PuppetFile {
 	f, err := os.Open(puppetfile)
 	if err != nil {
 		log.Fatalf("could not open %s: %v", puppetfile, err)
 	}
 
-	return &PuppetFile{File: f, wg: &sync.WaitGroup{}, filename: puppetfile}
+	return &PuppetFile{File: f, wg: &sync.WaitGroup{}, filename: puppetfile, controlBranch: controlBranch}
+}
+
+// findPuppetfile returns the path of the Puppetfile of an environment,
+// in any of the supported formats, or an empty string if there is none
+func findPuppetfile(folder string) string {
+	for _, name := range []string{"Puppetfile", "Puppetfile.yaml", "Puppetfile.yml", "Puppetfile.json"} {
+		if _, err := os.Stat(path.Join(folder, name)); err == nil {
+			return path.Join(folder, name)
+		}
+	}
+
+	return ""
+}
+
+// findPuppetfiles returns the Puppetfiles of folder, named *.Puppetfile
+// or Puppetfile.*, sorted by name
+func findPuppetfiles(folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var puppetfiles []string
+	for _, f := range files {
+		name := f.Name()
+		// Puppetfile.lock is written by librarian-puppet
+		if f.IsDir() || name == "Puppetfile.lock" {
+			continue
+		}
+		if strings.HasSuffix(name, ".Puppetfile") || strings.HasPrefix(name, "Puppetfile.") {
+			puppetfiles = append(puppetfiles, path.Join(folder, name))
+		}
+	}
+
+	if len(puppetfiles) == 0 {
+		return nil, fmt.Errorf("no Puppetfile found in %s", folder)
+	}
+
+	return puppetfiles, nil
 }
 
-func (p *PuppetFile) Filename() string         { return p.filename }
-func (p *PuppetFile) Close()                   { p.File.Close() }
-func (p *PuppetFile) moduleProcessedCallback() { p.wg.Done() }
+func (p *PuppetFile) Filename() string { return p.filename }
+func (p *PuppetFile) Close()           { p.File.Close() }
+
+// moduleProcessed releases the modules declared with :after => name
+func (p *PuppetFile) moduleProcessed(name string) {
+	p.mu.Lock()
+	name = normalizeModuleName(name)
+	released := p.waiting[name]
+	delete(p.waiting, name)
+	p.mu.Unlock()
+
+	// Called from the results loop, sending synchronously could deadlock
+	if len(released) > 0 {
+		go func() {
+			for _, m := range released {
+				p.modules <- m
+			}
+		}()
+	}
+
+	p.wg.Done()
+}
 
 func (p *PuppetFile) parseParameter(line string) string {
 	if strings.Contains(line, "=>") {
-		return strings.Trim(strings.Split(line, "=>")[1], " \"'")
+		return strings.Trim(strings.SplitN(line, "=>", 2)[1], " \"'")
 	}
 
 	return strings.Trim(strings.SplitN(line, ":", 3)[2], " \"'")
 }
 
+// Parameters modules can be declared with
+var moduleParameters = map[string]bool{
+	"version": true, "git": true, "github_tarball": true, "tarball": true,
+	"install_path": true, "tag": true, "ref": true, "branch": true,
+	"default_branch": true, "after": true, "checksum": true, "ignore_missing": true,
+	"postextract": true, "no_cache": true, "resolve_deps": true, "subdir": true,
+	"sparse": true, "tag_pattern": true,
+}
+
+// Modules downloaded again even if they are in the cache, given with
+// --refresh, by normalized name
+var refreshModules = make(map[string]bool)
+
 func (p *PuppetFile) parseModule(line string) (PuppetModule, error) {
-	var name, repoURL, repoName, moduleType, installPath, version string
-	var tag, ref, branch = "", "", ""
+	var name string
+	params := make(map[string]string)
 
 	line = strings.TrimSpace(line)
 	if !strings.HasPrefix(line, "mod") {
 		return &GitModule{}, errors.New("Error: Module definition not starting with mod")
 	}
 
-	for index, part := range strings.Split(line, ",") {
+	for index, part := range splitParameters(line) {
 		part = strings.TrimSpace(part)
 		switch {
 		case strings.HasPrefix(part, "mod"):
@@ -56,71 +146,200 @@ func (p *PuppetFile) parseModule(line string) (PuppetModule, error) {
 
 		// A line will contain : if it's in the form :tag: value or :tag => value
 		// if not then it must be a version string, and no further parameter is allowed
-		case index == 1 && !strings.Contains(part, "=>") && part != ":latest" && !strings.Contains(part, ":"):
-			moduleType = "forge"
-			version = strings.Trim(part, " \"'")
+		case index == 1 && !strings.Contains(part, "=>") && !strings.Contains(part, ":"):
+			params["version"] = strings.Trim(part, " \"'")
+
+		case index == 1 && (part == ":latest" || part == ":default"):
+			params["version"] = part
 
-		case index == 1 && part == ":latest":
-			moduleType = "forge"
-			version = "" // Latest will be downloaded when no version is given
+		case strings.Contains(part, "=>"):
+			key := strings.TrimPrefix(strings.TrimSpace(strings.Split(part, "=>")[0]), ":")
+			params[key] = p.parseParameter(part)
 
-		case strings.HasPrefix(part, ":github_tarball"):
-			moduleType = "github_tarball"
-			repoName = p.parseParameter(part)
+		case strings.HasPrefix(part, ":") && strings.Count(part, ":") >= 2:
+			params[strings.SplitN(part, ":", 3)[1]] = p.parseParameter(part)
 
-		case strings.HasPrefix(part, ":git"):
-			moduleType = "git"
-			repoURL = p.parseParameter(part)
+		default:
+			warnf("unsupported parameter %s in %s\n", part, p.filename)
+		}
+	}
 
-		case strings.HasPrefix(part, ":install_path"):
-			installPath = p.parseParameter(part)
+	return p.newModule(name, params)
+}
 
-		case strings.HasPrefix(part, ":tag"):
-			tag = p.parseParameter(part)
+// Sources of modules replaced in all Puppetfiles, and dependencies, by
+// normalized module name, set with module_overrides in r10k.yml
+var moduleOverrides map[string]map[string]string
 
-		case strings.HasPrefix(part, ":ref"):
-			ref = p.parseParameter(part)
+// Parameters defining where a module is downloaded from, replaced by
+// module overrides
+var sourceParameters = []string{"version", "git", "github_tarball", "tarball", "tag", "ref", "branch", "default_branch", "checksum", "subdir", "sparse", "tag_pattern"}
 
-		case strings.HasPrefix(part, ":branch"):
-			branch = p.parseParameter(part)
+// overrideParameters returns the parameters of the module, with its
+// source replaced if it is overridden in r10k.yml
+func overrideParameters(name string, params map[string]string) map[string]string {
+	override, ok := moduleOverrides[normalizeModuleName(name)]
+	if !ok {
+		return params
+	}
 
-		default:
-			fmt.Printf("Unsupported parameter %s in %s\n", part, p.filename)
+	merged := make(map[string]string)
+	for k, v := range params {
+		merged[k] = v
+	}
+	for _, k := range sourceParameters {
+		delete(merged, k)
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	log.Printf("overriding the source of module %s\n", name)
+
+	return merged
+}
+
+// Versions modules are forced to with --pin, whatever their version in
+// Puppetfiles, by normalized module name
+var pinnedVersions = make(map[string]string)
+
+// pinParameters returns the parameters of the module, with its version
+// replaced if it is pinned with --pin. Git modules are pinned to a ref.
+func pinParameters(name string, params map[string]string) map[string]string {
+	version, ok := pinnedVersions[normalizeModuleName(name)]
+	if !ok {
+		return params
+	}
+
+	if params["tarball"] != "" {
+		warnf("module %s is downloaded from a tarball, it can not be pinned to %s\n", name, version)
+		return params
+	}
+
+	pinned := make(map[string]string)
+	for k, v := range params {
+		pinned[k] = v
+	}
+	for _, k := range []string{"version", "ref", "tag", "branch", "default_branch", "tag_pattern"} {
+		delete(pinned, k)
+	}
+	if pinned["git"] != "" {
+		pinned["ref"] = version
+	} else {
+		pinned["version"] = version
+	}
+	log.Printf("pinning module %s to %s with --pin\n", name, version)
+
+	return pinned
+}
+
+// newModule returns the module declared with the given parameters,
+// the type of module depends on the parameters given
+func (p *PuppetFile) newModule(name string, params map[string]string) (PuppetModule, error) {
+	params = pinParameters(name, overrideParameters(name, params))
+
+	for key := range params {
+		if !moduleParameters[key] {
+			warnf("unsupported parameter :%s of module %s in %s\n", key, name, p.filename)
 		}
 	}
 
+	// The default of the source is used when no version is given: the
+	// default branch of git repositories, the latest release otherwise
+	unpinned := false
+	for _, key := range []string{"version", "ref", "tag", "branch"} {
+		if params[key] == ":default" || params[key] == ":latest" {
+			delete(params, key)
+			unpinned = true
+		}
+	}
+
+	branch := params["branch"]
+	if branch == controlBranch {
+		branch = p.controlBranch
+		if branch == "" && params["default_branch"] == "" {
+			return &GitModule{}, errParameter{fmt.Errorf("module %s tracks %s, but no environment is deployed and no :default_branch is set", name, controlBranch), "branch"}
+		}
+	}
+
+	base := baseModule{
+		name:          name,
+		installPath:   params["install_path"],
+		after:         params["after"],
+		ignoreMissing: params["ignore_missing"] == "true",
+		noCache:       params["no_cache"] == "true" || refreshModules[normalizeModuleName(name)],
+		noDeps:        params["resolve_deps"] == "false",
+		unpinned:      unpinned,
+		postExtract:   parseList(params["postextract"]),
+		processed:     func() { p.moduleProcessed(name) },
+	}
+
 	switch {
-	case moduleType == "git":
+	case params["github_tarball"] != "":
+		if branch == "" && params["branch"] == controlBranch {
+			branch = params["default_branch"]
+		}
+		if branch != "" && params["version"] != "" {
+			return &GithubTarballModule{}, errParameter{fmt.Errorf("module %s can not have both a version and a branch", name), "branch"}
+		}
+		m := &GithubTarballModule{
+			baseModule: base,
+			repoName:   params["github_tarball"],
+			version:    params["version"],
+			branch:     branch,
+		}
+		if isVersionRange(m.version) {
+			m.requirement, m.version = m.version, ""
+		}
+		return m, nil
+
+	case params["tarball"] != "":
+		return &TarballModule{
+			baseModule: base,
+			url:        params["tarball"],
+			version:    params["version"],
+			checksum:   strings.ToLower(params["checksum"]),
+		}, nil
+
+	case params["git"] != "":
+		// :sparse is an alias of :subdir
+		subdir := params["subdir"]
+		if subdir == "" {
+			subdir = params["sparse"]
+		}
+		// Cleaned as an absolute path, so it can not be outside of the repository
+		subdir = strings.Trim(path.Clean("/"+subdir), "/")
+
+		tagPattern := params["tag_pattern"]
+		if tagPattern != "" {
+			if params["ref"] != "" || params["tag"] != "" || branch != "" {
+				return &GitModule{}, errParameter{fmt.Errorf("module %s can not have both a :tag_pattern and a ref, tag or branch", name), "tag_pattern"}
+			}
+			if _, err := path.Match(tagPattern, ""); err != nil {
+				return &GitModule{}, errParameter{fmt.Errorf("invalid :tag_pattern %s of module %s", tagPattern, name), "tag_pattern"}
+			}
+		}
+
 		return &GitModule{
-			name:        name,
-			repoURL:     repoURL,
-			installPath: installPath,
-			processed:   p.moduleProcessedCallback,
+			baseModule:    base,
+			repoURL:       params["git"],
+			defaultBranch: params["default_branch"],
+			subdir:        subdir,
+			tagPattern:    tagPattern,
 			want: struct {
 				ref    string
 				tag    string
 				branch string
 			}{
-				ref,
-				tag,
+				params["ref"],
+				params["tag"],
 				branch,
 			},
-			cacheFolder: ""}, nil
-
-	case moduleType == "github_tarball":
-		return &GithubTarballModule{
-			name:        name,
-			repoName:    repoName,
-			version:     version,
-			processed:   p.moduleProcessedCallback,
-			cacheFolder: "",
 		}, nil
 
 	default:
 		return &ForgeModule{
-			name:      name,
-			version:   version,
-			processed: p.moduleProcessedCallback,
+			baseModule: base,
+			version:    params["version"],
 		}, nil
 	}
 }
@@ -131,6 +350,10 @@ func (p *PuppetFile) parse(s *bufio.Scanner) ([]PuppetModule, map[string]string,
 
 	lineNumber := 0
 
+	// Number of the first line of the block, and its lines as written
+	blockLine := 0
+	var lines []string
+
 	for block := ""; s.Scan(); {
 		lineNumber++
 
@@ -139,9 +362,16 @@ func (p *PuppetFile) parse(s *bufio.Scanner) ([]PuppetModule, map[string]string,
 		line = strings.TrimSpace(line)
 
 		if len(line) == 0 {
+			if block != "" {
+				lines = append(lines, s.Text())
+			}
 			continue
 		}
 
+		if block == "" {
+			blockLine, lines = lineNumber, nil
+		}
+		lines = append(lines, s.Text())
 		block += line
 
 		optionValue := func(block string) string {
@@ -161,12 +391,16 @@ func (p *PuppetFile) parse(s *bufio.Scanner) ([]PuppetModule, map[string]string,
 			case strings.HasPrefix(block, "mod"):
 				module, err := p.parseModule(block)
 				if err != nil {
-					return nil, nil, err
+					parameter := ""
+					if perr, ok := err.(errParameter); ok {
+						parameter = perr.parameter
+					}
+					return nil, nil, p.malformed(blockLine, lines, parameter, err.Error())
 				}
 				modules = append(modules, module)
 
 			default:
-				return nil, nil, fmt.Errorf("failed parsing Puppetfile, error around line: %d", lineNumber)
+				return nil, nil, p.malformed(blockLine, lines, "", "unknown directive")
 			}
 
 			block = ""
@@ -177,23 +411,270 @@ func (p *PuppetFile) parse(s *bufio.Scanner) ([]PuppetModule, map[string]string,
 	return modules, opts, nil
 }
 
-type ErrMalformedPuppetfile struct{ s string }
+// structuredPuppetfile is the format of Puppetfile.yaml and Puppetfile.json,
+// modules are declared with the same parameters as in a Puppetfile:
+//
+//	modules:
+//	  - name: puppetlabs/apt
+//	    git: https://github.com/puppetlabs/puppetlabs-apt.git
+//	    branch: main
+type structuredPuppetfile struct {
+	Forge     string
+	Moduledir string
+	Modules   []map[string]string
+}
+
+// isStructured returns true for Puppetfiles in YAML or JSON
+func (p *PuppetFile) isStructured() bool {
+	switch strings.ToLower(path.Ext(p.filename)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
 
-func (e ErrMalformedPuppetfile) Error() string { return e.s }
+	return false
+}
 
-func (p *PuppetFile) Process(modules chan<- PuppetModule, done func()) error {
-	parsedModules, _, err := p.parse(bufio.NewScanner(p.File))
+func (p *PuppetFile) parseStructured(r io.Reader) ([]PuppetModule, map[string]string, error) {
+	var pf structuredPuppetfile
+
+	b, err := ioutil.ReadAll(r)
 	if err != nil {
-		done()
-		return ErrMalformedPuppetfile{err.Error()}
+		return nil, nil, err
+	}
+
+	if strings.ToLower(path.Ext(p.filename)) == ".json" {
+		err = decodeJSONPuppetfile(b, &pf)
+	} else {
+		err = yaml.Unmarshal(b, &pf)
+	}
+	if err != nil {
+		return nil, nil, ErrMalformedPuppetfile{Filename: p.filename, Message: err.Error()}
+	}
+
+	opts := make(map[string]string)
+	if pf.Forge != "" {
+		opts["forge"] = pf.Forge
+	}
+	if pf.Moduledir != "" {
+		opts["moduledir"] = pf.Moduledir
+	}
+
+	modules := make([]PuppetModule, 0, len(pf.Modules))
+	for i, params := range pf.Modules {
+		name := params["name"]
+		if name == "" {
+			return nil, nil, ErrMalformedPuppetfile{Filename: p.filename, Message: fmt.Sprintf("module %d has no name", i+1)}
+		}
+		delete(params, "name")
+
+		module, err := p.newModule(name, params)
+		if err != nil {
+			return nil, nil, ErrMalformedPuppetfile{Filename: p.filename, Message: err.Error()}
+		}
+		modules = append(modules, module)
+	}
+
+	return modules, opts, nil
+}
+
+// decodeJSONPuppetfile decodes a Puppetfile.json, parameters of modules
+// can be given as strings, numbers or booleans
+func decodeJSONPuppetfile(b []byte, pf *structuredPuppetfile) error {
+	var raw struct {
+		Forge     string
+		Moduledir string
+		Modules   []map[string]interface{}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return err
+	}
+
+	pf.Forge, pf.Moduledir = raw.Forge, raw.Moduledir
+	for _, params := range raw.Modules {
+		m := make(map[string]string)
+		for k, v := range params {
+			m[k] = fmt.Sprint(v)
+		}
+		pf.Modules = append(pf.Modules, m)
 	}
+
+	return nil
+}
+
+// applyOverride merges the override of the environment, if any, into
+// the modules of the Puppetfile
+func (p *PuppetFile) applyOverride(modules []PuppetModule) ([]PuppetModule, error) {
+	if p.override == nil {
+		return modules, nil
+	}
+
+	overrides, _, err := p.parse(bufio.NewScanner(strings.NewReader(p.override.Puppetfile)))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing the override of %s: %v", p.filename, err)
+	}
+
+	removed := make(map[string]bool)
+	for _, name := range p.override.Remove {
+		removed[normalizeModuleName(name)] = true
+	}
+	for _, m := range overrides {
+		removed[normalizeModuleName(m.Name())] = true
+	}
+
+	merged := make([]PuppetModule, 0, len(modules)+len(overrides))
+	for _, m := range modules {
+		if !removed[normalizeModuleName(m.Name())] {
+			merged = append(merged, m)
+		}
+	}
+
+	return append(merged, overrides...), nil
+}
+
+// checkOrdering verifies that the prerequisites given with :after are
+// declared in the Puppetfile and do not form a cycle
+func checkOrdering(modules []PuppetModule) error {
+	after := make(map[string]string)
+	for _, m := range modules {
+		after[normalizeModuleName(m.Name())] = normalizeModuleName(m.After())
+	}
+
+	for _, m := range modules {
+		if m.After() == "" {
+			continue
+		}
+		if _, ok := after[normalizeModuleName(m.After())]; !ok {
+			return fmt.Errorf("module %s is to be installed after %s, which is not in the Puppetfile", m.Name(), m.After())
+		}
+
+		seen := map[string]bool{normalizeModuleName(m.Name()): true}
+		for next := after[normalizeModuleName(m.Name())]; next != ""; next = after[next] {
+			if seen[next] {
+				return fmt.Errorf("cycle in :after ordering of module %s", m.Name())
+			}
+			seen[next] = true
+		}
+	}
+
+	return nil
+}
+
+// ErrMalformedPuppetfile is returned for invalid Puppetfiles. Line and
+// Column are the position of the offending Token, 0 if the error is not
+// related to a specific declaration.
+type ErrMalformedPuppetfile struct {
+	Filename string
+	Line     int
+	Column   int
+	Token    string
+	Message  string
+}
+
+func (e ErrMalformedPuppetfile) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Filename, e.Message)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s, near %s", e.Filename, e.Line, e.Column, e.Message, e.Token)
+}
+
+// errParameter is returned for modules declared with an invalid parameter
+type errParameter struct {
+	error
+	parameter string
+}
+
+// malformed returns the error for the block of lines starting at line
+// first. The offending token is the declaration of parameter, if it is
+// set and found in the block, the first word of the block otherwise.
+func (p *PuppetFile) malformed(first int, lines []string, parameter string, message string) ErrMalformedPuppetfile {
+	if parameter != "" {
+		declaration := regexp.MustCompile(":" + regexp.QuoteMeta(parameter) + `\b`)
+		for i, line := range lines {
+			line = strings.Split(line, "#")[0]
+			if loc := declaration.FindStringIndex(line); loc != nil {
+				return ErrMalformedPuppetfile{Filename: p.filename, Line: first + i, Column: loc[0] + 1, Token: line[loc[0]:loc[1]], Message: message}
+			}
+		}
+	}
+
+	line := strings.Split(lines[0], "#")[0]
+	token := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ','
+	})[0]
+
+	return ErrMalformedPuppetfile{Filename: p.filename, Line: first, Column: strings.Index(line, token) + 1, Token: token, Message: message}
+}
+
+// load parses the Puppetfile, and returns the modules to install
+func (p *PuppetFile) load() ([]PuppetModule, error) {
+	var parsedModules []PuppetModule
+	var err error
+
+	if p.isStructured() {
+		parsedModules, _, err = p.parseStructured(p.File)
+	} else {
+		parsedModules, _, err = p.parse(bufio.NewScanner(p.File))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedModules, err = p.applyOverride(parsedModules); err != nil {
+		return nil, ErrMalformedPuppetfile{Filename: p.filename, Message: err.Error()}
+	}
+
 	// modulePath, ok := opts["moduledir"]
 	// if !ok {
 	// 	modulePath = "modules"
 	// }
 
+	if err = checkOrdering(parsedModules); err != nil {
+		return nil, ErrMalformedPuppetfile{Filename: p.filename, Message: err.Error()}
+	}
+
+	if selectedModules != nil {
+		parsedModules = selectModules(parsedModules)
+	}
+
+	if requirePinned {
+		if names := unpinnedModules(parsedModules, true); len(names) > 0 {
+			return nil, ErrMalformedPuppetfile{Filename: p.filename, Message: "modules not pinned to a version, ref or tag: " + strings.Join(names, ", ")}
+		}
+	}
+
+	return parsedModules, nil
+}
+
+func (p *PuppetFile) Process(modules chan<- PuppetModule, done func()) error {
+	parsedModules, err := p.load()
+	if err != nil {
+		done()
+		return err
+	}
+
+	// Modules declared with :after are held back until their prerequisite
+	// has been processed, all others are installed in parallel right away
+	p.mu.Lock()
+	p.modules = modules
+	p.waiting = make(map[string][]PuppetModule)
+	ready := make([]PuppetModule, 0, len(parsedModules))
 	for _, module := range parsedModules {
-		p.wg.Add(1)
+		if module.After() == "" {
+			ready = append(ready, module)
+			continue
+		}
+		after := normalizeModuleName(module.After())
+		p.waiting[after] = append(p.waiting[after], module)
+	}
+	p.mu.Unlock()
+
+	status.declare(len(parsedModules))
+	p.wg.Add(len(parsedModules))
+	for _, module := range ready {
 		modules <- module
 	}
 
@@ -204,3 +685,94 @@ func (p *PuppetFile) Process(modules chan<- PuppetModule, done func()) error {
 
 	return nil
 }
+
+// Modules of Puppetfiles installed with --modules-from, by normalized
+// name, all if nil
+var selectedModules map[string]bool
+
+// readModuleList reads the names of modules listed in file, one per line.
+// Empty lines and comments starting with # are ignored.
+func readModuleList(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if name := strings.TrimSpace(strings.Split(s.Text(), "#")[0]); name != "" {
+			names[normalizeModuleName(name)] = true
+		}
+	}
+
+	return names, s.Err()
+}
+
+// selectModules returns the modules selected with --modules-from. Modules
+// to be installed after one that is not selected are installed right away.
+func selectModules(modules []PuppetModule) []PuppetModule {
+	selected := make([]PuppetModule, 0, len(modules))
+	for _, m := range modules {
+		if !selectedModules[normalizeModuleName(m.Name())] {
+			continue
+		}
+		if m.After() != "" && !selectedModules[normalizeModuleName(m.After())] {
+			m.(interface {
+				setAfter(string)
+			}).setAfter("")
+		}
+		selected = append(selected, m)
+	}
+
+	return selected
+}
+
+// Refuse Puppetfiles with modules not pinned to a version, ref or tag,
+// set with --require-pinned
+var requirePinned bool
+
+// unpinnedModules returns the names of the modules not pinned to a
+// version. Modules declared with :default or :latest, or following a
+// branch or a :tag_pattern, are only returned if strict is true.
+// Tarball modules are pinned by their URL.
+func unpinnedModules(modules []PuppetModule, strict bool) []string {
+	var names []string
+	for _, m := range modules {
+		d := dumpModule(m)
+		switch {
+		case d.Type == "tarball" || d.Version != "" || d.Ref != "" || d.Tag != "":
+		case !strict && (d.Default || d.Branch != "" || d.TagPattern != ""):
+		default:
+			names = append(names, m.Name())
+		}
+	}
+
+	return names
+}
+
+// validatePuppetfiles parses the Puppetfiles, and warns about their
+// modules that are not pinned to a version
+func validatePuppetfiles(puppetfiles []string) error {
+	for _, puppetfile := range puppetfiles {
+		pf := NewPuppetFile(puppetfile, "")
+		modules, err := pf.load()
+		pf.Close()
+		if err != nil {
+			return err
+		}
+		warnUnpinned(puppetfile, modules)
+		log.Printf("%s is valid\n", puppetfile)
+	}
+
+	return nil
+}
+
+// warnUnpinned warns about the modules of puppetfile that are not pinned
+// to a version, unless declared with :default or :latest
+func warnUnpinned(puppetfile string, modules []PuppetModule) {
+	for _, name := range unpinnedModules(modules, false) {
+		warnf("module %s of %s is not pinned, declare it with :default if this is intended\n", name, puppetfile)
+	}
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -15,8 +22,8 @@ func TestParseModuleGit(t *testing.T) {
 	}
 
 	expected := &GitModule{
-		name:    "puppetlabs/puppetlabs-apache",
-		repoURL: "https://github.com/puppetlabs/puppetlabs-apache.git",
+		baseModule: baseModule{name: "puppetlabs/puppetlabs-apache"},
+		repoURL:    "https://github.com/puppetlabs/puppetlabs-apache.git",
 	}
 
 	for _, c := range cases {
@@ -102,3 +109,546 @@ mod 'puppetlabs-stdlib',
 		}
 	}
 }
+
+func TestParseModuleControlBranch(t *testing.T) {
+	testCases := []struct {
+		line           string
+		controlBranch  string
+		expectedBranch string
+		expectedError  bool
+	}{
+		{
+			line:           "mod 'acme/foo', :git => 'https://example.com/foo.git', :branch => :control_branch",
+			controlBranch:  "production",
+			expectedBranch: "production",
+		}, {
+			line:           "mod 'acme/foo', :git => 'https://example.com/foo.git', :branch => :control_branch, :default_branch => 'master'",
+			controlBranch:  "",
+			expectedBranch: "",
+		}, {
+			line:          "mod 'acme/foo', :git => 'https://example.com/foo.git', :branch => :control_branch",
+			controlBranch: "",
+			expectedError: true,
+		}, {
+			line:           "mod 'acme/foo', :git => 'https://example.com/foo.git', :branch => 'develop'",
+			controlBranch:  "production",
+			expectedBranch: "develop",
+		},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{controlBranch: c.controlBranch}
+		m, err := pf.parseModule(c.line)
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("expected an error parsing %s", c.line)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.line, err)
+			continue
+		}
+
+		if branch := m.(*GitModule).want.branch; branch != c.expectedBranch {
+			t.Errorf("failed parsing %s, expected branch %s, got %s", c.line, c.expectedBranch, branch)
+		}
+	}
+}
+
+func TestCheckOrdering(t *testing.T) {
+	testCases := []struct {
+		puppetfile    string
+		expectedError bool
+	}{
+		{
+			puppetfile: "mod 'acme/foo', '1.0.0'\nmod 'acme/bar', :git => 'https://example.com/bar.git', :after => 'acme/foo'",
+		}, {
+			puppetfile: "mod 'acme/foo', :git => 'https://example.com/foo.git', :after => 'acme-bar'\nmod 'acme/bar', :git => 'https://example.com/bar.git'",
+		}, {
+			puppetfile:    "mod 'acme/bar', :git => 'https://example.com/bar.git', :after => 'acme/baz'",
+			expectedError: true,
+		}, {
+			puppetfile:    "mod 'acme/foo', :git => 'https://example.com/foo.git', :after => 'acme/bar'\nmod 'acme/bar', :git => 'https://example.com/bar.git', :after => 'acme/foo'",
+			expectedError: true,
+		}, {
+			puppetfile:    "mod 'acme/foo', :git => 'https://example.com/foo.git', :after => 'acme/foo'",
+			expectedError: true,
+		},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{}
+		modules, _, err := pf.parse(bufio.NewScanner(strings.NewReader(c.puppetfile)))
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.puppetfile, err)
+			continue
+		}
+
+		if err = checkOrdering(modules); (err != nil) != c.expectedError {
+			t.Errorf("unexpected result checking the ordering of %s: %v", c.puppetfile, err)
+		}
+	}
+}
+
+func TestApplyOverride(t *testing.T) {
+	pf := PuppetFile{override: &environmentOverride{
+		Puppetfile: "mod 'puppetlabs/ntp', '6.0.0'\nmod 'puppetlabs/apt', '2.0.0'",
+		Remove:     []string{"puppetlabs-stdlib"},
+	}}
+
+	modules, _, err := pf.parse(bufio.NewScanner(strings.NewReader("mod 'puppetlabs/ntp', '5.0.0'\nmod 'puppetlabs/stdlib', '4.0.0'\nmod 'puppetlabs/concat', '1.0.0'")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if modules, err = pf.applyOverride(modules); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"puppetlabs/concat": "1.0.0", "puppetlabs/ntp": "6.0.0", "puppetlabs/apt": "2.0.0"}
+	actual := make(map[string]string)
+	for _, m := range modules {
+		actual[m.Name()] = m.Version()
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("failed applying override, expected %v, got %v", expected, actual)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	testCases := []struct {
+		puppetfile string
+		expected   ErrMalformedPuppetfile
+	}{
+		{
+			puppetfile: "mod 'puppetlabs-ntp', '0.0.3'\n\n  mdo 'puppetlabs-apt'\n",
+			expected:   ErrMalformedPuppetfile{Filename: "Puppetfile", Line: 3, Column: 3, Token: "mdo", Message: "unknown directive"},
+		}, {
+			puppetfile: "mod 'acme/foo',\n  :git => 'https://example.com/foo.git',\n  :branch => :control_branch\nfoo",
+			expected: ErrMalformedPuppetfile{Filename: "Puppetfile", Line: 3, Column: 3, Token: ":branch",
+				Message: "module acme/foo tracks :control_branch, but no environment is deployed and no :default_branch is set"},
+		}, {
+			puppetfile: "mod 'acme/foo', :git => 'https://example.com/foo.git', :ref => 'main', :tag_pattern => 'v*'",
+			expected: ErrMalformedPuppetfile{Filename: "Puppetfile", Line: 1, Column: 72, Token: ":tag_pattern",
+				Message: "module acme/foo can not have both a :tag_pattern and a ref, tag or branch"},
+		}, {
+			puppetfile: "mod 'acme/foo', '1.0.0',\n\n  # Development branch\n    :github_tarball => 'acme/foo', :branch => 'main'",
+			expected: ErrMalformedPuppetfile{Filename: "Puppetfile", Line: 4, Column: 36, Token: ":branch",
+				Message: "module acme/foo can not have both a version and a branch"},
+		},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{filename: "Puppetfile"}
+		_, _, err := pf.parse(bufio.NewScanner(strings.NewReader(c.puppetfile)))
+		if merr, ok := err.(ErrMalformedPuppetfile); !ok || merr != c.expected {
+			t.Errorf("failed parsing %s, expected %v, got %v", c.puppetfile, c.expected, err)
+		}
+	}
+}
+
+func TestParseModuleTarball(t *testing.T) {
+	pf := PuppetFile{}
+	m, err := pf.parseModule("mod 'acme/foo', :tarball => 'https://artifacts.example.com/foo-1.2.3.tar.gz', :version => '1.2.3', :checksum => 'ABC123'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm, ok := m.(*TarballModule)
+	if !ok {
+		t.Fatalf("expected a tarball module, got %T", m)
+	}
+
+	if tm.url != "https://artifacts.example.com/foo-1.2.3.tar.gz" || tm.version != "1.2.3" || tm.checksum != "abc123" {
+		t.Errorf("failed parsing tarball module, got %+v", tm)
+	}
+}
+
+func TestParseModuleDefault(t *testing.T) {
+	testCases := []struct {
+		line     string
+		unpinned bool
+	}{
+		{"mod 'puppetlabs/apache', :default", true},
+		{"mod 'puppetlabs/apache', :latest", true},
+		{"mod 'puppetlabs/apache', :version => :default", true},
+		{"mod 'acme/foo', :git => 'https://git.example.com/foo.git', :branch => :default", true},
+		{"mod 'acme/foo', :github_tarball => 'acme/foo', :version => :default", true},
+		{"mod 'puppetlabs/apache'", false},
+		{"mod 'puppetlabs/apache', '1.0.0'", false},
+	}
+
+	pf := PuppetFile{}
+	for _, c := range testCases {
+		m, err := pf.parseModule(c.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := dumpModule(m)
+		if d.Default != c.unpinned {
+			t.Errorf("expected %s to be unpinned: %t", c.line, c.unpinned)
+		}
+		if c.unpinned && (d.Version != "" || d.Branch != "") {
+			t.Errorf("expected %s to have no version, got %+v", c.line, d)
+		}
+	}
+}
+
+func TestParseModulePinned(t *testing.T) {
+	pinnedVersions["puppetlabs-apache"] = "5.0.0"
+	pinnedVersions["acme-foo"] = "v2.0.0"
+	defer func() { pinnedVersions = make(map[string]string) }()
+
+	testCases := []struct {
+		line     string
+		expected dumpedModule
+	}{
+		{"mod 'puppetlabs/apache', '4.0.0'", dumpedModule{Name: "puppetlabs/apache", Type: "forge", Version: "5.0.0"}},
+		{"mod 'puppetlabs/apache', :latest", dumpedModule{Name: "puppetlabs/apache", Type: "forge", Version: "5.0.0"}},
+		{"mod 'acme/foo', :git => 'https://git.example.com/foo.git', :branch => 'main'", dumpedModule{Name: "acme/foo", Type: "git", Source: "https://git.example.com/foo.git", Ref: "v2.0.0"}},
+		{"mod 'acme/foo', :github_tarball => 'acme/foo', :version => '1.0.0'", dumpedModule{Name: "acme/foo", Type: "github_tarball", Source: "acme/foo", Version: "v2.0.0"}},
+		{"mod 'puppetlabs/ntp', '4.0.0'", dumpedModule{Name: "puppetlabs/ntp", Type: "forge", Version: "4.0.0"}},
+	}
+
+	pf := PuppetFile{}
+	for _, c := range testCases {
+		m, err := pf.parseModule(c.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := dumpModule(m); !reflect.DeepEqual(d, c.expected) {
+			t.Errorf("expected %s to be parsed as %+v, got %+v", c.line, c.expected, d)
+		}
+	}
+}
+
+func TestUnpinnedModules(t *testing.T) {
+	puppetfile := `
+mod 'puppetlabs/ntp', '4.0.0'
+mod 'puppetlabs/apache'
+mod 'puppetlabs/stdlib', :latest
+mod 'acme/foo', :git => 'https://git.example.com/foo.git', :branch => 'main'
+mod 'acme/bar', :git => 'https://git.example.com/bar.git', :tag => 'v1.0.0'
+mod 'acme/baz', :tarball => 'https://files.example.com/baz.tar.gz'
+`
+	pf := PuppetFile{filename: "Puppetfile"}
+	modules, _, err := pf.parse(bufio.NewScanner(strings.NewReader(puppetfile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := unpinnedModules(modules, false); !reflect.DeepEqual(names, []string{"puppetlabs/apache"}) {
+		t.Errorf("expected only puppetlabs/apache to be unpinned, got %v", names)
+	}
+	if names := unpinnedModules(modules, true); !reflect.DeepEqual(names, []string{"puppetlabs/apache", "puppetlabs/stdlib", "acme/foo"}) {
+		t.Errorf("expected puppetlabs/apache, puppetlabs/stdlib and acme/foo to be unpinned, got %v", names)
+	}
+}
+
+func TestSelectModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list := path.Join(dir, "phase1")
+	if err := ioutil.WriteFile(list, []byte("# Phase one\npuppetlabs-apache\n\n  puppetlabs/concat  # after stdlib\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if selectedModules, err = readModuleList(list); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { selectedModules = nil }()
+
+	puppetfile := `
+mod 'puppetlabs/apache', '5.0.0'
+mod 'puppetlabs/stdlib', '4.25.1'
+mod 'puppetlabs/concat', '4.0.0', :after => 'puppetlabs/stdlib'
+`
+	pf := PuppetFile{filename: "Puppetfile"}
+	modules, _, err := pf.parse(bufio.NewScanner(strings.NewReader(puppetfile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := selectModules(modules)
+	if len(selected) != 2 || selected[0].Name() != "puppetlabs/apache" || selected[1].Name() != "puppetlabs/concat" {
+		t.Fatalf("expected puppetlabs/apache and puppetlabs/concat to be selected, got %v", selected)
+	}
+	if selected[1].After() != "" {
+		t.Errorf("expected puppetlabs/concat not to wait for puppetlabs/stdlib, which is not selected")
+	}
+}
+
+func TestParseModuleSubdir(t *testing.T) {
+	testCases := []struct {
+		line   string
+		subdir string
+	}{
+		{"mod 'acme/foo', :git => 'https://git.example.com/mono.git', :subdir => 'modules/foo'", "modules/foo"},
+		{"mod 'acme/foo', :git => 'https://git.example.com/mono.git', :sparse => '/modules/foo/'", "modules/foo"},
+		{"mod 'acme/foo', :git => 'https://git.example.com/mono.git', :subdir => '../../etc'", "etc"},
+		{"mod 'acme/foo', :git => 'https://git.example.com/mono.git'", ""},
+	}
+
+	pf := PuppetFile{}
+	for _, c := range testCases {
+		m, err := pf.parseModule(c.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gm := m.(*GitModule); gm.subdir != c.subdir {
+			t.Errorf("expected subdir %q for %s, got %q", c.subdir, c.line, gm.subdir)
+		}
+	}
+}
+
+func TestParseStructured(t *testing.T) {
+	testCases := []struct {
+		filename   string
+		puppetfile string
+	}{
+		{
+			filename: "Puppetfile.yaml",
+			puppetfile: `
+modules:
+  - name: puppetlabs/ntp
+    version: 6.0.0
+  - name: puppetlabs/apt
+    git: https://github.com/puppetlabs/puppetlabs-apt.git
+    branch: main
+`,
+		}, {
+			filename: "Puppetfile.json",
+			puppetfile: `{
+	"modules": [
+		{"name": "puppetlabs/ntp", "version": "6.0.0"},
+		{"name": "puppetlabs/apt", "git": "https://github.com/puppetlabs/puppetlabs-apt.git", "branch": "main"}
+	]
+}`,
+		},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{filename: c.filename}
+		if !pf.isStructured() {
+			t.Errorf("expected %s to be a structured Puppetfile", c.filename)
+		}
+
+		modules, _, err := pf.parseStructured(strings.NewReader(c.puppetfile))
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.filename, err)
+			continue
+		}
+
+		if len(modules) != 2 {
+			t.Errorf("%s: expected 2 modules, got %d", c.filename, len(modules))
+			continue
+		}
+
+		if m, ok := modules[0].(*ForgeModule); !ok || m.Name() != "puppetlabs/ntp" || m.version != "6.0.0" {
+			t.Errorf("%s: failed parsing forge module, got %+v", c.filename, modules[0])
+		}
+
+		if m, ok := modules[1].(*GitModule); !ok || m.repoURL != "https://github.com/puppetlabs/puppetlabs-apt.git" || m.want.branch != "main" {
+			t.Errorf("%s: failed parsing git module, got %+v", c.filename, modules[1])
+		}
+	}
+}
+
+func TestDumpPuppetfile(t *testing.T) {
+	pf := PuppetFile{}
+	modules, _, err := pf.parse(bufio.NewScanner(strings.NewReader("mod 'puppetlabs/ntp', '6.0.0'\nmod 'acme/foo', :git => 'https://example.com/foo.git', :tag => 'v1.0.0', :install_path => 'site'")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err = dumpPuppetfile(&b, modules); err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []dumpedModule
+	if err = json.Unmarshal(b.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dumpedModule{
+		{Name: "puppetlabs/ntp", Type: "forge", Version: "6.0.0"},
+		{Name: "acme/foo", Type: "git", Source: "https://example.com/foo.git", Tag: "v1.0.0", InstallPath: "site"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("failed dumping Puppetfile, expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestParseModulePostExtract(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected []string
+	}{
+		{
+			line:     "mod 'acme/foo', :git => 'https://example.com/foo.git', :postextract => 'make'",
+			expected: []string{"make"},
+		}, {
+			line:     "mod 'acme/foo', :git => 'https://example.com/foo.git', :postextract => ['bundle install --path vendor', 'echo a, b'], :tag => 'v1'",
+			expected: []string{"bundle install --path vendor", "echo a, b"},
+		}, {
+			line: "mod 'acme/foo', '1.0.0'",
+		},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{}
+		m, err := pf.parseModule(c.line)
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m.PostExtract(), c.expected) {
+			t.Errorf("failed parsing %s, expected %v, got %v", c.line, c.expected, m.PostExtract())
+		}
+	}
+}
+
+func TestParseModuleNoCache(t *testing.T) {
+	defer func(refresh map[string]bool) { refreshModules = refresh }(refreshModules)
+	refreshModules = map[string]bool{"puppetlabs-ntp": true}
+
+	testCases := []struct {
+		line     string
+		expected bool
+	}{
+		{"mod 'acme/foo', :git => 'https://example.com/foo.git', :no_cache => true", true},
+		{"mod 'acme/foo', :tarball => 'https://example.com/foo.tar.gz', :version => '1.0.0'", false},
+		{"mod 'puppetlabs/ntp', '6.0.0'", true},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{}
+		m, err := pf.parseModule(c.line)
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.line, err)
+			continue
+		}
+
+		if m.NoCache() != c.expected {
+			t.Errorf("failed parsing %s, expected no_cache to be %t", c.line, c.expected)
+		}
+	}
+}
+
+func TestParseModuleResolveDeps(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected bool
+	}{
+		{"mod 'acme/foo', '1.0.0', :resolve_deps => false", true},
+		{"mod 'acme/foo', '1.0.0', :resolve_deps => true", false},
+		{"mod 'acme/foo', '1.0.0'", false},
+	}
+
+	for _, c := range testCases {
+		pf := PuppetFile{}
+		m, err := pf.parseModule(c.line)
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.line, err)
+			continue
+		}
+
+		if m.NoDeps() != c.expected {
+			t.Errorf("failed parsing %s, expected dependencies to be skipped: %t", c.line, c.expected)
+		}
+	}
+}
+
+func TestModuleOverrides(t *testing.T) {
+	defer func() { moduleOverrides = nil }()
+	moduleOverrides = map[string]map[string]string{
+		"puppetlabs-stdlib": {"git": "https://git.example.com/forks/stdlib.git", "tag": "v4.25.1"},
+	}
+
+	pf := PuppetFile{}
+	m, err := pf.parseModule("mod 'puppetlabs/stdlib', '4.25.0', :install_path => 'vendor'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gm, ok := m.(*GitModule)
+	if !ok {
+		t.Fatalf("expected the module to be replaced by a git module, got %T", m)
+	}
+	if gm.repoURL != "https://git.example.com/forks/stdlib.git" || gm.want.tag != "v4.25.1" || gm.installPath != "vendor" {
+		t.Errorf("failed overriding module, got %+v", gm)
+	}
+
+	mf := MetadataFile{wg: &sync.WaitGroup{}}
+	dep, _ := mf.dependency(metadataDependency{Name: "puppetlabs-stdlib"})
+	if _, ok := dep.(*GitModule); !ok {
+		t.Errorf("expected the dependency to be overridden")
+	}
+	dep, _ = mf.dependency(metadataDependency{Name: "puppetlabs-concat"})
+	if _, ok := dep.(*ForgeModule); !ok {
+		t.Errorf("expected the dependency to be downloaded from the Forge")
+	}
+}
+
+func TestFindPuppetfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"base.Puppetfile", "Puppetfile.web", "Puppetfile.lock", "README.md"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	puppetfiles, err := findPuppetfiles(dir)
+	if err != nil {
+		t.Fatalf("failed finding Puppetfiles: %v", err)
+	}
+
+	expected := []string{path.Join(dir, "Puppetfile.web"), path.Join(dir, "base.Puppetfile")}
+	if !reflect.DeepEqual(puppetfiles, expected) {
+		t.Errorf("expected %v, got %v", expected, puppetfiles)
+	}
+
+	if _, err := findPuppetfiles(path.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing folder")
+	}
+}
+
+func TestValidateStrictWarnings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	puppetfile := path.Join(dir, "Puppetfile")
+	if err := ioutil.WriteFile(puppetfile, []byte("mod 'puppetlabs/stdlib'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(n int32) { atomic.StoreInt32(&warningsCount, n) }(atomic.LoadInt32(&warningsCount))
+	atomic.StoreInt32(&warningsCount, 0)
+
+	if err := validatePuppetfiles([]string{puppetfile}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := exitCode(0, false); code != 0 {
+		t.Errorf("expected the unpinned module not to fail validate, got exit code %d", code)
+	}
+	if code := exitCode(0, true); code == 0 {
+		t.Errorf("expected the unpinned module to fail validate with --strict-warnings")
+	}
+}
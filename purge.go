@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Folders containing this file are not removed by --purge, for example
+// modules vendored in the control repository
+const keepMarker = ".r10k-keep"
+
+// keepFolder returns true if folder, relative to the environment root
+// as rel, must not be purged
+func keepFolder(folder, rel string, excludeSpec []string) bool {
+	if _, err := os.Stat(path.Join(folder, keepMarker)); err == nil {
+		return true
+	}
+
+	for _, pattern := range excludeSpec {
+		if match, err := filepath.Match(pattern, rel); err == nil && match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// purgeUnmanaged removes the folders of the module paths of the
+// environment, modulePath and those of modules with an install_path
+// within the environment, that are not modules of its Puppetfile, or one
+// of their dependencies, which are the keys of managed. Returns the
+// number of errors.
+func purgeUnmanaged(environmentRootFolder string, modulePath string, managed map[string]PuppetModule, excludeSpec []string) int {
+	if modulePath == "" {
+		modulePath = "modules"
+	}
+	if !path.IsAbs(modulePath) {
+		modulePath = path.Join(environmentRootFolder, modulePath)
+	}
+
+	modulePaths := map[string]bool{modulePath: true}
+	for folder := range managed {
+		// Modules installed at the root of the environment do not
+		// make it a module path, nor do those installed outside of it,
+		// in another environment for example
+		dir := path.Dir(folder)
+		if rel, err := filepath.Rel(environmentRootFolder, dir); err == nil && rel != "." && !outside(rel) {
+			modulePaths[dir] = true
+		}
+	}
+
+	nErr := 0
+	for modulePath := range modulePaths {
+		folders, err := ioutil.ReadDir(modulePath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("failed listing modules in %s: %v\n", modulePath, err)
+				nErr++
+			}
+			continue
+		}
+
+		for _, f := range folders {
+			folder := path.Join(modulePath, f.Name())
+			if _, ok := managed[folder]; !f.IsDir() || ok {
+				continue
+			}
+
+			rel, err := filepath.Rel(environmentRootFolder, folder)
+			if err != nil {
+				rel = folder
+			}
+			if keepFolder(folder, rel, excludeSpec) {
+				continue
+			}
+
+			if err := os.RemoveAll(folder); err != nil {
+				log.Printf("failed purging %s: %v\n", folder, err)
+				nErr++
+				continue
+			}
+			log.Printf("Purged %s\n", folder)
+		}
+	}
+
+	return nErr
+}
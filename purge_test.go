@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPurgeUnmanaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"modules/ntp", "modules/stale", "modules/vendored", "modules/excluded", "site/profile", "site/old", "manifests"} {
+		if err := os.MkdirAll(path.Join(dir, f), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "modules", "vendored", keepMarker), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	managed := map[string]PuppetModule{
+		path.Join(dir, "modules", "ntp"):   &ForgeModule{},
+		path.Join(dir, "site", "profile"):  &ForgeModule{},
+		path.Join(dir, "environment.conf"): &ForgeModule{},
+	}
+	if nErr := purgeUnmanaged(dir, "", managed, []string{"modules/exclu*"}); nErr != 0 {
+		t.Errorf("%d error(s) purging %s", nErr, dir)
+	}
+
+	expected := map[string]bool{
+		"modules/ntp": true, "modules/stale": false, "modules/vendored": true, "modules/excluded": true,
+		"site/profile": true, "site/old": false, "manifests": true,
+	}
+	for f, kept := range expected {
+		if _, err := os.Stat(path.Join(dir, f)); (err == nil) != kept {
+			t.Errorf("expected %s to be kept: %t", f, kept)
+		}
+	}
+}
+
+func TestPurgeOutsideEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"production/modules/ntp", "development/modules/ntp", "development/stale", "shared/apache", "shared/other"} {
+		if err := os.MkdirAll(path.Join(dir, f), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Modules installed with :install_path => '..', and an absolute path
+	env := path.Join(dir, "production")
+	managed := map[string]PuppetModule{
+		path.Join(env, "modules", "ntp"): &ForgeModule{},
+		path.Join(dir, "development"):    &ForgeModule{},
+		path.Join(dir, "shared/apache"):  &ForgeModule{},
+	}
+	if nErr := purgeUnmanaged(env, "", managed, nil); nErr != 0 {
+		t.Errorf("%d error(s) purging %s", nErr, env)
+	}
+
+	for _, f := range []string{"development/modules/ntp", "development/stale", "shared/other"} {
+		if _, err := os.Stat(path.Join(dir, f)); err != nil {
+			t.Errorf("expected %s, outside of the environment, to be kept", f)
+		}
+	}
+}
@@ -2,28 +2,122 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 )
 
+// Prefix of the environment variables overriding fields of r10k.yml
+const configEnvPrefix = "R10K_"
+
 type source struct {
-	Basedir string
-	Prefix  string
-	Remote  string
+	Basedir  string
+	Basedirs []string // Additional basedirs environments are mirrored to
+	Cachedir string   // Cache of the modules of the source, overrides the global one
+	Prefix   string
+	Remote   string
+}
+
+type deployConfig struct {
+	// Reason for which deployments are disabled, deployments are
+	// allowed when empty
+	WriteLock   string   `yaml:"write_lock"`
+	PurgeLevels []string `yaml:"purge_levels"`
+
+	// Number of commits of the history of environments fetched, all if 0
+	EnvDepth int `yaml:"env_depth"`
+
+	// Replacement of the characters of branches not valid in environment
+	// names, "_" if empty
+	EnvNameReplacement string `yaml:"env_name_replacement"`
+
+	// Owner of the files of modules, user:group. Same as --chown.
+	Chown string
+
+	// Octal permissions of the folders and files of modules installed
+	// from archives. Same as --dir-mode and --file-mode.
+	DirMode  string `yaml:"dir_mode"`
+	FileMode string `yaml:"file_mode"`
+
+	// Folders not removed by --purge, relative to the environment,
+	// modules/vendored-* for example
+	ExcludeSpec []string `yaml:"exclude_spec"`
+}
+
+// gitConfig configures how git modules and environments are cloned.
+// Only the shellgit provider, running the git command, is supported.
+type gitConfig struct {
+	Provider   string
+	Binary     string // Path of the git command, same as --git-binary
+	PrivateKey string `yaml:"private_key"` // SSH key used by git
+	Proxy      string // Proxy of git HTTP(S) remotes
+}
+
+// environmentOverride changes the modules of an environment: modules of
+// the Puppetfile fragment are added, or replace the modules of the
+// environment with the same name. Modules in Remove are not installed.
+type environmentOverride struct {
+	Puppetfile string
+	Remove     []string
+}
+
+// forgeConfig configures the Forge modules are downloaded from. baseurls
+// are tried in turn when one fails, after baseurl.
+type forgeConfig struct {
+	Baseurl  string
+	Baseurls []string
+}
+
+// urls returns the roots of the Forge APIs to use, ending with a /
+func (c forgeConfig) urls() []string {
+	var urls []string
+	for _, u := range append([]string{c.Baseurl}, c.Baseurls...) {
+		if u != "" {
+			urls = append(urls, strings.TrimSuffix(u, "/")+"/")
+		}
+	}
+
+	return urls
+}
+
+// githubConfig configures how GitHub tarball modules are downloaded
+type githubConfig struct {
+	// Roots of mirrors archives are downloaded from when GitHub fails
+	ArchiveMirrors []string `yaml:"archive_mirrors"`
 }
 
 type r10kConfig struct {
-	Cachedir string
-	Sources  map[string]source
+	Cachedir          string
+	KeepCacheVersions int `yaml:"keep_cache_versions"`
+	Sources           map[string]source
+	URLRewrites       []urlRewrite `yaml:"url_rewrites"`
+	Deploy            deployConfig
+	Credentials       map[string]credential
+	Overrides         map[string]environmentOverride // By environment name
+	Git               gitConfig
+	Forge             forgeConfig
+	Github            githubConfig
+
+	// Sources of modules replaced in all environments, by module name
+	ModuleOverrides map[string]map[string]string `yaml:"module_overrides"`
 }
 
+// NewR10kConfig parses the r10k configuration file filename, then
+// overrides its fields with the R10K_* environment variables. The file
+// is optional when such variables are set.
 func NewR10kConfig(filename string) (*r10kConfig, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		log.Fatalf("could not open %s: %v", filename, err)
+		if !os.IsNotExist(err) || !hasConfigEnv(os.Environ()) {
+			log.Fatalf("could not open %s: %v", filename, err)
+		}
+		return parseR10kConfig(strings.NewReader(""))
 	}
+	defer f.Close()
 
 	return parseR10kConfig(f)
 }
@@ -39,5 +133,122 @@ func parseR10kConfig(r io.Reader) (*r10kConfig, error) {
 		return nil, err
 	}
 
+	if err := overrideFromEnv(reflect.ValueOf(c).Elem(), configEnvPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	for _, level := range c.Deploy.PurgeLevels {
+		switch level {
+		case "deployment", "environment", "puppetfile":
+		default:
+			return nil, fmt.Errorf("unknown purge level %s", level)
+		}
+	}
+
+	switch c.Git.Provider {
+	case "", "shellgit":
+	case "rugged":
+		warnf("git provider rugged is not supported, using shellgit\n")
+	default:
+		return nil, fmt.Errorf("unknown git provider %s", c.Git.Provider)
+	}
+
+	if c.Deploy.EnvNameReplacement != "" && invalidEnvironmentChars.MatchString(c.Deploy.EnvNameReplacement) {
+		return nil, fmt.Errorf("env_name_replacement %s is not valid in environment names", c.Deploy.EnvNameReplacement)
+	}
+
+	for i := range c.URLRewrites {
+		if err := c.URLRewrites[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
+
+// hasConfigEnv returns true if one of the variables of environ, as
+// returned by os.Environ, overrides a field of r10k.yml
+func hasConfigEnv(environ []string) bool {
+	var names []string
+	configEnvNames(reflect.TypeOf(r10kConfig{}), configEnvPrefix, &names)
+
+	for _, v := range environ {
+		for _, name := range names {
+			if strings.HasPrefix(v, name+"=") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// configFieldName returns the name of a field in r10k.yml, its yaml tag
+// or its lowercased name as yaml.v2 does
+func configFieldName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("yaml"), ",")[0]; name != "" {
+		return name
+	}
+
+	return strings.ToLower(f.Name)
+}
+
+// configEnvNames appends the names of the environment variables
+// overriding the fields of the struct type t to names
+func configEnvNames(t reflect.Type, prefix string, names *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := prefix + strings.ToUpper(configFieldName(f))
+		if f.Type.Kind() == reflect.Struct {
+			configEnvNames(f.Type, name+"_", names)
+			continue
+		}
+		*names = append(*names, name)
+	}
+}
+
+// overrideFromEnv sets the fields of the struct v from the environment
+// variables named after their path in r10k.yml, R10K_FORGE_BASEURL for
+// forge: baseurl: for example. Strings are used as is, lists of strings
+// are comma separated, other values, like sources, are parsed as YAML.
+func overrideFromEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		f, field := v.Type().Field(i), v.Field(i)
+		name := prefix + strings.ToUpper(configFieldName(f))
+
+		if f.Type.Kind() == reflect.Struct {
+			if err := overrideFromEnv(field, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case f.Type.Kind() == reflect.String:
+			field.SetString(value)
+
+		case f.Type == reflect.TypeOf([]string{}):
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+
+		default:
+			parsed := reflect.New(f.Type)
+			if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+				return fmt.Errorf("invalid value of %s: %v", name, err)
+			}
+			field.Set(parsed.Elem())
+		}
+	}
+
+	return nil
+}
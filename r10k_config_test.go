@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverrideFromEnv(t *testing.T) {
+	c, err := parseR10kConfig(strings.NewReader("cachedir: /var/cache/r10k\nforge:\n  baseurl: https://forgeapi.puppetlabs.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"R10K_CACHEDIR":               "/cache",
+		"R10K_KEEP_CACHE_VERSIONS":    "3",
+		"R10K_FORGE_BASEURL":          "https://forge.example.com",
+		"R10K_DEPLOY_PURGE_LEVELS":    "deployment, puppetfile",
+		"R10K_DEPLOY_WRITE_LOCK":      "maintenance",
+		"R10K_SOURCES":                "{production: {remote: 'https://git.example.com/control.git', basedir: /etc/puppetlabs/code/environments}}",
+		"R10K_GITHUB_ARCHIVE_MIRRORS": "https://mirror.example.com/",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	if err := overrideFromEnv(reflect.ValueOf(c).Elem(), configEnvPrefix, lookup); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Cachedir != "/cache" || c.KeepCacheVersions != 3 || c.Forge.Baseurl != "https://forge.example.com" || c.Deploy.WriteLock != "maintenance" {
+		t.Errorf("scalar fields were not overridden: %+v", c)
+	}
+	if !reflect.DeepEqual(c.Deploy.PurgeLevels, []string{"deployment", "puppetfile"}) {
+		t.Errorf("expected purge levels deployment and puppetfile, got %v", c.Deploy.PurgeLevels)
+	}
+	if !reflect.DeepEqual(c.Github.ArchiveMirrors, []string{"https://mirror.example.com/"}) {
+		t.Errorf("expected an archive mirror, got %v", c.Github.ArchiveMirrors)
+	}
+	if s := c.Sources["production"]; s.Remote != "https://git.example.com/control.git" || s.Basedir != "/etc/puppetlabs/code/environments" {
+		t.Errorf("expected source production to be set, got %+v", c.Sources)
+	}
+
+	env = map[string]string{"R10K_KEEP_CACHE_VERSIONS": "many"}
+	if err := overrideFromEnv(reflect.ValueOf(c).Elem(), configEnvPrefix, lookup); err == nil {
+		t.Errorf("expected an error for an invalid number")
+	}
+}
+
+func TestHasConfigEnv(t *testing.T) {
+	if !hasConfigEnv([]string{"HOME=/root", "R10K_GIT_PROXY=http://proxy:3128"}) {
+		t.Errorf("expected R10K_GIT_PROXY to override r10k.yml")
+	}
+	if hasConfigEnv([]string{"R10K_MODULE_NAME=apache"}) {
+		t.Errorf("expected R10K_MODULE_NAME not to override r10k.yml")
+	}
+}
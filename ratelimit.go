@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Below this number of remaining requests, requests to the GitHub API
+// are spread until the rate limit is reset
+const lowRateLimit = 10
+
+// rateLimiter paces the requests of all workers to an API, using the
+// rate limit reported in the X-RateLimit-* headers of its responses
+type rateLimiter struct {
+	mu        sync.Mutex
+	remaining int       // Requests left until reset, -1 if unknown
+	reset     time.Time // When the rate limit is reset
+	inFlight  int       // Requests sent, whose response is not known yet
+	last      time.Time // When the last request was sent
+	warned    time.Time // Reset the last warning was logged for
+}
+
+// Requests of GitHub tarball modules to the GitHub API
+var githubLimiter = rateLimiter{remaining: -1}
+
+// delay returns how long to wait before sending a request, 0 if it can
+// be sent now, in which case it is recorded as in flight
+func (l *rateLimiter) delay(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.remaining >= 0 && !now.Before(l.reset) {
+		l.remaining = -1
+	}
+
+	var d time.Duration
+	switch left := l.remaining - l.inFlight; {
+	case l.remaining < 0 || left > lowRateLimit:
+	case left <= 0:
+		d = l.reset.Sub(now)
+	default:
+		// What is left is spread until the reset
+		d = l.last.Add(l.reset.Sub(now) / time.Duration(left+1)).Sub(now)
+	}
+
+	if d > 0 {
+		return d
+	}
+
+	l.inFlight++
+	l.last = now
+	return 0
+}
+
+// wait blocks until a request can be sent without exceeding the rate
+// limit, or the run is cancelled
+func (l *rateLimiter) wait() {
+	for {
+		d := l.delay(time.Now())
+		if d == 0 {
+			return
+		}
+
+		l.mu.Lock()
+		if l.remaining-l.inFlight <= 0 && !l.warned.Equal(l.reset) {
+			l.warned = l.reset
+			log.Printf("GitHub API rate limit reached, waiting %s until it is reset\n", d-d%time.Second)
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(d):
+		case <-runContext.Done():
+			return
+		}
+	}
+}
+
+// update records the rate limit reported by the response of a request
+// sent after wait, resp is nil if the request failed
+func (l *rateLimiter) update(resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight > 0 {
+		l.inFlight--
+	}
+	if resp == nil {
+		return
+	}
+
+	// Secondary rate limits only tell how long to wait
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && resp.StatusCode >= 400 {
+		l.remaining, l.reset = 0, time.Now().Add(time.Duration(seconds)*time.Second)
+		return
+	}
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	l.remaining, l.reset = remaining, time.Unix(reset, 0)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	reset := now.Add(time.Minute)
+
+	response := func(remaining int) *http.Response {
+		h := http.Header{}
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		return &http.Response{StatusCode: http.StatusOK, Header: h}
+	}
+
+	l := rateLimiter{remaining: -1}
+
+	// Requests are not delayed while the rate limit is unknown or high
+	if d := l.delay(now); d != 0 {
+		t.Errorf("expected no delay with an unknown rate limit, got %s", d)
+	}
+	l.update(response(100))
+	if d := l.delay(now); d != 0 {
+		t.Errorf("expected no delay with 100 requests left, got %s", d)
+	}
+	l.update(response(5))
+
+	// With few requests left, they are spread until the reset
+	if d := l.delay(now); d <= 0 || d > 10*time.Second {
+		t.Errorf("expected the next request to be delayed by up to 10s, got %s", d)
+	}
+	if d := l.delay(now.Add(10 * time.Second)); d != 0 {
+		t.Errorf("expected the request to be sent after 10s, got a delay of %s", d)
+	}
+	l.update(response(0))
+
+	// Once exhausted, requests wait for the reset
+	if d := l.delay(now); d < 59*time.Second || d > time.Minute {
+		t.Errorf("expected requests to wait for the reset, got %s", d)
+	}
+	if d := l.delay(reset); d != 0 {
+		t.Errorf("expected no delay once the rate limit is reset, got %s", d)
+	}
+}
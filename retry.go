@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Number of retries left for failed downloads across all modules, set
+// with --retry-budget. Unlimited if negative.
+var retryBudget int64 = -1
+
+var (
+	retriesTaken         int64
+	retryBudgetExhausted sync.Once
+)
+
+// takeRetry returns true if a failed download can be retried, consuming
+// one retry of the budget. Once the budget is exhausted, for example
+// because a server is down, downloads fail without being retried.
+func takeRetry() bool {
+	if retryBudget < 0 || atomic.AddInt64(&retriesTaken, 1) <= retryBudget {
+		return true
+	}
+
+	retryBudgetExhausted.Do(func() {
+		warnf("retry budget exhausted, failed downloads are not retried anymore\n")
+	})
+	return false
+}
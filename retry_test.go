@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestTakeRetry(t *testing.T) {
+	defer func(budget int64) { retryBudget = budget }(retryBudget)
+
+	retryBudget, retriesTaken = 2, 0
+	for i, expected := range []bool{true, true, false, false} {
+		if actual := takeRetry(); actual != expected {
+			t.Errorf("expected retry %d to be allowed: %t, got %t", i+1, expected, actual)
+		}
+	}
+
+	retryBudget = -1
+	if !takeRetry() {
+		t.Error("expected retries to be unlimited with a negative budget")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// urlRewrite replaces the part of module URLs matching the Match regular
+// expression with Replace, which can reference submatches as $1, ${name}...
+type urlRewrite struct {
+	Match   string
+	Replace string
+	re      *regexp.Regexp
+}
+
+// Rules applied to the URLs of all modules before downloading them
+var urlRewrites []urlRewrite
+
+func (r *urlRewrite) compile() error {
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("invalid url rewrite %s: %v", r.Match, err)
+	}
+
+	r.re = re
+	return nil
+}
+
+// rewriteURL applies the first rewrite rule matching url
+func rewriteURL(url string) string {
+	for _, r := range urlRewrites {
+		if r.re.MatchString(url) {
+			return r.re.ReplaceAllString(url, r.Replace)
+		}
+	}
+
+	return url
+}
+
+// Protocol git remotes are converted to with --git-protocol, https
+// or ssh. Remotes are used unchanged when empty.
+var gitProtocol string
+
+// Remotes with a port are not matched, the port of a protocol says
+// nothing of the port of the other one
+var (
+	sshRemote   = regexp.MustCompile(`^(?:ssh://git@([^:/]+)/|git@([^:/]+):)(.+)$`)
+	httpsRemote = regexp.MustCompile(`^https?://(?:[^@/]+@)?([^:/]+)/(.+)$`)
+	scpRemote   = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+)
+
+// convertGitProtocol converts git@host:org/repo.git remotes to
+// https://host/org/repo.git, or the other way around, depending on
+// gitProtocol. Other remotes, local paths or remotes with a port for
+// example, are unchanged.
+func convertGitProtocol(remote string) string {
+	switch gitProtocol {
+	case "https":
+		if m := sshRemote.FindStringSubmatch(remote); m != nil {
+			return "https://" + m[1] + m[2] + "/" + m[3]
+		}
+	case "ssh":
+		if m := httpsRemote.FindStringSubmatch(remote); m != nil {
+			return "git@" + m[1] + ":" + m[2]
+		}
+	}
+
+	return remote
+}
+
+// normalizeGitRemote returns the remote without its protocol, user and
+// .git suffix, so that https://github.com/org/repo.git and
+// git@github.com:org/repo both become github.com/org/repo. Modules
+// whose remotes are the same once normalized share their cache.
+func normalizeGitRemote(remote string) string {
+	r := strings.TrimSpace(remote)
+
+	if u, err := url.Parse(r); err == nil && (u.Host != "" || u.Scheme == "file") {
+		r = strings.ToLower(u.Host) + u.Path
+	} else if m := scpRemote.FindStringSubmatch(r); m != nil {
+		r = strings.ToLower(m[1]) + "/" + strings.TrimPrefix(m[2], "/")
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(r, "/"), ".git")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteURL(t *testing.T) {
+	config := `
+url_rewrites:
+  - match: '^https://github\.com/(.*)$'
+    replace: 'https://mirror.example.com/github/$1'
+  - match: '^https://github\.com/'
+    replace: 'https://unused.example.com/'
+`
+	c, err := parseR10kConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("failed parsing configuration: %v", err)
+	}
+
+	urlRewrites = c.URLRewrites
+	defer func() { urlRewrites = nil }()
+
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"https://github.com/puppetlabs/puppetlabs-apt.git", "https://mirror.example.com/github/puppetlabs/puppetlabs-apt.git"},
+		{"https://forgeapi.puppetlabs.com/v3/releases", "https://forgeapi.puppetlabs.com/v3/releases"},
+	}
+
+	for _, c := range testCases {
+		if actual := rewriteURL(c.url); actual != c.expected {
+			t.Errorf("failed rewriting %s, expected %s, got %s", c.url, c.expected, actual)
+		}
+	}
+
+	if _, err := parseR10kConfig(strings.NewReader("url_rewrites:\n  - match: '('\n")); err == nil {
+		t.Error("expected an error parsing an invalid url rewrite")
+	}
+}
+
+func TestConvertGitProtocol(t *testing.T) {
+	defer func() { gitProtocol = "" }()
+
+	testCases := []struct {
+		protocol string
+		remote   string
+		expected string
+	}{
+		{"https", "git@github.com:puppetlabs/puppetlabs-apt.git", "https://github.com/puppetlabs/puppetlabs-apt.git"},
+		{"https", "ssh://git@github.com/puppetlabs/puppetlabs-apt.git", "https://github.com/puppetlabs/puppetlabs-apt.git"},
+		{"https", "https://github.com/puppetlabs/puppetlabs-apt.git", "https://github.com/puppetlabs/puppetlabs-apt.git"},
+		{"ssh", "https://github.com/puppetlabs/puppetlabs-apt.git", "git@github.com:puppetlabs/puppetlabs-apt.git"},
+		{"ssh", "git@github.com:puppetlabs/puppetlabs-apt.git", "git@github.com:puppetlabs/puppetlabs-apt.git"},
+		{"ssh", "/srv/git/puppetlabs-apt", "/srv/git/puppetlabs-apt"},
+		{"https", "ssh://git@git.example.com:2222/puppet/apt.git", "ssh://git@git.example.com:2222/puppet/apt.git"},
+		{"ssh", "https://git.example.com:8443/puppet/apt.git", "https://git.example.com:8443/puppet/apt.git"},
+		{"", "git@github.com:puppetlabs/puppetlabs-apt.git", "git@github.com:puppetlabs/puppetlabs-apt.git"},
+	}
+
+	for _, c := range testCases {
+		gitProtocol = c.protocol
+		if actual := convertGitProtocol(c.remote); actual != c.expected {
+			t.Errorf("failed converting %s to %s, expected %s, got %s", c.remote, c.protocol, c.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeGitRemote(t *testing.T) {
+	testCases := []struct {
+		remote   string
+		expected string
+	}{
+		{"https://github.com/puppetlabs/puppetlabs-apt.git", "github.com/puppetlabs/puppetlabs-apt"},
+		{"https://user@GitHub.com/puppetlabs/puppetlabs-apt/", "github.com/puppetlabs/puppetlabs-apt"},
+		{"git@github.com:puppetlabs/puppetlabs-apt.git", "github.com/puppetlabs/puppetlabs-apt"},
+		{"ssh://git@github.com/puppetlabs/puppetlabs-apt", "github.com/puppetlabs/puppetlabs-apt"},
+		{"git://github.com/puppetlabs/puppetlabs-apt.git", "github.com/puppetlabs/puppetlabs-apt"},
+		{"ssh://git@git.example.com:2222/puppet/apt.git", "git.example.com:2222/puppet/apt"},
+		{"file:///srv/git/puppetlabs-apt.git", "/srv/git/puppetlabs-apt"},
+		{"/srv/git/puppetlabs-apt", "/srv/git/puppetlabs-apt"},
+	}
+
+	for _, c := range testCases {
+		if actual := normalizeGitRemote(c.remote); actual != c.expected {
+			t.Errorf("failed normalizing %s, expected %s, got %s", c.remote, c.expected, actual)
+		}
+	}
+}
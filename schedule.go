@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// cachedSize returns the size of the module in the cache, from a previous
+// run, or 0 if unknown. The time to install a module grows with it.
+func cachedSize(m PuppetModule) int64 {
+	if a, ok := m.(archived); ok {
+		if fi, err := os.Stat(a.archive()); err == nil {
+			return fi.Size()
+		}
+		return 0
+	}
+
+	// Objects of git repositories are mostly in packs
+	packs, err := ioutil.ReadDir(path.Join(m.CacheFolder(), ".git", "objects", "pack"))
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, p := range packs {
+		size += p.Size()
+	}
+
+	return size
+}
+
+// scheduleBySize forwards modules from in to out, largest first, so that
+// the largest modules start installing first and small ones fill the
+// tail of the run. Modules of unknown size keep their order, after the
+// others. out is closed once in is.
+func scheduleBySize(in <-chan PuppetModule, out chan<- PuppetModule, size func(PuppetModule) int64) {
+	type sized struct {
+		m    PuppetModule
+		size int64
+	}
+	var queue []sized
+
+	for in != nil || len(queue) > 0 {
+		var send chan<- PuppetModule
+		var next PuppetModule
+		if len(queue) > 0 {
+			send, next = out, queue[0].m
+		}
+
+		select {
+		case m, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			s := sized{m, size(m)}
+			i := len(queue)
+			for i > 0 && queue[i-1].size < s.size {
+				i--
+			}
+			queue = append(queue, sized{})
+			copy(queue[i+1:], queue[i:])
+			queue[i] = s
+
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+
+	close(out)
+}
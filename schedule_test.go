@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestScheduleBySize(t *testing.T) {
+	sizes := map[string]int64{"small": 10, "large": 1000, "medium": 100}
+	size := func(m PuppetModule) int64 { return sizes[m.Name()] }
+
+	in, out := make(chan PuppetModule), make(chan PuppetModule)
+	go scheduleBySize(in, out, size)
+
+	// All modules are queued before the first is installed
+	for _, name := range []string{"small", "unknown1", "large", "unknown2", "medium"} {
+		in <- &ForgeModule{baseModule: baseModule{name: name}}
+	}
+	close(in)
+
+	var order []string
+	for m := range out {
+		order = append(order, m.Name())
+	}
+
+	expected := []string{"large", "medium", "small", "unknown1", "unknown2"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, order)
+			break
+		}
+	}
+}
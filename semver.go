@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Whether prereleases, 1.0.0-rc1 for example, can be picked as the
+// latest version of a module
+var allowPrerelease bool
+
+// semver is a semantic version, see https://semver.org
+type semver struct {
+	version    [3]int
+	prerelease string
+}
+
+// parseSemver parses versions like 1.2.3, v1.2.3-rc.1 or 1.2. Build
+// metadata is ignored. ok is false if s is not a semantic version.
+func parseSemver(s string) (v semver, ok bool) {
+	s = strings.TrimPrefix(s, "v")
+	s = strings.SplitN(s, "+", 2)[0]
+
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.prerelease = s[i+1:]
+		s = s[:i]
+		if v.prerelease == "" {
+			return v, false
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.version[i] = n
+	}
+
+	return v, true
+}
+
+// less returns true if v precedes w
+func (v semver) less(w semver) bool {
+	for i := range v.version {
+		if v.version[i] != w.version[i] {
+			return v.version[i] < w.version[i]
+		}
+	}
+
+	// A prerelease precedes the release
+	switch {
+	case v.prerelease == w.prerelease:
+		return false
+	case v.prerelease == "":
+		return false
+	case w.prerelease == "":
+		return true
+	}
+
+	vIDs, wIDs := strings.Split(v.prerelease, "."), strings.Split(w.prerelease, ".")
+	for i := 0; i < len(vIDs) && i < len(wIDs); i++ {
+		if vIDs[i] == wIDs[i] {
+			continue
+		}
+
+		vn, verr := strconv.Atoi(vIDs[i])
+		wn, werr := strconv.Atoi(wIDs[i])
+		switch {
+		case verr == nil && werr == nil:
+			return vn < wn
+		case verr == nil:
+			return true // Numeric identifiers precede alphanumeric ones
+		case werr == nil:
+			return false
+		default:
+			return vIDs[i] < wIDs[i]
+		}
+	}
+
+	return len(vIDs) < len(wIDs)
+}
+
+// latestVersion returns the index of the highest version in versions,
+// prereleases are ignored unless allowPrerelease is set. ok is false if
+// none of the versions is a semantic version.
+func latestVersion(versions []string) (index int, ok bool) {
+	index, ok, _ = latestMatching(versions, "")
+	return index, ok
+}
+
+// latestMatching returns the index of the highest version in versions
+// satisfying the requirement. Versions that are not semantic versions
+// are ignored, so are prereleases unless allowPrerelease is set.
+func latestMatching(versions []string, requirement string) (index int, ok bool, err error) {
+	var latest semver
+
+	for i, s := range versions {
+		v, isSemver := parseSemver(s)
+		if !isSemver || (v.prerelease != "" && !allowPrerelease) {
+			continue
+		}
+
+		match, err := v.satisfies(requirement)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if match && (!ok || latest.less(v)) {
+			latest, index, ok = v, i, true
+		}
+	}
+
+	return index, ok, nil
+}
+
+// isVersionRange returns true if version is a requirement such as
+// "~> 2.1" or ">= 1.0.0 < 2.0.0", rather than a single version
+func isVersionRange(version string) bool {
+	if strings.ContainsAny(version, "<>=~ ") {
+		return true
+	}
+
+	for _, p := range strings.Split(version, ".") {
+		if p == "x" || p == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// satisfies returns true if v matches the version requirement, as used
+// in metadata.json: ">= 4.7.0 < 7.0.0", "4.x" or "1.2.3" for example.
+// "~> 2.1" matches versions from 2.1 up to 3.0 excluded.
+func (v semver) satisfies(requirement string) (bool, error) {
+	// Operators can be separated from their version by spaces
+	fields := strings.Fields(requirement)
+	constraints := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		c := fields[i]
+		if strings.Trim(c, "<>=~") == "" && i+1 < len(fields) {
+			i++
+			c += fields[i]
+		}
+		constraints = append(constraints, c)
+	}
+
+	for _, c := range constraints {
+		version := strings.TrimLeft(c, "<>=~")
+		op := c[:len(c)-len(version)]
+
+		// 4.x matches all 4 versions, 4.2.x all 4.2 ones
+		wildcard := -1
+		parts := strings.Split(version, ".")
+		for i, p := range parts {
+			if p == "x" || p == "*" {
+				wildcard = i
+				parts = parts[:i]
+				break
+			}
+		}
+
+		w, ok := parseSemver(strings.Join(parts, "."))
+		if !ok && wildcard != 0 {
+			return false, fmt.Errorf("invalid version requirement %s", requirement)
+		}
+
+		var match bool
+		switch {
+		case wildcard == 0:
+			match = true
+		case wildcard > 0 && (op == "" || op == "="):
+			next := w
+			next.version[wildcard-1]++
+			match = !v.less(w) && v.less(next)
+		case op == "~>":
+			// The last component given may increase: ~> 2.1 is < 3.0
+			// and ~> 2.1.3 < 2.2.0
+			next := semver{version: w.version}
+			if len(parts) > 1 {
+				next.version[len(parts)-2]++
+				for i := len(parts) - 1; i < len(next.version); i++ {
+					next.version[i] = 0
+				}
+			} else {
+				next.version[0]++
+			}
+			match = !v.less(w) && v.less(next)
+		case op == ">=":
+			match = !v.less(w)
+		case op == ">":
+			match = w.less(v)
+		case op == "<=":
+			match = !w.less(v)
+		case op == "<":
+			match = v.less(w)
+		case op == "" || op == "=":
+			match = !v.less(w) && !w.less(v)
+		default:
+			return false, fmt.Errorf("invalid version requirement %s", requirement)
+		}
+
+		if !match {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestLatestVersion(t *testing.T) {
+	testCases := []struct {
+		versions        []string
+		allowPrerelease bool
+		expected        int
+		expectedOk      bool
+	}{
+		{[]string{"v1.2.0", "v1.10.0", "v1.9.3"}, false, 1, true},
+		{[]string{"1.0.0", "2.0.0-rc1", "1.1.0"}, false, 2, true},
+		{[]string{"1.0.0", "2.0.0-rc1", "1.1.0"}, true, 1, true},
+		{[]string{"2.0.0-rc.2", "2.0.0-rc.10", "2.0.0-beta"}, true, 1, true},
+		{[]string{"2.0.0", "2.0.0-rc.10"}, true, 0, true},
+		{[]string{"nightly", "v1.0", "stable"}, false, 1, true},
+		{[]string{"nightly", "stable"}, false, 0, false},
+		{[]string{}, false, 0, false},
+	}
+
+	defer func() { allowPrerelease = false }()
+
+	for _, c := range testCases {
+		allowPrerelease = c.allowPrerelease
+		index, ok := latestVersion(c.versions)
+		if ok != c.expectedOk || index != c.expected {
+			t.Errorf("failed finding the latest version of %v, expected %d, got %d", c.versions, c.expected, index)
+		}
+	}
+}
+
+func TestSatisfies(t *testing.T) {
+	testCases := []struct {
+		version     string
+		requirement string
+		expected    bool
+	}{
+		{"6.4.2", ">= 4.7.0 < 7.0.0", true},
+		{"7.0.0", ">= 4.7.0 < 7.0.0", false},
+		{"4.6.9", ">=4.7.0 <7.0.0", false},
+		{"6.4.2", "6.x", true},
+		{"6.4.2", "6.3.x", false},
+		{"6.4.2", "6.4.2", true},
+		{"6.4.2", "> 6.4.2", false},
+		{"6.4.2", "<= 6.4.2", true},
+		{"2.9.0", "~> 2.1", true},
+		{"3.0.0", "~> 2.1", false},
+		{"2.0.9", "~>2.1", false},
+		{"2.1.9", "~> 2.1.3", true},
+		{"2.2.0", "~> 2.1.3", false},
+	}
+
+	for _, c := range testCases {
+		v, _ := parseSemver(c.version)
+		actual, err := v.satisfies(c.requirement)
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", c.requirement, err)
+		} else if actual != c.expected {
+			t.Errorf("expected %s satisfying %s to be %t", c.version, c.requirement, c.expected)
+		}
+	}
+}
+
+func TestLatestMatching(t *testing.T) {
+	testCases := []struct {
+		versions    []string
+		requirement string
+		expected    int
+		expectedOk  bool
+	}{
+		{[]string{"v2.0.0", "v2.1.0", "v2.4.1", "v3.0.0", "latest"}, "~> 2.1", 2, true},
+		{[]string{"v2.0.0", "v2.1.0", "v2.4.1", "v3.0.0"}, ">= 2.1.0 < 2.4.0", 1, true},
+		{[]string{"v2.0.0", "v3.0.0-rc1"}, "~> 3.0", 0, false},
+		{[]string{"nightly"}, "~> 1.0", 0, false},
+	}
+
+	for _, c := range testCases {
+		index, ok, err := latestMatching(c.versions, c.requirement)
+		if err != nil || ok != c.expectedOk || index != c.expected {
+			t.Errorf("failed finding the latest version of %v matching %s, expected %d, got %d (%v)", c.versions, c.requirement, c.expected, index, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Maximum size of downloaded archives, and of their extracted content,
+// in bytes. Unlimited if 0.
+var (
+	maxArchiveSize   int64
+	maxExtractedSize int64
+)
+
+// ErrTooLarge is returned when an archive, or its content, is larger
+// than allowed. Retrying can not succeed.
+type ErrTooLarge struct {
+	what  string
+	limit int64
+}
+
+func (e ErrTooLarge) Error() string {
+	return fmt.Sprintf("%s is larger than the maximum of %d bytes", e.what, e.limit)
+}
+
+// parseSize parses a number of bytes, optionally followed by K, M or G
+func parseSize(s string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+
+	number := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for suffix, m := range units {
+		if strings.HasSuffix(number, suffix) {
+			number, multiplier = strings.TrimSuffix(number, suffix), m
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+
+	return n * multiplier, nil
+}
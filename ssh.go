@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Policies for the verification of the keys of SSH hosts git connects
+// to, see StrictHostKeyChecking in ssh_config(5)
+const (
+	hostKeyAcceptNew = "accept-new" // Keys of new hosts are added, changed keys are refused
+	hostKeyYes       = "yes"        // Only hosts in known_hosts are accepted
+	hostKeyNo        = "no"         // Any key is accepted, insecure
+)
+
+// gitSSHCommand returns the ssh command git runs, verifying host keys
+// with the given policy, against knownHosts if not empty. Only the key
+// privateKey is offered to servers if it is not empty.
+func gitSSHCommand(policy, knownHosts, privateKey string) (string, error) {
+	switch policy {
+	case hostKeyAcceptNew, hostKeyYes:
+	case hostKeyNo:
+		warnf("SSH host keys are not verified, connections to git servers can be intercepted\n")
+	default:
+		return "", fmt.Errorf("unknown host key policy %s, should be one of accept-new, yes or no", policy)
+	}
+
+	cmd := "ssh -o StrictHostKeyChecking=" + policy
+	if knownHosts != "" {
+		cmd += " -o UserKnownHostsFile=" + shellQuote(knownHosts)
+	}
+	if privateKey != "" {
+		cmd += " -o IdentitiesOnly=yes -i " + shellQuote(privateKey)
+	}
+
+	return cmd, nil
+}
+
+// shellQuote quotes s to be used as a single argument of a shell command
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// setupGitSSH sets the ssh command of git commands run by r10k-go. A
+// GIT_SSH_COMMAND set by the user is kept, unless explicit is true.
+func setupGitSSH(policy, knownHosts, privateKey string, explicit bool) error {
+	if os.Getenv("GIT_SSH_COMMAND") != "" && !explicit {
+		return nil
+	}
+
+	cmd, err := gitSSHCommand(policy, knownHosts, privateKey)
+	if err != nil {
+		return err
+	}
+
+	return os.Setenv("GIT_SSH_COMMAND", cmd)
+}
+
+// setupGitProxy sets the proxy git connects to HTTP(S) remotes through.
+// Other downloads do not use it, see gitCmd.
+func setupGitProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy %s, should be a URL like http://proxy:3128", proxy)
+	}
+
+	gitProxy = proxy
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGitSSHCommand(t *testing.T) {
+	testCases := []struct {
+		policy, knownHosts, privateKey string
+		expected                       string
+		expectedError                  bool
+	}{
+		{"accept-new", "", "", "ssh -o StrictHostKeyChecking=accept-new", false},
+		{"yes", "/etc/r10k/known_hosts", "", "ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile='/etc/r10k/known_hosts'", false},
+		{"yes", "/tmp/it's", "", `ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile='/tmp/it'\''s'`, false},
+		{"accept-new", "", "/etc/r10k/id_rsa", "ssh -o StrictHostKeyChecking=accept-new -o IdentitiesOnly=yes -i '/etc/r10k/id_rsa'", false},
+		{"maybe", "", "", "", true},
+	}
+
+	for _, c := range testCases {
+		actual, err := gitSSHCommand(c.policy, c.knownHosts, c.privateKey)
+		if (err != nil) != c.expectedError || actual != c.expected {
+			t.Errorf("expected ssh command %s for %s, got %s (%v)", c.expected, c.policy, actual, err)
+		}
+	}
+}
+
+func TestSetupGitProxyInvalid(t *testing.T) {
+	for _, proxy := range []string{"proxy:3128", "://proxy", "http://"} {
+		if err := setupGitProxy(proxy); err == nil {
+			t.Errorf("expected an error setting up proxy %s", proxy)
+		}
+	}
+}
+
+func TestSetupGitProxy(t *testing.T) {
+	defer func(proxy string) { gitProxy = proxy }(gitProxy)
+	defer os.Setenv("https_proxy", os.Getenv("https_proxy"))
+	os.Unsetenv("https_proxy")
+
+	if err := setupGitProxy("http://proxy:3128"); err != nil {
+		t.Fatal(err)
+	}
+
+	if proxy := os.Getenv("https_proxy"); proxy != "" {
+		t.Errorf("expected the proxy of git not to be used by other downloads, https_proxy is %s", proxy)
+	}
+
+	cmd := gitCmd("ls-remote", "https://github.com/puppetlabs/puppetlabs-stdlib.git")
+	expected := []string{gitBinary, "-c", "http.proxy=http://proxy:3128", "ls-remote", "https://github.com/puppetlabs/puppetlabs-stdlib.git"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("expected git to be run as %v, got %v", expected, cmd.Args)
+	}
+}
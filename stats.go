@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runStats are the counters of a run, displayed with --stats
+type runStats struct {
+	downloaded   int64
+	skipped      int64
+	failed       int64
+	bytes        int64 // Downloaded over HTTP
+	downloadTime int64 // Cumulated time spent downloading modules, in ns
+}
+
+var stats runStats
+
+func (s *runStats) print(elapsed time.Duration) {
+	downloaded := atomic.LoadInt64(&s.downloaded)
+	skipped := atomic.LoadInt64(&s.skipped)
+	failed := atomic.LoadInt64(&s.failed)
+
+	log.Printf("%d modules: %d downloaded, %d up to date, %d failed\n",
+		downloaded+skipped+failed, downloaded, skipped, failed)
+	log.Printf("%d bytes transferred, %v spent downloading, finished in %v\n",
+		atomic.LoadInt64(&s.bytes), time.Duration(atomic.LoadInt64(&s.downloadTime)), elapsed)
+}
+
+// metrics returns the counters of a run with nErr errors in the
+// Prometheus text exposition format, labelled with the environment
+func (s *runStats) metrics(environment string, elapsed time.Duration, nErr int) []byte {
+	downloaded := atomic.LoadInt64(&s.downloaded)
+	skipped := atomic.LoadInt64(&s.skipped)
+	failed := atomic.LoadInt64(&s.failed)
+
+	success := 1
+	if nErr > 0 {
+		success = 0
+	}
+
+	label := fmt.Sprintf(`{environment="%s"}`, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(environment))
+
+	var b bytes.Buffer
+	for _, m := range []struct {
+		name, help string
+		value      interface{}
+	}{
+		{"r10k_modules_total", "Modules installed or up to date, and failed", downloaded + skipped + failed},
+		{"r10k_modules_failed", "Modules that failed to install", failed},
+		{"r10k_deploy_duration_seconds", "Duration of the run", elapsed.Seconds()},
+		{"r10k_bytes_downloaded", "Bytes downloaded over HTTP", atomic.LoadInt64(&s.bytes)},
+		{"r10k_deploy_success", "1 if the run succeeded, 0 otherwise", success},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s%s %v\n", m.name, m.help, m.name, m.name, label, m.value)
+	}
+
+	return b.Bytes()
+}
+
+// saveMetrics writes the metrics of a run with nErr errors to file, for
+// the textfile collector of node_exporter. The file is replaced
+// atomically. Returns the number of errors.
+func saveMetrics(file string, environment string, elapsed time.Duration, nErr int) int {
+	// The collector ignores files without the .prom extension
+	if err := ioutil.WriteFile(file+".part", stats.metrics(environment, elapsed, nErr), 0644); err != nil {
+		log.Printf("failed writing metrics %s: %v\n", file, err)
+		return 1
+	}
+
+	if err := os.Rename(file+".part", file); err != nil {
+		log.Printf("failed writing metrics %s: %v\n", file, err)
+		return 1
+	}
+
+	return 0
+}
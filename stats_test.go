@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s := runStats{downloaded: 3, skipped: 5, failed: 1, bytes: 2048}
+	metrics := string(s.metrics(`prod"uction`, 90*time.Second, 1))
+
+	for _, expected := range []string{
+		"# TYPE r10k_modules_total gauge\nr10k_modules_total{environment=\"prod\\\"uction\"} 9\n",
+		"r10k_modules_failed{environment=\"prod\\\"uction\"} 1\n",
+		"r10k_deploy_duration_seconds{environment=\"prod\\\"uction\"} 90\n",
+		"r10k_bytes_downloaded{environment=\"prod\\\"uction\"} 2048\n",
+		"r10k_deploy_success{environment=\"prod\\\"uction\"} 0\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", expected, metrics)
+		}
+	}
+}
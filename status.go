@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// progress tracks the modules being installed, served as JSON with
+// --status-addr
+type progress struct {
+	mu          sync.Mutex
+	total       int // Modules known so far, declared or required by another module
+	pendingDeps int // Installed modules whose dependencies are not known yet
+	queued      int
+	downloading map[string]int // Modules of the same name may be installed to several folders
+	done        int
+	failed      int
+}
+
+var status = progress{downloading: make(map[string]int)}
+
+// declare adds n modules, parsed from a Puppetfile or the dependencies
+// of a module, to the total
+func (p *progress) declare(n int) {
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// drop removes a module from the total, installed already as it was
+// declared several times
+func (p *progress) drop() {
+	p.mu.Lock()
+	p.total--
+	p.mu.Unlock()
+}
+
+// expectDeps records a module whose dependencies are being resolved,
+// which may increase the total
+func (p *progress) expectDeps() {
+	p.mu.Lock()
+	p.pendingDeps++
+	p.mu.Unlock()
+}
+
+// resolveDeps records that the dependencies of a module were added
+func (p *progress) resolveDeps() {
+	p.mu.Lock()
+	p.pendingDeps--
+	p.mu.Unlock()
+}
+
+// queue records a module waiting for a worker
+func (p *progress) queue() {
+	p.mu.Lock()
+	p.queued++
+	p.mu.Unlock()
+}
+
+// start records a module picked up by a worker. A module is started
+// once, it stays downloading while its download is retried.
+func (p *progress) start(name string) {
+	p.mu.Lock()
+	p.queued--
+	p.downloading[name]++
+	p.mu.Unlock()
+}
+
+// finish records a module that was installed, or failed to
+func (p *progress) finish(name string, failed bool) {
+	p.mu.Lock()
+	if p.downloading[name]--; p.downloading[name] <= 0 {
+		delete(p.downloading, name)
+	}
+	if failed {
+		p.failed++
+	} else {
+		p.done++
+	}
+	p.mu.Unlock()
+}
+
+type progressSnapshot struct {
+	Total       int      `json:"total"`
+	DepsPending int      `json:"deps_pending"`
+	Queued      int      `json:"queued"`
+	Downloading []string `json:"downloading"`
+	Done        int      `json:"done"`
+	Failed      int      `json:"failed"`
+}
+
+func (p *progress) snapshot() progressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := progressSnapshot{Total: p.total, DepsPending: p.pendingDeps, Queued: p.queued, Downloading: []string{}, Done: p.done, Failed: p.failed}
+	for name := range p.downloading {
+		s.Downloading = append(s.Downloading, name)
+	}
+	sort.Strings(s.Downloading)
+
+	return s
+}
+
+// String returns the number of modules processed out of the total, the
+// total may still grow while dependencies are pending: "12/40 +deps pending"
+func (s progressSnapshot) String() string {
+	str := fmt.Sprintf("%d/%d", s.Done+s.Failed, s.Total)
+	if s.DepsPending > 0 {
+		str += " +deps pending"
+	}
+
+	return str
+}
+
+func (p *progress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.snapshot())
+}
+
+// serveStatus serves the progress of the run on addr, until the
+// returned listener is closed
+func serveStatus(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := http.Serve(l, &status); err != nil {
+			tracef("status server stopped: %v\n", err)
+		}
+	}()
+	log.Printf("serving progress on %s\n", l.Addr())
+
+	return l, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := &progress{downloading: make(map[string]int)}
+	p.declare(5)
+	p.drop()
+	p.expectDeps()
+	for i := 0; i < 4; i++ {
+		p.queue()
+	}
+	p.start("acme/foo")
+	p.start("acme/bar")
+	// Installed to another folder
+	p.start("acme/bar")
+	p.finish("acme/bar", false)
+	p.finish("acme/foo", true)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	var actual progressSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := progressSnapshot{Total: 4, DepsPending: 1, Queued: 1, Downloading: []string{"acme/bar"}, Done: 1, Failed: 1}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected progress %+v, got %+v", expected, actual)
+	}
+	if actual.String() != "2/4 +deps pending" {
+		t.Errorf("expected progress 2/4 +deps pending, got %s", actual)
+	}
+
+	p.resolveDeps()
+	if s := p.snapshot().String(); s != "2/4" {
+		t.Errorf("expected progress 2/4, got %s", s)
+	}
+}
+
+// TestProgressRetry installs a module whose first download fails, it
+// must not be left queued or downloading once retried
+func TestProgressRetry(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 0
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(tarball(t, []string{"metadata.json"}).Bytes())
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "r10k-go-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	puppetfile := path.Join(dir, "Puppetfile")
+	if err := ioutil.WriteFile(puppetfile, []byte("mod 'acme/foo', :tarball => '"+ts.URL+"/foo.tar.gz'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := status.snapshot()
+	if nErr := installModules([]string{puppetfile}, dir, "", nil, &cache, installOptions{numWorkers: 1, depWorkers: 1}); nErr != 0 {
+		t.Fatalf("%d error(s) installing the module", nErr)
+	}
+	after := status.snapshot()
+
+	if requests != 2 {
+		t.Errorf("expected the download to be retried once, got %d requests", requests)
+	}
+	if after.Queued != before.Queued || len(after.Downloading) != 0 || after.Done != before.Done+1 || after.Failed != before.Failed {
+		t.Errorf("expected the module to be done once retried, got %+v from %+v", after, before)
+	}
+}
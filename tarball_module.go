@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Archives downloaded from a URL are extracted as they are
+const tarballArchiveStrip = 0
+
+// TarballModule is a module downloaded from the URL of a tar.gz archive
+type TarballModule struct {
+	baseModule
+	url      string
+	version  string
+	checksum string // SHA-256 of the archive, not verified if empty
+}
+
+func (m *TarballModule) Version() string {
+	return m.version
+}
+
+// Hash identifies the cache folder of the module by its URL, archives of
+// other URLs or of Forge modules of the same name may differ
+func (m *TarballModule) Hash() string {
+	hasher := sha1.New()
+	hasher.Write([]byte("tarball:" + m.url))
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// archive returns the path of the archive in the cache
+func (m *TarballModule) archive() string {
+	if m.version == "" {
+		// Without version, the archive is downloaded on each install
+		return path.Join(m.cacheFolder, "latest.tar.gz")
+	}
+
+	return path.Join(m.cacheFolder, m.version+".tar.gz")
+}
+
+func (m *TarballModule) reuseContent() bool {
+	if m.version == "" {
+		return false
+	}
+
+	return reuseExtracted(m.archive(), tarballArchiveStrip, m.TargetFolder(), m.version)
+}
+
+func (m *TarballModule) IsUpToDate() bool {
+	_, err := os.Stat(m.TargetFolder())
+	if err != nil {
+		return false
+	} else if m.version == "" {
+		// Module is present and no version specified...
+		return true
+	}
+
+	versionFile := path.Join(m.TargetFolder(), ".version")
+	version, err := ioutil.ReadFile(versionFile)
+	if err != nil {
+		warnf("module %s has no version file, reinstalling it: %v\n", m.Name(), err)
+		return false
+	}
+
+	return string(version) == m.version
+}
+
+// verifyChecksum checks the SHA-256 of the archive
+func (m *TarballModule) verifyChecksum() error {
+	if m.checksum == "" {
+		return nil
+	}
+
+	f, err := os.Open(m.archive())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != m.checksum {
+		return fmt.Errorf("checksum of %s is %s, expected %s", m.url, sum, m.checksum)
+	}
+
+	return nil
+}
+
+// fetch downloads the archive of the module to the cache, and verifies
+// its checksum
+func (m *TarballModule) fetch() DownloadError {
+	if _, err := os.Stat(m.archive()); m.version == "" || err != nil || m.noCache {
+		removeArchive(m.archive())
+		// The archive at the URL of unversioned modules may have changed
+		if m.version == "" {
+			removePartial(m.archive())
+		}
+		if err := downloadFile(rewriteURL(m.url), m.archive()); err != nil {
+			return DownloadError{err, retryable(err)}
+		}
+		recordSource(m.archive(), rewriteURL(m.url))
+	}
+
+	if err := m.verifyChecksum(); err != nil {
+		// Download it again in case it was corrupted
+		removeArchive(m.archive())
+		return DownloadError{err, true}
+	}
+
+	return DownloadError{nil, false}
+}
+
+func (m *TarballModule) cachedMetadata() ([]byte, error) {
+	return archiveFile(m.archive(), tarballArchiveStrip, "metadata.json")
+}
+
+func (m *TarballModule) Download() DownloadError {
+	if derr := fetches.do(m, m.fetch); derr.error != nil {
+		return derr
+	}
+
+	// The extracted module takes at least as much space as the archive
+	if fi, err := os.Stat(m.archive()); err == nil {
+		if err := checkFreeSpace(m.TargetFolder(), fi.Size()); err != nil {
+			return DownloadError{err, false}
+		}
+	}
+
+	download := func() error {
+		return m.fetch().error
+	}
+
+	if err := installCachedArchive(m.archive(), m.TargetFolder(), tarballArchiveStrip, linkFromCache(m), download); err != nil {
+		if !retryable(err) {
+			return DownloadError{err, false}
+		}
+		// The archive in the cache is probably broken, download it again
+		removeArchive(m.archive())
+		return DownloadError{err, true}
+	}
+
+	if err := writeVersion(m.TargetFolder(), m.version); err != nil {
+		return DownloadError{err, false}
+	}
+
+	return DownloadError{nil, false}
+}
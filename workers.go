@@ -0,0 +1,51 @@
+package main
+
+// With --workers auto, modules are downloaded by this many workers per
+// CPU, as downloads mostly wait for the network
+const workersPerCPU = 4
+
+// With --workers auto, this many git modules per CPU are cloned and
+// checked out at once, as git is bound by the disk more than the network
+const gitWorkersPerCPU = 1
+
+// Number of git modules installed at once, unlimited if nil
+var gitSlots chan struct{}
+
+// autoWorkers returns the number of workers to use on a host with cpus
+// CPUs, at most max, and the number of them that can install git
+// modules at once
+func autoWorkers(cpus, max int) (workers int, gitWorkers int) {
+	workers = cpus * workersPerCPU
+	if workers > max {
+		workers = max
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	gitWorkers = cpus * gitWorkersPerCPU
+	if gitWorkers > workers {
+		gitWorkers = workers
+	}
+	if gitWorkers < 1 {
+		gitWorkers = 1
+	}
+
+	return workers, gitWorkers
+}
+
+// withGitSlot runs install, waiting for one of the gitSlots first if m
+// is a git module
+func withGitSlot(m PuppetModule, install func() DownloadError) DownloadError {
+	if _, ok := m.(*GitModule); ok && gitSlots != nil {
+		gitSlots <- struct{}{}
+		defer func() { <-gitSlots }()
+	}
+
+	return install()
+}
+
+// download installs the module, see withGitSlot
+func download(m PuppetModule) DownloadError {
+	return withGitSlot(m, m.Download)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutoWorkers(t *testing.T) {
+	testCases := []struct {
+		cpus, max           int
+		workers, gitWorkers int
+	}{
+		{1, 32, 4, 1},
+		{4, 32, 16, 4},
+		{16, 32, 32, 16},
+		{64, 32, 32, 32},
+		{4, 2, 2, 2},
+	}
+
+	for _, c := range testCases {
+		workers, gitWorkers := autoWorkers(c.cpus, c.max)
+		if workers != c.workers || gitWorkers != c.gitWorkers {
+			t.Errorf("expected %d workers and %d git workers for %d CPUs at most %d, got %d and %d", c.workers, c.gitWorkers, c.cpus, c.max, workers, gitWorkers)
+		}
+	}
+}
+
+func TestWithGitSlot(t *testing.T) {
+	defer func() { gitSlots = nil }()
+	gitSlots = make(chan struct{}, 2)
+
+	var running, maxRunning int32
+	install := func() DownloadError {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return DownloadError{nil, false}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			withGitSlot(&GitModule{}, install)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 git modules to be installed at once, got %d", maxRunning)
+	}
+}